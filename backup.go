@@ -0,0 +1,389 @@
+package docdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This file contains backups and restores.
+//
+// Primary data and the index are separate stores, written one after
+// the other, so copying their directories while the database is open
+// can give an index that doesn't match the documents. A backup holds
+// writeMu, which every write of either store takes, and idx.mu, so
+// that the index isn't replaced by a reindex, while it takes a Pebble
+// checkpoint of each store. Checkpoints hard link the stores' files
+// where they can, so the database is only blocked for a moment. A
+// running reindex's shadow index is backed up too, so that the reindex
+// resumes after a restore. Stores that can't checkpoint, such as
+// those in memory, are copied from snapshots taken under the same
+// locks.
+//
+// A backup is a directory laid out like a database at "data" in it,
+// with a manifest, backup.json, recording the index format version.
+// Restoring copies the stores to where the database will be opened,
+// after checking the version, or copies primary data alone and builds
+// a new index from it.
+//
+// Backups requested over HTTP are only written in the directory
+// given to DB.SetBackupRoot, so that clients of the API can't write
+// anywhere the server can. Symlinks are resolved before checking, so
+// a link in the root can't lead a backup out of it.
+
+var (
+	// errBackupsDisabled is returned for backups requested over HTTP
+	// when there's no backup root.
+	errBackupsDisabled = errors.New("Backups over HTTP aren't enabled")
+	// errBadBackupDir is returned for backup directories requested
+	// over HTTP that aren't inside the backup root.
+	errBadBackupDir = errors.New("Backup dir must be a relative path inside the backup root")
+)
+
+// backupFormatVersion is the version of the layout of backups
+// written by this code.
+const backupFormatVersion = 1
+
+// backupManifest is the name of the manifest file in a backup.
+const backupManifest = "backup.json"
+
+// backupData is the path, in a backup, of the database's primary
+// data. The index is at backupData + ".index", as with Open.
+const backupData = "data"
+
+// BackupInfo is the manifest of a backup.
+type BackupInfo struct {
+	Version      int       `json:"version"`
+	IndexVersion int       `json:"index_version"`
+	Created      time.Time `json:"created"`
+	// Reindexing is true if a reindex was running, in which case the
+	// backup holds the unfinished index too.
+	Reindexing bool `json:"reindexing,omitempty"`
+}
+
+// RestoreOptions control how a backup is restored.
+type RestoreOptions struct {
+	// RebuildIndex restores primary data alone and builds a new index
+	// from it, rather than restoring the backed up index. Backups
+	// whose index is in another format version can only be restored
+	// this way.
+	RebuildIndex bool
+	// Options are the index options of the default collection, as
+	// passed to Open, used when rebuilding the index. The other
+	// collections' options are in primary data.
+	Options *Options
+}
+
+// kvCheckpointer is implemented by KVs that can write a consistent
+// copy of themselves, as of the call, to a new database at a
+// directory.
+type kvCheckpointer interface {
+	Checkpoint(dir string) error
+}
+
+// backupStore is a store to back up, and its path in the backup.
+type backupStore struct {
+	kv   KV
+	path string
+	snap KVSnapshot // Taken for stores that can't checkpoint
+}
+
+// backup writes a consistent copy of the database to dir, which
+// mustn't exist.
+func (s server) backup(dir string) (*BackupInfo, error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{Version: backupFormatVersion, IndexVersion: indexFormatVersion, Created: time.Now().UTC()}
+	stores, err := s.checkpointStores(dir, info)
+	for _, store := range stores {
+		if store.snap == nil {
+			continue
+		}
+		if err == nil {
+			err = copyKV(store.snap, store.path)
+		}
+		store.snap.Close()
+	}
+	if err == nil {
+		err = writeBackupInfo(dir, info)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return info, nil
+}
+
+// checkpointStores checkpoints the stores of the database into dir
+// while holding the locks of writes, and returns them, with snapshots
+// of the ones still to copy.
+func (s server) checkpointStores(dir string, info *BackupInfo) ([]backupStore, error) {
+	s.idx.mu.RLock()
+	defer s.idx.mu.RUnlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	data := filepath.Join(dir, backupData)
+	stores := []backupStore{{kv: s.cols.root, path: data}, {kv: s.idx.db, path: data + ".index"}}
+	if s.idx.shadow != nil {
+		stores = append(stores, backupStore{kv: s.idx.shadow, path: data + ".index.reindex"})
+		info.Reindexing = true
+	}
+	for i := range stores {
+		if c, ok := stores[i].kv.(kvCheckpointer); ok {
+			if err := c.Checkpoint(stores[i].path); err != nil {
+				return stores, err
+			}
+		} else {
+			stores[i].snap = stores[i].kv.NewSnapshot()
+		}
+	}
+	return stores, nil
+}
+
+// copyKV copies every key of r into a new Pebble database at path.
+func copyKV(r KVReader, path string) error {
+	db, err := OpenPebbleKV(path)
+	if err != nil {
+		return err
+	}
+	iter := r.NewIter(nil)
+	b := db.NewBatch()
+	for iter.First(); iter.Valid() && err == nil; iter.Next() {
+		err = b.Set(iter.Key(), iter.Value())
+		if err == nil && b.Count() >= migrationBatchSize {
+			err = db.Apply(b)
+			b.Close()
+			b = db.NewBatch()
+		}
+	}
+	if err == nil {
+		err = db.Apply(b)
+	}
+	b.Close()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeBackupInfo writes info as the manifest of the backup at dir.
+// It's written last, so a directory with one is a complete backup.
+func writeBackupInfo(dir string, info *BackupInfo) error {
+	manifest, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, backupManifest), manifest, 0644)
+}
+
+// readBackupInfo returns the manifest of the backup at dir.
+func readBackupInfo(dir string) (*BackupInfo, error) {
+	manifest, err := os.ReadFile(filepath.Join(dir, backupManifest))
+	if os.IsNotExist(err) {
+		return nil, errors.New(fmt.Sprintf("%s is not a docdb backup", dir))
+	} else if err != nil {
+		return nil, err
+	}
+	var info BackupInfo
+	if err := json.Unmarshal(manifest, &info); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad backup manifest: %v", err))
+	}
+	if info.Version != backupFormatVersion {
+		return nil, errors.New(fmt.Sprintf(
+			"Backup format version %d isn't supported, upgrade docdb", info.Version))
+	}
+	return &info, nil
+}
+
+// Backup writes a consistent copy of the database, its documents and
+// index, to a new directory dir, while the database stays open. Each
+// store is copied with a Pebble checkpoint, which is quick, but dir
+// must be on the same filesystem as the database to avoid copying
+// every file. The copy can be restored with Restore.
+func (db *DB) Backup(dir string) (*BackupInfo, error) {
+	return db.s.backup(dir)
+}
+
+// SetBackupRoot lets the HTTP API write backups, to directories in
+// root named by the request. Until it's called, or if root is "",
+// POST /_backup is refused.
+func (db *DB) SetBackupRoot(root string) {
+	db.s.cols.mu.Lock()
+	defer db.s.cols.mu.Unlock()
+	db.s.cols.backupRoot = root
+}
+
+// backupPath returns the path of dir, a directory requested over
+// HTTP, in the backup root, with symlinks resolved.
+func (s server) backupPath(dir string) (string, error) {
+	s.cols.mu.RLock()
+	root := s.cols.backupRoot
+	s.cols.mu.RUnlock()
+	if root == "" {
+		return "", errBackupsDisabled
+	}
+
+	if dir == "" || filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" {
+		return "", errBadBackupDir
+	}
+	for _, part := range strings.Split(filepath.ToSlash(dir), "/") {
+		if part == ".." {
+			return "", errBadBackupDir
+		}
+	}
+
+	root, err := resolveExisting(root)
+	if err != nil {
+		return "", err
+	}
+	path, err := resolveExisting(filepath.Join(root, dir))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errBadBackupDir
+	}
+	return path, nil
+}
+
+// resolveExisting returns path with the symlinks in the part of it
+// that exists resolved. The rest is yet to be created, so it can't
+// contain links, except dangling ones, for which it returns
+// errBadBackupDir.
+func resolveExisting(path string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return "", errBadBackupDir
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// Restore restores the backup at dir as the database at path, which
+// mustn't exist, and returns its manifest. It checks the backup's
+// index format version, and that the restored database opens. Unless
+// opts.RebuildIndex, the index must be in the current format version.
+func Restore(dir, path string, opts *RestoreOptions) (*BackupInfo, error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	info, err := readBackupInfo(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.RebuildIndex && info.IndexVersion != indexFormatVersion {
+		return nil, errors.New(fmt.Sprintf(
+			"Backup index format version %d isn't %d, rebuild the index instead",
+			info.IndexVersion, indexFormatVersion))
+	}
+
+	storage := pebbleStorage{path}
+	paths := []string{path, storage.indexPath(), storage.shadowPath()}
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return nil, errors.New(fmt.Sprintf("%s already exists", p))
+		}
+	}
+	err = restoreStores(dir, paths, info, opts)
+	if err != nil {
+		for _, p := range paths {
+			os.RemoveAll(p)
+		}
+		return nil, err
+	}
+	return info, nil
+}
+
+// restoreStores copies the stores of the backup at dir, with manifest
+// info, to paths, the paths of the primary data, index and shadow
+// index of the database, and opens the database to check it.
+func restoreStores(dir string, paths []string, info *BackupInfo, opts *RestoreOptions) error {
+	data := filepath.Join(dir, backupData)
+	from := []string{data}
+	if !opts.RebuildIndex {
+		from = append(from, data+".index")
+		if info.Reindexing {
+			from = append(from, data+".index.reindex")
+		}
+	}
+	for i, src := range from {
+		if err := copyDir(src, paths[i]); err != nil {
+			return err
+		}
+	}
+
+	db, err := Open(paths[0], opts.Options)
+	if err != nil {
+		return err
+	}
+	if opts.RebuildIndex {
+		err = db.s.reindex(reindexOptions{batchSize: migrationBatchSize})
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyDir copies the directory src, and everything in it, to dst.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target)
+	})
+}
+
+// copyFile copies the file src to dst, and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package docdb
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assertRestored checks that the database at path has the documents
+// written before the backup of Test_backup.
+func assertRestored(t *testing.T, path string) {
+	ctx := context.Background()
+	db, err := Open(path, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open restored database")
+	}
+	defer db.Close()
+
+	doc, err := db.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), doc.Rev)
+	_, err = db.Get(ctx, "later")
+	assert.Equal(t, ErrNotFound, err)
+	docs, err := db.Find(ctx, "name:Kate")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+
+	notes, err := db.Collection("notes")
+	assert.Nil(t, err)
+	docs, err = notes.Find(ctx, `text:~"backups"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+	ok, err := db.Check(false, &strings.Builder{})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func Test_backup(t *testing.T) {
+	ctx := context.Background()
+	d := t.TempDir()
+	db, err := Open(filepath.Join(d, "docdb.data"), nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open database")
+	}
+	defer db.Close()
+	db.Put(ctx, "a", map[string]any{"name": "Phil"})
+	db.Put(ctx, "a", map[string]any{"name": "Kate"})
+	notes, err := db.CreateCollection("notes", &Options{FullText: []string{"text"}})
+	assert.Nil(t, err)
+	notes.Put(ctx, "n1", map[string]any{"text": "consistent backups"})
+
+	backup := filepath.Join(d, "backup")
+	info, err := db.Backup(backup)
+	assert.Nil(t, err)
+	assert.Equal(t, indexFormatVersion, info.IndexVersion)
+	assert.False(t, info.Reindexing)
+	db.Put(ctx, "later", map[string]any{})
+	_, err = db.Backup(backup)
+	assert.True(t, os.IsExist(err))
+
+	restored := filepath.Join(d, "restored.data")
+	restoredInfo, err := Restore(backup, restored, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Created.Unix(), restoredInfo.Created.Unix())
+	assertRestored(t, restored)
+
+	rebuilt := filepath.Join(d, "rebuilt.data")
+	_, err = Restore(backup, rebuilt, &RestoreOptions{RebuildIndex: true})
+	assert.Nil(t, err)
+	assertRestored(t, rebuilt)
+
+	// Restores never overwrite a database
+	_, err = Restore(backup, restored, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "already exists")
+	}
+}
+
+func Test_restoreVersions(t *testing.T) {
+	d := t.TempDir()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open database")
+	}
+	defer db.Close()
+	db.Put(context.Background(), "a", map[string]any{"name": "Kate"})
+
+	// Databases in memory are copied rather than checkpointed
+	backup := filepath.Join(d, "backup")
+	info, err := db.Backup(backup)
+	assert.Nil(t, err)
+
+	info.IndexVersion = indexFormatVersion + 1
+	assert.Nil(t, writeBackupInfo(backup, info))
+	_, err = Restore(backup, filepath.Join(d, "a.data"), nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "index format version")
+	}
+	_, err = os.Stat(filepath.Join(d, "a.data"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = Restore(backup, filepath.Join(d, "a.data"), &RestoreOptions{RebuildIndex: true})
+	assert.Nil(t, err)
+
+	info.Version = backupFormatVersion + 1
+	assert.Nil(t, writeBackupInfo(backup, info))
+	_, err = Restore(backup, filepath.Join(d, "b.data"), &RestoreOptions{RebuildIndex: true})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Backup format version")
+	}
+	_, err = Restore(d, filepath.Join(d, "c.data"), nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not a docdb backup")
+	}
+}
+
+func Test_backupDuringReindex(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(filepath.Join(d, "docdb.data"), nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	defer s.close()
+	s.addDocument("a", map[string]any{"name": "Kate"})
+	s.addDocument("b", map[string]any{"name": "Phil"})
+
+	// Stop a reindex after its first document
+	checkpoint, err := s.startShadow()
+	assert.Nil(t, err)
+	_, more, err := s.reindexBatch(checkpoint, 1)
+	assert.Nil(t, err)
+	assert.True(t, more)
+
+	backup := filepath.Join(d, "backup")
+	info, err := s.backup(backup)
+	assert.Nil(t, err)
+	assert.True(t, info.Reindexing)
+
+	restored := filepath.Join(d, "restored.data")
+	_, err = Restore(backup, restored, nil)
+	assert.Nil(t, err)
+	db, err := Open(restored, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open restored database")
+	}
+	defer db.Close()
+	assert.NotNil(t, db.s.idx.shadow)
+	assert.Nil(t, db.s.reindex(reindexOptions{batchSize: 1}))
+	docs, err := db.Find(context.Background(), "name:Phil")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+}
+
+func Test_httpBackup(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	root := t.TempDir()
+
+	// Backups over HTTP are only allowed inside the backup root
+	resp, _ := doRequest(t, s, "POST", "/_backup", `{"dir": "backup"}`, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	s.cols.backupRoot = root
+	outside := t.TempDir()
+	os.Symlink(outside, filepath.Join(root, "link"))
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling"))
+	for _, dir := range []string{filepath.Join(root, "backup"), "../backup", "a/../../backup", "link/backup", "dangling/backup"} {
+		resp, _ = doRequest(t, s, "POST", "/_backup", `{"dir": "`+dir+`"}`, nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, dir)
+	}
+
+	resp, body := doRequest(t, s, "POST", "/_backup", `{"dir": "backup"}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(indexFormatVersion), body["body"].(map[string]any)["index_version"])
+	_, err = readBackupInfo(filepath.Join(root, "backup"))
+	assert.Nil(t, err)
+
+	resp, _ = doRequest(t, s, "POST", "/_backup", `{"dir": "backup"}`, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = doRequest(t, s, "POST", "/_backup", `{}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
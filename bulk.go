@@ -0,0 +1,229 @@
+package docdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// This file contains bulk writes, which store many documents with
+// one write to primary data and one to the index, rather than a
+// synced write of each for every document.
+//
+// A bulk write stages every document in a batch of each database,
+// holding writeMu throughout, so revisions are read through the
+// primary data batch and a document written twice in one bulk write
+// gets two revisions. Unlike a transaction, documents succeed or
+// fail on their own: a document whose expected revision doesn't
+// match is left out with ErrConflict and the rest are written.
+
+// defaultBulkBatchSize is the number of documents written together
+// by the bulk API and by a BulkWriter with no batch size.
+const defaultBulkBatchSize = 1000
+
+// errMissingBody is returned for bulk write lines without a body.
+var errMissingBody = errors.New("Missing document body")
+
+// bulkWrite is a document to store in a bulk write.
+type bulkWrite struct {
+	id       string
+	document map[string]any
+	rev      uint64 // Expected revision, anyRevision for any
+}
+
+// BulkResult is the outcome of storing one document in a bulk write.
+type BulkResult struct {
+	ID  string
+	Rev uint64 // New revision, if Err is nil
+	Err error
+}
+
+// bulkLine is a line of a bulk write request or export. A line
+// without an id inserts a document with a new ID, and one with a rev
+// stores it only if that's the stored document's revision, 0 for
+// none.
+type bulkLine struct {
+	ID   string         `json:"id"`
+	Rev  *uint64        `json:"rev,omitempty"`
+	Body map[string]any `json:"body"`
+}
+
+// parseBulkLine returns the write for the JSON bulkLine in data. On
+// error, the write has the line's ID, if it has one.
+func (s server) parseBulkLine(data []byte) (bulkWrite, error) {
+	var line bulkLine
+	err := json.Unmarshal(data, &line)
+	if err == nil && line.Body == nil {
+		err = errMissingBody
+	}
+
+	write := bulkWrite{id: line.ID, document: line.Body, rev: anyRevision}
+	if line.Rev != nil {
+		write.rev = *line.Rev
+	}
+	if err == nil && write.id == "" {
+		write.id, err = s.newID()
+		if line.Rev == nil {
+			write.rev = 0
+		}
+	}
+	return write, err
+}
+
+// bulkWrite stores writes together, and returns the result of each.
+// The error is for failures that stop every write.
+func (s server) bulkWrite(writes []bulkWrite) ([]BulkResult, error) {
+	results := make([]BulkResult, len(writes))
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	b := s.db.NewBatch()
+	defer b.Close()
+	indexDb := s.indexDb()
+	ib := indexDb.NewBatch()
+	defer ib.Close()
+
+	var written []string
+	var changes []Change
+	for i, w := range writes {
+		results[i].ID = w.id
+		if !validID(w.id) {
+			results[i].Err = errBadID
+			continue
+		}
+
+		current, err := readRevision(b, []byte(w.id))
+		if err != nil {
+			return nil, err
+		}
+		if w.rev != anyRevision && w.rev != current {
+			results[i].Err = ErrConflict
+			continue
+		}
+
+		next, err := s.nextRevision([]byte(w.id), current)
+		if err != nil {
+			return nil, err
+		}
+		document, err := s.storedDocument(w.document)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		bs, err := encodeDocument(document, next)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		err = indexBatch(ib, s.cfg, w.id, document)
+		if err != nil {
+			return nil, err
+		}
+		err = b.Set([]byte(w.id), bs)
+		if err != nil {
+			return nil, err
+		}
+
+		results[i].Rev = next
+		written = append(written, w.id)
+		changes = append(changes, Change{ID: w.id, Rev: next})
+	}
+	if len(written) == 0 {
+		return results, nil
+	}
+	seq, err := s.logChanges(b, changes...)
+	if err != nil {
+		return nil, err
+	}
+
+	// As with putDocument, the index is written first
+	if err := indexDb.Apply(ib); err != nil {
+		return nil, err
+	}
+	if err := s.db.Apply(b); err != nil {
+		return nil, err
+	}
+	s.feed.publish(seq)
+	return results, s.updateShadow(written...)
+}
+
+// BulkWriter stores documents in a collection in batches, which is
+// much faster than storing them one at a time. Documents are written
+// when a batch fills up and by Flush, which returns their results.
+// It isn't safe for concurrent use.
+type BulkWriter struct {
+	c         *Collection
+	batchSize int
+	pending   []bulkWrite
+	results   []BulkResult
+}
+
+// NewBulkWriter returns a BulkWriter for the collection that writes
+// batchSize documents at a time, or 1000 if batchSize is 0.
+func (c *Collection) NewBulkWriter(batchSize int) *BulkWriter {
+	if batchSize <= 0 {
+		batchSize = defaultBulkBatchSize
+	}
+	return &BulkWriter{c: c, batchSize: batchSize}
+}
+
+// NewBulkWriter returns a BulkWriter for the default collection. See
+// Collection.NewBulkWriter.
+func (db *DB) NewBulkWriter(batchSize int) *BulkWriter {
+	return db.def.NewBulkWriter(batchSize)
+}
+
+// Put adds storing body as the document with id, replacing any
+// existing document, to the batch.
+func (w *BulkWriter) Put(ctx context.Context, id string, body map[string]any) error {
+	return w.PutIf(ctx, id, body, anyRevision)
+}
+
+// PutIf adds storing body as the document with id, if rev is its
+// revision, to the batch. See Collection.PutIf.
+func (w *BulkWriter) PutIf(ctx context.Context, id string, body map[string]any, rev uint64) error {
+	w.pending = append(w.pending, bulkWrite{id: id, document: body, rev: rev})
+	if len(w.pending) < w.batchSize {
+		return ctx.Err()
+	}
+	return w.write(ctx)
+}
+
+// Insert adds storing body with a new ID to the batch, and returns
+// the ID. See Collection.Insert.
+func (w *BulkWriter) Insert(ctx context.Context, body map[string]any) (string, error) {
+	id, err := w.c.s.newID()
+	if err != nil {
+		return "", err
+	}
+	return id, w.PutIf(ctx, id, body, 0)
+}
+
+// Flush writes the documents in the batch, and returns the results
+// of every document added since the last Flush, in the order they
+// were added. The error is for failures that stopped a batch being
+// written, and its documents have no results.
+func (w *BulkWriter) Flush(ctx context.Context) ([]BulkResult, error) {
+	err := w.write(ctx)
+	results := w.results
+	w.results = nil
+	return results, err
+}
+
+// write writes the pending documents.
+func (w *BulkWriter) write(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(w.pending) == 0 {
+		return nil
+	}
+	results, err := w.c.s.bulkWrite(w.pending)
+	w.pending = w.pending[:0]
+	w.results = append(w.results, results...)
+	return err
+}
@@ -0,0 +1,110 @@
+package docdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_bulkWrite(t *testing.T) {
+	s, err := newMemoryServer(&indexConfig{fullText: []string{"bio"}})
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("phil", map[string]any{"name": "Phil"})
+
+	results, err := s.bulkWrite([]bulkWrite{
+		{id: "mike", document: map[string]any{"name": "Mike", "bio": "Writes databases"}, rev: 0},
+		{id: "phil", document: map[string]any{"name": "Phil"}, rev: 0},
+		{id: "mike", document: map[string]any{"name": "Michael", "bio": "Writes databases"}, rev: 1},
+		{id: "", document: map[string]any{}, rev: anyRevision},
+		{id: "tim", document: map[string]any{"name": "Tim"}, rev: anyRevision},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []BulkResult{
+		{ID: "mike", Rev: 1},
+		{ID: "phil", Err: ErrConflict},
+		{ID: "mike", Rev: 2},
+		{ID: "", Err: errBadID},
+		{ID: "tim", Rev: 1},
+	}, results)
+
+	ids, _ := lookupEq(s.idx.db, nil, "name", "Michael")
+	assert.Equal(t, []string{"mike"}, ids)
+	ids, _ = lookupEq(s.idx.db, nil, "name", "Mike")
+	assert.Empty(t, ids)
+	ids, _ = lookupText(s.idx.db, "bio", "databases")
+	assert.Equal(t, []string{"mike"}, ids)
+	report, _ := s.checkIndex(false)
+	assert.True(t, report.ok())
+}
+
+func Test_BulkWriter(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(&Options{IDs: "counter"})
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+
+	w := db.NewBulkWriter(2)
+	assert.NoError(t, w.Put(ctx, "a", map[string]any{"n": 1}))
+	assert.NoError(t, w.PutIf(ctx, "b", map[string]any{"n": 2}, 3))
+	// The first batch is written when it's full
+	doc, err := db.Get(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, doc.Body["n"])
+
+	id, err := w.Insert(ctx, map[string]any{"n": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "00000000000000000001", id)
+	results, err := w.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []BulkResult{
+		{ID: "a", Rev: 1},
+		{ID: "b", Err: ErrConflict},
+		{ID: id, Rev: 1},
+	}, results)
+	results, err = w.Flush(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	docs, _ := db.Find(ctx, "n:>0")
+	assert.Len(t, docs, 2)
+}
+
+func benchmarkWrites(b *testing.B, write func(s *server, ids []string)) {
+	s, err := newServer(b.TempDir(), nil)
+	if err != nil {
+		b.Fatalf("Failed due to error: %v", err)
+	}
+	defer s.close()
+
+	ids := make([]string, 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range ids {
+			ids[j] = fmt.Sprintf("%d-%d", i, j)
+		}
+		write(s, ids)
+	}
+}
+
+func Benchmark_putDocument(b *testing.B) {
+	benchmarkWrites(b, func(s *server, ids []string) {
+		for _, id := range ids {
+			s.addDocument(id, map[string]any{"name": id, "n": 1})
+		}
+	})
+}
+
+func Benchmark_bulkWrite(b *testing.B) {
+	benchmarkWrites(b, func(s *server, ids []string) {
+		writes := make([]bulkWrite, len(ids))
+		for i, id := range ids {
+			writes[i] = bulkWrite{id: id, document: map[string]any{"name": id, "n": 1}, rev: anyRevision}
+		}
+		s.bulkWrite(writes)
+	})
+}
@@ -0,0 +1,254 @@
+package docdb
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// This file contains change feeds, which let other systems follow the
+// writes to a collection, such as to keep a cache or search cluster
+// in step with it.
+//
+// Every write of a document is given the next sequence number of its
+// collection, and a change recording the document's ID, its new
+// revision or the revision deleted, and whether it was deleted, is
+// kept under changeKey(name, seq) in primary data. The change is in
+// the same batch as the document, so a stored document always has its
+// change. Consumers read the changes after the last sequence number
+// they've seen, so they can stop and resume where they left off.
+//
+// Changes are kept until the collection is dropped, when its feed
+// starts again from 1.
+
+// Change is a write of a document in a collection's change feed.
+type Change struct {
+	Seq     uint64 `json:"seq"`
+	ID      string `json:"id"`
+	Rev     uint64 `json:"rev"` // New revision, or the revision deleted
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// changesPrefix returns the primary data key prefix of the changes of
+// collection name.
+func changesPrefix(name string) []byte {
+	return metaKey(changesMeta, name, nil)
+}
+
+// changeKey returns the primary data key of change seq of collection
+// name. Sequence numbers are big endian, so changes are in order.
+func changeKey(name string, seq uint64) []byte {
+	key := changesPrefix(name)
+	key = append(key, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(key[len(key)-8:], seq)
+	return key
+}
+
+// encodeChange serialises c, without its sequence number, which is in
+// its key.
+func encodeChange(c Change) []byte {
+	b := binary.AppendUvarint(nil, c.Rev)
+	if c.Deleted {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	return append(b, c.ID...)
+}
+
+// decodeChange deserialises the change with key and value.
+func decodeChange(key, value []byte) (Change, error) {
+	rev, n := binary.Uvarint(value)
+	if n <= 0 || len(value) == n {
+		return Change{}, errors.New("Bad change record")
+	}
+	return Change{
+		Seq:     binary.BigEndian.Uint64(key[len(key)-8:]),
+		ID:      string(value[n+1:]),
+		Rev:     rev,
+		Deleted: value[n] == 1,
+	}, nil
+}
+
+// changeFeed tracks the last sequence number of a collection, and
+// wakes the readers waiting for it to change.
+type changeFeed struct {
+	mu   sync.Mutex
+	seq  uint64        // Last sequence number written
+	wake chan struct{} // Closed when seq changes or the collection is dropped
+}
+
+// loadChangeFeed returns the feed of collection name, starting from
+// the last change stored in root.
+func loadChangeFeed(root KVReader, name string) (*changeFeed, error) {
+	prefix := changesPrefix(name)
+	iter := root.NewIter(&IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)})
+	defer iter.Close()
+
+	f := &changeFeed{wake: make(chan struct{})}
+	if iter.Last() {
+		c, err := decodeChange(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		f.seq = c.Seq
+	}
+	return f, nil
+}
+
+// last returns the last sequence number written.
+func (f *changeFeed) last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seq
+}
+
+// publish records that the changes up to seq are written, and wakes
+// waiting readers.
+func (f *changeFeed) publish(seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq = seq
+	close(f.wake)
+	f.wake = make(chan struct{})
+}
+
+// wait returns once there are changes after since, the feed's
+// collection is dropped, or ctx is done.
+func (f *changeFeed) wait(ctx context.Context, since uint64) error {
+	f.mu.Lock()
+	seq, wake := f.seq, f.wake
+	f.mu.Unlock()
+	if seq > since {
+		return nil
+	}
+	select {
+	case <-wake:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logChanges stages changes in b, a batch of s.db, with the sequence
+// numbers after the last one written, and returns the last of them.
+// Deletes also record a tombstone of the document's revision. The
+// caller must hold writeMu, and publish the sequence number once b is
+// applied.
+func (s server) logChanges(b KVBatch, changes ...Change) (uint64, error) {
+	// Changes are outside the collection's prefix
+	b = rootBatch(b)
+	seq := s.feed.last()
+	for _, c := range changes {
+		seq++
+		if err := b.Set(changeKey(s.name, seq), encodeChange(c)); err != nil {
+			return 0, err
+		}
+		if !c.Deleted {
+			continue
+		}
+		err := b.Set(tombstoneKey(s.name, c.ID), binary.AppendUvarint(nil, c.Rev))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// changesSince returns up to limit changes of s after since, or all of
+// them if limit is 0.
+func (s server) changesSince(since uint64, limit int) ([]Change, error) {
+	prefix := changesPrefix(s.name)
+	iter := s.cols.root.NewIter(&IterOptions{
+		LowerBound: changeKey(s.name, since+1),
+		UpperBound: prefixEnd(prefix),
+	})
+	defer iter.Close()
+
+	changes := []Change{}
+	for iter.First(); iter.Valid() && (limit == 0 || len(changes) < limit); iter.Next() {
+		c, err := decodeChange(iter.Key(), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// waitForChanges returns once s has changes after since, or ctx is
+// done. It returns ErrNoCollection if s is dropped.
+func (s server) waitForChanges(ctx context.Context, since uint64) error {
+	if err := s.feed.wait(ctx, since); err != nil {
+		return err
+	}
+	if !s.exists() {
+		return ErrNoCollection
+	}
+	return nil
+}
+
+// Changes returns up to limit changes of the collection after
+// sequence number since, in order, or all of them if limit is 0.
+func (c *Collection) Changes(ctx context.Context, since uint64, limit int) ([]Change, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.s.changesSince(since, limit)
+}
+
+// Changes returns changes of the default collection. See
+// Collection.Changes.
+func (db *DB) Changes(ctx context.Context, since uint64, limit int) ([]Change, error) {
+	return db.def.Changes(ctx, since, limit)
+}
+
+// Subscription follows the change feed of a collection. It isn't
+// safe for concurrent use.
+type Subscription struct {
+	s       server
+	since   uint64
+	pending []Change
+}
+
+// Subscribe returns a Subscription to the changes of the collection
+// after sequence number since, 0 for every change. To resume after a
+// restart, pass the Seq of the last change handled.
+func (c *Collection) Subscribe(since uint64) *Subscription {
+	return &Subscription{s: *c.s, since: since}
+}
+
+// Subscribe returns a Subscription to the changes of the default
+// collection. See Collection.Subscribe.
+func (db *DB) Subscribe(since uint64) *Subscription {
+	return db.def.Subscribe(since)
+}
+
+// subscriptionBatchSize is the number of changes a Subscription reads
+// at a time.
+const subscriptionBatchSize = 100
+
+// Next returns the next change, waiting for one if there isn't one
+// yet, until ctx is done. It returns ErrNoCollection once the
+// collection is dropped.
+func (sub *Subscription) Next(ctx context.Context) (Change, error) {
+	for len(sub.pending) == 0 {
+		changes, err := sub.s.changesSince(sub.since, subscriptionBatchSize)
+		if err != nil {
+			return Change{}, err
+		}
+		if len(changes) > 0 {
+			sub.pending = changes
+			break
+		}
+		if err := sub.s.waitForChanges(ctx, sub.since); err != nil {
+			return Change{}, err
+		}
+	}
+
+	c := sub.pending[0]
+	sub.pending = sub.pending[1:]
+	sub.since = c.Seq
+	return c, nil
+}
@@ -0,0 +1,114 @@
+package docdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_changes(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	s.addDocument("mike", map[string]any{"age": 40})
+	s.addDocument("mike", map[string]any{"age": 41})
+	s.addDocument("phil", map[string]any{"age": 41})
+	assert.Nil(t, s.deleteDocument("mike", anyRevision))
+	s.bulkWrite([]bulkWrite{
+		{id: "tim", document: map[string]any{}, rev: anyRevision},
+		{id: "phil", document: map[string]any{}, rev: 0},
+	})
+	ctx := context.Background()
+	tx := s.begin()
+	tx.Get(ctx, "tim")
+	tx.Put(ctx, "kim", map[string]any{})
+	tx.Delete(ctx, "phil")
+	assert.Nil(t, tx.Commit(ctx))
+	// Other collections have feeds of their own
+	other, _ := s.createCollection("other", nil)
+	other.addDocument("mike", map[string]any{})
+
+	changes, err := s.changesSince(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Seq: 1, ID: "mike", Rev: 1},
+		{Seq: 2, ID: "mike", Rev: 2},
+		{Seq: 3, ID: "phil", Rev: 1},
+		{Seq: 4, ID: "mike", Rev: 2, Deleted: true},
+		{Seq: 5, ID: "tim", Rev: 1},
+		{Seq: 6, ID: "kim", Rev: 1},
+		{Seq: 7, ID: "phil", Rev: 1, Deleted: true},
+	}, changes)
+	changes, _ = s.changesSince(5, 1)
+	assert.Equal(t, []Change{{Seq: 6, ID: "kim", Rev: 1}}, changes)
+	changes, _ = other.changesSince(0, 0)
+	assert.Equal(t, []Change{{Seq: 1, ID: "mike", Rev: 1}}, changes)
+
+	// Change keys belong to no collection
+	report, _ := s.checkIndex(false)
+	assert.True(t, report.ok())
+
+	// Sequence numbers carry on after a restart
+	s.cols.root.Close()
+	s.idx.db.Close()
+	s, err = newServer(d, nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	defer s.close()
+	s.addDocument("tim", map[string]any{})
+	changes, _ = s.changesSince(7, 0)
+	assert.Equal(t, []Change{{Seq: 8, ID: "tim", Rev: 2}}, changes)
+
+	// Dropping a collection drops its feed
+	other, _ = s.collection("other")
+	assert.Nil(t, s.dropCollection("other"))
+	other, _ = s.createCollection("other", nil)
+	changes, _ = other.changesSince(0, 0)
+	assert.Empty(t, changes)
+}
+
+func Test_Subscription(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	db.Put(ctx, "mike", map[string]any{})
+
+	sub := db.Subscribe(0)
+	c, err := sub.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Change{Seq: 1, ID: "mike", Rev: 1}, c)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.Delete(ctx, "mike")
+	}()
+	c, err = sub.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, Change{Seq: 2, ID: "mike", Rev: 1, Deleted: true}, c)
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = sub.Next(timeout)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Resuming from a sequence number
+	c, _ = db.Subscribe(1).Next(ctx)
+	assert.Equal(t, uint64(2), c.Seq)
+
+	other, _ := db.CreateCollection("other", nil)
+	sub = other.Subscribe(0)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.DropCollection("other")
+	}()
+	_, err = sub.Next(ctx)
+	assert.Equal(t, ErrNoCollection, err)
+}
@@ -0,0 +1,222 @@
+package docdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// This file contains the index consistency checker, run with
+// `docdb check`.
+//
+// Primary data and index are separate databases, and index errors
+// are logged rather than failing writes, so the two can drift apart.
+// The checker rebuilds the index that the primary data should have
+// into a scratch database, using the same code as index, then walks
+// it alongside the real index one namespace at a time. As both are
+// sorted, one pass over each finds:
+//
+// - missing keys, which are in the rebuilt index but absent from the
+//   real one, or have a different value there;
+// - orphaned keys, which are in the real index but no document
+//   accounts for them.
+//
+// With repair, missing keys are written and orphaned keys deleted,
+// which leaves the real index the same as the rebuilt one.
+
+// indexNamespaces lists the namespaces in the index database that
+// hold index entries, rather than metadata. The entries of every
+// collection but the default one are in collectionNamespace.
+var indexNamespaces = []byte{
+	collectionNamespace,
+	invIdxNamespace,
+	fwdIdxNamespace,
+	ftsIdxNamespace,
+	ftsLenNamespace,
+	geoIdxNamespace,
+	expIdxNamespace,
+}
+
+// checkReport describes the differences between the index and the
+// primary data found by checkIndex.
+type checkReport struct {
+	documents    int      // Number of documents checked
+	badDocuments []string // IDs of documents that couldn't be decoded
+	missing      [][]byte // Keys absent from the index or with the wrong value
+	orphans      [][]byte // Keys in the index no document accounts for
+	repaired     bool     // Whether missing and orphans have been fixed
+}
+
+// ok returns true if the index and primary data agree.
+func (r *checkReport) ok() bool {
+	return len(r.badDocuments) == 0 && len(r.missing) == 0 && len(r.orphans) == 0
+}
+
+// checkIndex compares the index with the primary data of every
+// collection and, if repair is true, fixes the index to match.
+// Nothing else may write to the databases while it runs.
+func (s server) checkIndex(repair bool) (*checkReport, error) {
+	dir, err := os.MkdirTemp("", "docdb-check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	expected, err := OpenPebbleKV(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer expected.Close()
+
+	report := &checkReport{}
+	iter := s.cols.root.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		c, id := s.cols.forKey(iter.Key())
+		if c == nil {
+			continue
+		}
+		report.documents++
+		document, _, err := decodeDocument(iter.Value())
+		if err != nil {
+			report.badDocuments = append(report.badDocuments, c.describeID(id))
+			continue
+		}
+
+		b := expected.NewBatch()
+		err = indexBatch(c.indexView(b), c.cfg, string(id), document)
+		if err == nil {
+			err = expected.Apply(b)
+		}
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	fix := s.idx.db.NewBatch()
+	defer fix.Close()
+	for _, ns := range indexNamespaces {
+		err := compareNamespace(s.idx.db, expected, ns, report, fix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if repair && fix.Count() > 0 {
+		err = s.idx.db.Apply(fix)
+		if err != nil {
+			return nil, err
+		}
+		report.repaired = true
+	}
+	return report, nil
+}
+
+// compareNamespace adds the differences in namespace ns between the
+// actual and expected indexes to report, and the writes to fix them
+// to fix.
+func compareNamespace(actual, expected KVReader, ns byte, report *checkReport, fix KVBatch) error {
+	readOptions := &IterOptions{
+		LowerBound: []byte{ns},
+		UpperBound: []byte{ns + 1},
+	}
+	actualIter := actual.NewIter(readOptions)
+	expectedIter := expected.NewIter(readOptions)
+	actualIter.First()
+	expectedIter.First()
+
+	var err error
+	for err == nil && (actualIter.Valid() || expectedIter.Valid()) {
+		var c int
+		switch {
+		case !actualIter.Valid():
+			c = 1
+		case !expectedIter.Valid():
+			c = -1
+		default:
+			c = bytes.Compare(actualIter.Key(), expectedIter.Key())
+		}
+
+		if c < 0 {
+			report.orphans = append(report.orphans, append([]byte(nil), actualIter.Key()...))
+			err = fix.Delete(actualIter.Key())
+			actualIter.Next()
+			continue
+		}
+		if c > 0 || !bytes.Equal(actualIter.Value(), expectedIter.Value()) {
+			report.missing = append(report.missing, append([]byte(nil), expectedIter.Key()...))
+			err = fix.Set(expectedIter.Key(), expectedIter.Value())
+		}
+		if c == 0 {
+			actualIter.Next()
+		}
+		expectedIter.Next()
+	}
+
+	if closeErr := actualIter.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := expectedIter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// describeIndexKey returns a readable description of index key k.
+func describeIndexKey(k []byte) string {
+	switch k[0] {
+	case collectionNamespace:
+		if i := bytes.IndexByte(k[1:], 0); i > 0 && len(k) > i+2 {
+			return fmt.Sprintf("%s in collection %s", describeIndexKey(k[i+2:]), k[1:1+i])
+		}
+	case invIdxNamespace:
+		iik, err := decodeInvIndexKey(k)
+		if err == nil {
+			return fmt.Sprintf("inverted %q %s=%q", iik.DocID, iik.Path, iik.TaggedValue)
+		}
+	case fwdIdxNamespace:
+		fik := decodeFwdIdxKey(k)
+		return fmt.Sprintf("forward %q %s=%q", fik.id, fik.path, fik.taggedValue)
+	case ftsIdxNamespace:
+		fk := decodeFtsKey(k)
+		return fmt.Sprintf("full-text %q %s term %q", fk.docID, fk.path, fk.term)
+	case ftsLenNamespace:
+		parts := unpackTupleN(k, 3)
+		if len(parts) == 3 {
+			return fmt.Sprintf("full-text length %q %s", parts[2], parts[1])
+		}
+	case geoIdxNamespace:
+		gk, err := decodeGeoKey(k)
+		if err == nil {
+			return fmt.Sprintf("geo %q %s cell %016x", gk.docID, gk.path, gk.cell)
+		}
+	case expIdxNamespace:
+		if len(k) >= 10 {
+			return fmt.Sprintf("expiry %q at %s", k[10:], decodeTime(k[2:10]).Format(time.RFC3339Nano))
+		}
+	}
+	return fmt.Sprintf("bad key %q", k)
+}
+
+// print writes r to w, one line per problem followed by a summary.
+func (r *checkReport) print(w io.Writer) {
+	for _, id := range r.badDocuments {
+		fmt.Fprintf(w, "bad document %q\n", id)
+	}
+	for _, k := range r.missing {
+		fmt.Fprintf(w, "missing %s\n", describeIndexKey(k))
+	}
+	for _, k := range r.orphans {
+		fmt.Fprintf(w, "orphan %s\n", describeIndexKey(k))
+	}
+
+	fmt.Fprintf(w, "Checked %d documents: %d bad, %d missing index keys, %d orphaned index keys\n",
+		r.documents, len(r.badDocuments), len(r.missing), len(r.orphans))
+	if r.repaired {
+		fmt.Fprintln(w, "Repaired index")
+	}
+}
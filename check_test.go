@@ -0,0 +1,67 @@
+package docdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_checkIndex(t *testing.T) {
+	d := t.TempDir()
+	cfg := &indexConfig{fullText: []string{"bio"}, geo: []string{"home"}}
+	s, err := newServer(d, cfg)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike", map[string]any{
+		"age":  40,
+		"bio":  "Writes databases",
+		"home": map[string]any{"lat": 51.5, "lon": -0.12},
+	})
+	s.addDocument("phil", map[string]any{"age": 41})
+
+	report, err := s.checkIndex(false)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.True(t, report.ok())
+	assert.Equal(t, 2, report.documents)
+
+	// Lose an inverted entry, leave one behind for a document that
+	// no longer exists and add a document that was never indexed
+	missing := encodeInvIdxKey([]byte("age"), encodeTaggedValue(40), []byte("mike"))
+	s.idx.db.Delete(missing)
+	orphan := encodeInvIdxKey([]byte("age"), encodeTaggedValue(50), []byte("gone"))
+	s.idx.db.Set(orphan, nil)
+	bs, _ := encodeDocument(map[string]any{"age": 42}, 1)
+	s.db.Set([]byte("tim"), bs)
+	s.db.Set([]byte("bad"), []byte("{"))
+
+	report, err = s.checkIndex(false)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.False(t, report.ok())
+	assert.Equal(t, []string{"bad"}, report.badDocuments)
+	assert.Contains(t, report.missing, missing)
+	assert.Len(t, report.missing, 3) // mike's entry, tim's two entries
+	assert.Equal(t, [][]byte{orphan}, report.orphans)
+	assert.False(t, report.repaired)
+
+	var out bytes.Buffer
+	report.print(&out)
+	assert.True(t, strings.Contains(out.String(), `missing inverted "mike" age=`))
+	assert.True(t, strings.Contains(out.String(), `orphan inverted "gone" age=`))
+
+	report, _ = s.checkIndex(true)
+	assert.True(t, report.repaired)
+	report, _ = s.checkIndex(false)
+	assert.Empty(t, report.missing)
+	assert.Empty(t, report.orphans)
+	assert.Equal(t, []string{"bad"}, report.badDocuments)
+
+	ids, _ := lookupEq(s.idx.db, cfg, "age", 42)
+	assert.Equal(t, []string{"tim"}, ids)
+}
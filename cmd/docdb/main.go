@@ -0,0 +1,388 @@
+// Command docdb serves a docdb database over HTTP, or maintains it.
+//
+//	docdb [serve] [flags]  Serve the HTTP API on :8080, or follow
+//	                       another docdb with -follow
+//	docdb check [-repair]  Check the index against the documents
+//	docdb migrate          Rewrite the index in the current format
+//	docdb import [flags] [file]
+//	                       Load documents from a file, or stdin
+//	docdb export [flags]   Write documents out as NDJSON
+//	docdb validate-existing [flags]
+//	                       Check stored documents against a schema
+//	docdb backup [-server url] dir
+//	                       Write a consistent copy of the database
+//	docdb restore [-rebuild-index] dir
+//	                       Restore a backup as the database
+//
+// Run a command with -h for its flags. Commands other than serving
+// open the database directly, so the server mustn't be running, but
+// backup -server asks a running server to write the backup instead.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/eatonphil/docdb"
+)
+
+const database = "docdb.data"
+
+func main() {
+	command, args := "", os.Args[1:]
+	// Flags without a command are serve's
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "", "serve":
+		serve(args)
+	case "check":
+		os.Exit(check(args))
+	case "migrate":
+		os.Exit(migrate())
+	case "import":
+		os.Exit(importDocuments(args))
+	case "export":
+		os.Exit(exportDocuments(args))
+	case "validate-existing":
+		os.Exit(validateExisting(args))
+	case "backup":
+		os.Exit(backup(args))
+	case "restore":
+		os.Exit(restore(args))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", command)
+		os.Exit(2)
+	}
+}
+
+// serve resumes an unfinished reindex, or starts one with -reindex,
+// delivers webhooks and deletes expired documents in the background,
+// and serves the HTTP API. With -follow, it also replicates the
+// leader at that URL, and refuses writes.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "Address to listen on")
+	data := flags.String("data", database, "Directory of the database")
+	leader := flags.String("follow", "", "URL of a docdb to follow, such as http://leader:8080")
+	rebuild := flags.Bool("reindex", false, "Rebuild the index in the background")
+	backupRoot := flags.String("backup-root", "", "Directory that POST /_backup writes backups in, which is refused without it")
+	flags.Parse(args)
+
+	db, err := docdb.Open(*data, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	if *rebuild {
+		err = db.StartReindex()
+	} else {
+		err = db.ResumeReindex()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = db.StartWebhooks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.StartReaper()
+	db.SetBackupRoot(*backupRoot)
+
+	if *leader != "" {
+		err = db.Follow(*leader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Following %s", *leader)
+	}
+
+	log.Printf("Listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, db.Handler()))
+}
+
+// check runs `docdb check` and returns the exit code, 1 if problems
+// remain.
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Fix missing and orphaned index keys")
+	flags.Parse(args)
+
+	db, err := docdb.Open(database, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ok, err := db.Check(*repair, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check index: %v\n", err)
+		return 1
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// migrate runs `docdb migrate` and returns the exit code.
+func migrate() int {
+	from, to, err := docdb.Migrate(database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if from == 0 || from == to {
+		fmt.Printf("Index is already at version %d\n", to)
+	} else {
+		fmt.Printf("Migrated index from version %d to %d\n", from, to)
+	}
+	return 0
+}
+
+// importFormats are the import formats of file extensions.
+var importFormats = map[string]string{
+	".json":   "json",
+	".ndjson": "ndjson",
+	".jsonl":  "ndjson",
+	".csv":    "csv",
+}
+
+// importDocuments runs `docdb import` and returns the exit code, 1 if
+// any document wasn't imported.
+func importDocuments(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	collection := flags.String("collection", docdb.DefaultCollection, "Collection to import into")
+	format := flags.String("format", "", "Format of the input: json, ndjson, csv or bulk (default from the file extension)")
+	idField := flags.String("id", "", "Dotted path of each document's ID (default new IDs)")
+	batchSize := flags.Int("batch", 0, "Documents to write at a time (default 1000)")
+	flags.Parse(args)
+
+	in := io.Reader(os.Stdin)
+	if path := flags.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+		if *format == "" {
+			*format = importFormats[filepath.Ext(path)]
+		}
+	}
+
+	db, c, err := openCollection(*collection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	stats, err := c.Import(context.Background(), in, &docdb.ImportOptions{
+		Format:    *format,
+		IDField:   *idField,
+		BatchSize: *batchSize,
+	})
+	if stats != nil {
+		for _, failed := range stats.Failed {
+			fmt.Fprintln(os.Stderr, failed)
+		}
+		fmt.Printf("Imported %d documents, %d failed\n", stats.Imported, len(stats.Failed))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not import: %v\n", err)
+		return 1
+	}
+	if len(stats.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// exportDocuments runs `docdb export` and returns the exit code.
+func exportDocuments(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	collection := flags.String("collection", docdb.DefaultCollection, "Collection to export")
+	query := flags.String("q", "", "Export only the documents matching this query")
+	output := flags.String("o", "", "File to write to (default stdout)")
+	flags.Parse(args)
+
+	db, c, err := openCollection(*collection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	count, err := c.Export(context.Background(), out, *query)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not export: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d documents\n", count)
+	return 0
+}
+
+// validateExisting runs `docdb validate-existing` and returns the exit
+// code, 1 if any document doesn't match the schema.
+func validateExisting(args []string) int {
+	flags := flag.NewFlagSet("validate-existing", flag.ExitOnError)
+	collection := flags.String("collection", docdb.DefaultCollection, "Collection to check")
+	schemaFile := flags.String("schema", "", "File of a JSON Schema to check against (default the collection's)")
+	flags.Parse(args)
+
+	var schema any
+	if *schemaFile != "" {
+		data, err := os.ReadFile(*schemaFile)
+		if err == nil {
+			err = json.Unmarshal(data, &schema)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read schema: %v\n", err)
+			return 1
+		}
+	}
+
+	db, c, err := openCollection(*collection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	invalid, checked, err := c.ValidateExisting(context.Background(), schema)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not validate: %v\n", err)
+		return 1
+	}
+	for _, doc := range invalid {
+		for _, e := range doc.Err.Errors {
+			fmt.Printf("%s: %v\n", doc.ID, e)
+		}
+	}
+	fmt.Printf("Checked %d documents, %d don't match the schema\n", checked, len(invalid))
+	if len(invalid) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// backup runs `docdb backup` and returns the exit code.
+func backup(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	server := flags.String("server", "", "URL of a running server to back up, which writes dir in its -backup-root")
+	flags.Parse(args)
+	dir := flags.Arg(0)
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "Usage: docdb backup [-server url] dir")
+		return 2
+	}
+
+	var info *docdb.BackupInfo
+	var err error
+	if *server != "" {
+		info, err = requestBackup(*server, dir)
+	} else {
+		var db *docdb.DB
+		db, err = docdb.Open(database, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer db.Close()
+		info, err = db.Backup(dir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not back up: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Backed up to %s at %s\n", dir, info.Created.Format(time.RFC3339))
+	return 0
+}
+
+// requestBackup asks the server at url to back up to dir.
+func requestBackup(url, dir string) (*docdb.BackupInfo, error) {
+	req, err := json.Marshal(map[string]string{"dir": dir})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(strings.TrimSuffix(url, "/")+"/_backup", "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Body  *docdb.BackupInfo `json:"body"`
+		Error string            `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(body.Error)
+	}
+	return body.Body, nil
+}
+
+// restore runs `docdb restore` and returns the exit code.
+func restore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	rebuild := flags.Bool("rebuild-index", false, "Build a new index from the documents rather than restoring the index")
+	flags.Parse(args)
+	dir := flags.Arg(0)
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "Usage: docdb restore [-rebuild-index] dir")
+		return 2
+	}
+
+	info, err := docdb.Restore(dir, database, &docdb.RestoreOptions{RebuildIndex: *rebuild})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not restore: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Restored the backup from %s\n", info.Created.Format(time.RFC3339))
+	return 0
+}
+
+// openCollection opens the database and returns the collection called
+// name in it.
+func openCollection(name string) (*docdb.DB, *docdb.Collection, error) {
+	db, err := docdb.Open(database, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := db.Collection(name)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, c, nil
+}
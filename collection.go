@@ -0,0 +1,569 @@
+package docdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// This file contains collections, which divide a database's
+// documents into separate ID spaces, each with its own index options.
+//
+// Every collection other than the default one has a key prefix,
+// collectionPrefix(name), under which its documents are kept in the
+// primary data and its entries in the index. A server is the view of
+// one collection: its db and indexDb are prefixed views of the
+// stores, so the code that reads and writes documents and index
+// entries doesn't know about collections. The default collection has
+// no prefix, so that databases from before collections need no
+// migration, and its view of primary data hides the prefixed keys.
+//
+// Prefixes start with collectionNamespace, a zero byte. Document IDs
+// can't contain zero bytes, so no default document key starts with
+// one, and in the index it sorts before every namespace. The
+// definition of each collection, the Options it was created with as
+// JSON, is kept in primary data under catalogKey(name).
+//
+// Data about a collection other than its documents, such as its
+// definition and change feed, is kept in primary data under meta
+// keys, which start with two zero bytes so that they're neither
+// documents nor in any collection's prefix. Each kind of meta key has
+// its own byte, following those, and then the collection's name.
+//
+// A collection is dropped by deleting its key range from both stores
+// with DeleteRange.
+
+// collectionNamespace starts the keys of collections other than the
+// default one, in primary data and the index.
+const collectionNamespace byte = 0
+
+var (
+	// ErrCollectionExists is returned when creating a collection
+	// with the name of an existing one.
+	ErrCollectionExists = errors.New("Collection already exists")
+	// errBadCollectionName is returned for names that aren't
+	// allowed.
+	errBadCollectionName = errors.New("Collection names must be 1 to 64 lower case letters, digits, - or _")
+	// errDropDefault is returned when dropping the default
+	// collection.
+	errDropDefault = errors.New("The default collection can't be dropped")
+	// errBadID is returned for document IDs that are empty or
+	// contain zero bytes.
+	errBadID = errors.New("Document IDs must be non-empty and can't contain zero bytes")
+)
+
+var collectionNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// collectionPrefix returns the key prefix of collection name.
+func collectionPrefix(name string) []byte {
+	return packTuple(nil, []byte(name), nil)
+}
+
+// The kinds of meta keys. They're upper case, so that they can't be
+// mistaken for the first letter of a collection name in the meta keys
+// of old databases (see upgradeMetaKeys).
+const (
+	catalogMeta     byte = 'C' // See catalogKey
+	sequenceMeta    byte = 'S' // See sequenceKey
+	changesMeta     byte = 'L' // See changesPrefix
+	webhooksMeta    byte = 'W' // See webhooksPrefix
+	replicationMeta byte = 'R' // See replicationKey
+	schemaMeta      byte = 'V' // See schemaKey
+	tombstoneMeta   byte = 'T' // See tombstoneKey
+)
+
+// metaKinds lists every kind of meta key.
+var metaKinds = []byte{catalogMeta, sequenceMeta, changesMeta, webhooksMeta, replicationMeta, schemaMeta, tombstoneMeta}
+
+// metaKey returns the primary data meta key of kind for collection
+// name, followed by the components in rest.
+func metaKey(kind byte, name string, rest ...[]byte) []byte {
+	return packTuple(append([][]byte{nil, nil, {kind}, []byte(name)}, rest...)...)
+}
+
+// catalogKey returns the primary data key of the definition of
+// collection name.
+func catalogKey(name string) []byte {
+	return metaKey(catalogMeta, name)
+}
+
+// upgradeMetaKeys rewrites meta keys from before they had kinds, when
+// the number of zero bytes they started with was their kind, from 2
+// for catalog keys to 7 for schema keys. The rest of those keys was
+// as it is now.
+func upgradeMetaKeys(root KV) error {
+	oldKinds := []byte{catalogMeta, sequenceMeta, changesMeta, webhooksMeta, replicationMeta, schemaMeta}
+	snap := root.NewSnapshot()
+	defer snap.Close()
+	iter := snap.NewIter(&IterOptions{
+		LowerBound: []byte{0, 0},
+		UpperBound: []byte{0, 1},
+	})
+	b := root.NewBatch()
+
+	var err error
+	for iter.First(); iter.Valid() && err == nil; iter.Next() {
+		key := iter.Key()
+		zeros := 2
+		for zeros < len(key) && key[zeros] == 0 {
+			zeros++
+		}
+		if zeros == len(key) || zeros-2 >= len(oldKinds) || bytes.IndexByte(metaKinds, key[zeros]) >= 0 {
+			// Already upgraded, or not a meta key
+			continue
+		}
+
+		err = b.Set(append(metaKey(oldKinds[zeros-2], ""), key[zeros:]...), iter.Value())
+		if err == nil {
+			err = b.Delete(key)
+		}
+		if err == nil && b.Count() >= migrationBatchSize {
+			err = root.Apply(b)
+			b.Close()
+			b = root.NewBatch()
+		}
+	}
+	if err == nil {
+		err = root.Apply(b)
+	}
+	b.Close()
+
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// validID returns true if id can be a document ID.
+func validID(id string) bool {
+	return id != "" && !bytes.ContainsRune([]byte(id), 0)
+}
+
+// collections holds the collections of a database.
+type collections struct {
+	root KV // Primary data of every collection, unprefixed
+
+	mu     sync.RWMutex
+	byName map[string]*server
+
+	hooks *webhooks // Delivery of every collection's webhooks
+
+	follower *follower // Replication from the leader, guarded by mu
+	reaper   *reaper   // Deletion of expired documents, guarded by mu
+
+	// backupRoot is the directory that backups requested over HTTP
+	// are written in, or "" if they aren't allowed. Guarded by mu.
+	backupRoot string
+}
+
+// readOnly returns true if the database is a follower, when only
+// replication writes documents.
+func (c *collections) readOnly() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.follower != nil
+}
+
+// get returns the collection called name, or nil.
+func (c *collections) get(name string) *server {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.byName[name]
+}
+
+// forKey returns the collection that the primary data key belongs to
+// and the document ID in it, or nil if it isn't a document key.
+func (c *collections) forKey(key []byte) (*server, []byte) {
+	if len(key) == 0 || key[0] != collectionNamespace {
+		return c.get(DefaultCollection), key
+	}
+	i := bytes.IndexByte(key[1:], 0)
+	if i <= 0 {
+		// A meta key, or not a collection key at all
+		return nil, nil
+	}
+	return c.get(string(key[1 : 1+i])), key[2+i:]
+}
+
+// newCollection returns the server for collection name, with opts,
+// sharing the stores and locks of s.
+func (s server) newCollection(name string, opts *Options) (*server, error) {
+	cfg, err := opts.indexConfig()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := newIDGenerator(opts.idStrategy())
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := opts.ttl()
+	if err != nil {
+		return nil, err
+	}
+	feed, err := loadChangeFeed(s.cols.root, name)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := loadSchema(s.cols.root, name)
+	if err != nil {
+		return nil, err
+	}
+
+	c := s
+	c.name = name
+	c.cfg = cfg
+	c.ids = ids
+	c.ttl = ttl
+	c.feed = feed
+	c.schema = schema
+	c.prefix = collectionPrefix(name)
+	c.db = newPrefixKV(s.cols.root, c.prefix, nil)
+	return &c, nil
+}
+
+// loadCollections adds the collections defined in the catalog.
+func (s server) loadCollections() error {
+	prefix := catalogKey("")
+	iter := s.cols.root.NewIter(&IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		name := string(iter.Key()[len(prefix):])
+		var opts *Options
+		if err := json.Unmarshal(iter.Value(), &opts); err != nil {
+			return err
+		}
+		c, err := s.newCollection(name, opts)
+		if err != nil {
+			return err
+		}
+		s.cols.byName[name] = c
+	}
+	return nil
+}
+
+// writable returns the error for writing documents to s, if it's been
+// dropped or is a follower's. The caller must hold writeMu.
+func (s server) writable() error {
+	if !s.exists() {
+		return ErrNoCollection
+	}
+	if s.cols.readOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// exists returns true if s hasn't been dropped. Once it has, a new
+// collection with its name is a different one. The caller must hold
+// writeMu to write to s.
+func (s server) exists() bool {
+	c := s.cols.get(s.name)
+	return c != nil && c.feed == s.feed
+}
+
+// indexDb returns the view of the index for s.
+func (s server) indexDb() KV {
+	if s.prefix == nil {
+		return s.idx.db
+	}
+	return newPrefixKV(s.idx.db, s.prefix, nil)
+}
+
+// indexView returns the view for s of a batch of index writes.
+func (s server) indexView(b KVBatch) KVBatch {
+	if s.prefix == nil {
+		return b
+	}
+	return prefixBatch{prefixReader{b, s.prefix, nil}, b}
+}
+
+// describeID returns the ID of the document for id, qualified with
+// the collection's name outside the default collection.
+func (s server) describeID(id []byte) string {
+	if s.prefix == nil {
+		return string(id)
+	}
+	return s.name + "/" + string(id)
+}
+
+// collection returns the collection called name.
+func (s server) collection(name string) (*server, error) {
+	c := s.cols.get(name)
+	if c == nil {
+		return nil, ErrNoCollection
+	}
+	return c, nil
+}
+
+// listCollections returns the names of the collections in order.
+func (s server) listCollections() []string {
+	s.cols.mu.RLock()
+	defer s.cols.mu.RUnlock()
+	names := make([]string, 0, len(s.cols.byName))
+	for name := range s.cols.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createCollection adds an empty collection called name, indexed as
+// opts says.
+func (s server) createCollection(name string, opts *Options) (*server, error) {
+	if s.cols.readOnly() {
+		return nil, ErrReadOnly
+	}
+	return s.addCollection(name, opts)
+}
+
+// addCollection does the work of createCollection, which followers
+// do for the collections of their leader.
+func (s server) addCollection(name string, opts *Options) (*server, error) {
+	if !collectionNameRegexp.MatchString(name) {
+		return nil, errBadCollectionName
+	}
+	c, err := s.newCollection(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	def, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.cols.get(name) != nil {
+		return nil, ErrCollectionExists
+	}
+	if err := s.cols.root.Set(catalogKey(name), def); err != nil {
+		return nil, err
+	}
+
+	s.cols.mu.Lock()
+	s.cols.byName[name] = c
+	s.cols.mu.Unlock()
+	return c, nil
+}
+
+// dropCollection deletes collection name and all of its documents.
+func (s server) dropCollection(name string) error {
+	if s.cols.readOnly() {
+		return ErrReadOnly
+	}
+	return s.removeCollection(name)
+}
+
+// removeCollection does the work of dropCollection, which followers
+// do for the collections their leader drops.
+func (s server) removeCollection(name string) error {
+	if name == DefaultCollection {
+		return errDropDefault
+	}
+	s.cols.hooks.stop(name, func(string) bool { return true })
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	c := s.cols.get(name)
+	if c == nil {
+		return ErrNoCollection
+	}
+
+	// As with deleteDocument, the index is written first
+	prefix := collectionPrefix(name)
+	indexes := []KV{s.idx.db}
+	if s.idx.shadow != nil {
+		indexes = append(indexes, s.idx.shadow)
+	}
+	for _, db := range indexes {
+		b := db.NewBatch()
+		err := b.DeleteRange(prefix, prefixEnd(prefix))
+		if err == nil {
+			err = db.Apply(b)
+		}
+		b.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	b := s.cols.root.NewBatch()
+	defer b.Close()
+	err := b.DeleteRange(prefix, prefixEnd(prefix))
+	// Every meta key of the collection, from metaKey(kind, name) to
+	// the last starting with metaKey(kind, name, nil)
+	for _, kind := range metaKinds {
+		if err == nil {
+			err = b.DeleteRange(metaKey(kind, name), prefixEnd(metaKey(kind, name, nil)))
+		}
+	}
+	if err == nil {
+		err = s.cols.root.Apply(b)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.cols.mu.Lock()
+	delete(s.cols.byName, name)
+	s.cols.mu.Unlock()
+	// Wake its subscribers, who find that it's gone
+	c.feed.publish(0)
+	return nil
+}
+
+// prefixEnd returns the smallest key after every key starting with
+// prefix, which mustn't end in 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	end[len(end)-1]++
+	return end
+}
+
+// prefixReader reads the keys of r that start with prefix, with the
+// prefix removed. Its iterators also skip keys before min, which is
+// how the default collection, with no prefix, hides the keys of the
+// others.
+type prefixReader struct {
+	r      KVReader
+	prefix []byte
+	min    []byte
+}
+
+// key returns the key in r for k.
+func (p prefixReader) key(k []byte) []byte {
+	return append(append(make([]byte, 0, len(p.prefix)+len(k)), p.prefix...), k...)
+}
+
+func (p prefixReader) Get(key []byte) ([]byte, io.Closer, error) {
+	return p.r.Get(p.key(key))
+}
+
+func (p prefixReader) NewIter(o *IterOptions) KVIterator {
+	var lower, upper []byte
+	if o != nil {
+		lower, upper = o.LowerBound, o.UpperBound
+	}
+	if p.min != nil && (lower == nil || bytes.Compare(lower, p.min) < 0) {
+		lower = p.min
+	}
+
+	bounds := &IterOptions{}
+	if lower != nil || p.prefix != nil {
+		bounds.LowerBound = p.key(lower)
+	}
+	if upper != nil {
+		bounds.UpperBound = p.key(upper)
+	} else if p.prefix != nil {
+		bounds.UpperBound = prefixEnd(p.prefix)
+	}
+	return prefixIter{p.r.NewIter(bounds), p.prefix}
+}
+
+// prefixIter is an iterator of a prefixReader.
+type prefixIter struct {
+	KVIterator
+	prefix []byte
+}
+
+func (it prefixIter) SeekGE(key []byte) bool {
+	return it.KVIterator.SeekGE(prefixReader{prefix: it.prefix}.key(key))
+}
+
+func (it prefixIter) SeekLT(key []byte) bool {
+	return it.KVIterator.SeekLT(prefixReader{prefix: it.prefix}.key(key))
+}
+
+func (it prefixIter) Key() []byte {
+	return it.KVIterator.Key()[len(it.prefix):]
+}
+
+// prefixKV is the view of the keys of kv that start with a prefix,
+// as a prefixReader. It doesn't own kv, so closing it does nothing.
+type prefixKV struct {
+	prefixReader
+	kv KV
+}
+
+func newPrefixKV(kv KV, prefix, min []byte) prefixKV {
+	return prefixKV{prefixReader{kv, prefix, min}, kv}
+}
+
+func (p prefixKV) Set(key, value []byte) error {
+	return p.kv.Set(p.key(key), value)
+}
+
+func (p prefixKV) Delete(key []byte) error {
+	return p.kv.Delete(p.key(key))
+}
+
+func (p prefixKV) NewBatch() KVBatch {
+	b := p.kv.NewBatch()
+	return prefixBatch{prefixReader{b, p.prefix, p.min}, b}
+}
+
+func (p prefixKV) Apply(b KVBatch) error {
+	return p.kv.Apply(b.(prefixBatch).b)
+}
+
+func (p prefixKV) NewSnapshot() KVSnapshot {
+	snap := p.kv.NewSnapshot()
+	return prefixSnapshot{prefixReader{snap, p.prefix, p.min}, snap}
+}
+
+func (p prefixKV) Close() error {
+	return nil
+}
+
+// prefixBatch is a batch of a prefixKV.
+type prefixBatch struct {
+	prefixReader
+	b KVBatch
+}
+
+func (p prefixBatch) Set(key, value []byte) error {
+	return p.b.Set(p.key(key), value)
+}
+
+func (p prefixBatch) Delete(key []byte) error {
+	return p.b.Delete(p.key(key))
+}
+
+func (p prefixBatch) DeleteRange(start, end []byte) error {
+	return p.b.DeleteRange(p.key(start), p.key(end))
+}
+
+func (p prefixBatch) Count() uint32 {
+	return p.b.Count()
+}
+
+func (p prefixBatch) Close() error {
+	return p.b.Close()
+}
+
+// rootBatch returns the batch of the KV under b, if b is a batch of a
+// prefixKV, for writing keys outside the prefix.
+func rootBatch(b KVBatch) KVBatch {
+	if p, ok := b.(prefixBatch); ok {
+		return p.b
+	}
+	return b
+}
+
+// prefixSnapshot is a snapshot of a prefixKV.
+type prefixSnapshot struct {
+	prefixReader
+	s KVSnapshot
+}
+
+func (p prefixSnapshot) Close() error {
+	return p.s.Close()
+}
@@ -0,0 +1,173 @@
+package docdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_collections(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	orders, err := s.createCollection("orders", &Options{FullText: []string{"note"}})
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	_, err = s.createCollection("orders", nil)
+	assert.Equal(t, ErrCollectionExists, err)
+	_, err = s.createCollection("Bad Name", nil)
+	assert.Equal(t, errBadCollectionName, err)
+	assert.Equal(t, []string{"default", "orders"}, s.listCollections())
+
+	// The same ID in two collections is two documents
+	s.addDocument("1", map[string]any{"kind": "default"})
+	orders.addDocument("1", map[string]any{"kind": "order", "note": "Leave at the door"})
+	orders.addDocument("2", map[string]any{"kind": "order"})
+	_, err = orders.putDocument("a\x00b", map[string]any{}, anyRevision)
+	assert.Equal(t, errBadID, err)
+
+	document, _ := s.getDocumentById([]byte("1"))
+	assert.Equal(t, "default", document["kind"])
+	document, _ = orders.getDocumentById([]byte("1"))
+	assert.Equal(t, "order", document["kind"])
+
+	q, _ := parseQuery("kind:order")
+	result, _ := s.searchDocuments(q)
+	assert.Equal(t, 0, result["count"])
+	result, _ = orders.searchDocuments(q)
+	assert.Equal(t, 2, result["count"])
+	q, _ = parseQuery("note:~door")
+	result, _ = orders.searchDocuments(q)
+	assert.Equal(t, 1, result["count"])
+
+	report, _ := s.checkIndex(false)
+	assert.True(t, report.ok())
+	assert.Equal(t, 3, report.documents)
+
+	// Collections and their options are loaded when the database is
+	// reopened, and reindexed with the default collection
+	assert.NoError(t, s.close())
+	s, err = newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not reopen s")
+	}
+	assert.NoError(t, s.reindex(reindexOptions{batchSize: 1}))
+	assert.Equal(t, 3, s.reindexProgress().indexed)
+	orders, _ = s.collection("orders")
+	result, _ = orders.searchDocuments(q)
+	assert.Equal(t, 1, result["count"])
+
+	// Dropping deletes the collection's documents and index entries
+	assert.Equal(t, errDropDefault, s.dropCollection(DefaultCollection))
+	assert.NoError(t, s.dropCollection("orders"))
+	assert.Equal(t, ErrNoCollection, s.dropCollection("orders"))
+	assert.Equal(t, ErrNoCollection, orders.addDocument("3", map[string]any{}))
+	_, err = s.collection("orders")
+	assert.Equal(t, ErrNoCollection, err)
+	for _, kv := range []KV{s.cols.root, s.idx.db} {
+		iter := kv.NewIter(nil)
+		for iter.First(); iter.Valid(); iter.Next() {
+			assert.False(t, bytes.HasPrefix(iter.Key(), collectionPrefix("orders")))
+		}
+		iter.Close()
+	}
+
+	orders, _ = s.createCollection("orders", nil)
+	_, err = orders.getDocumentById([]byte("1"))
+	assert.Equal(t, ErrNotFound, err)
+	document, _ = s.getDocumentById([]byte("1"))
+	assert.Equal(t, "default", document["kind"])
+	assert.NoError(t, s.close())
+}
+
+func Test_checkIndexCollections(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	orders, _ := s.createCollection("orders", nil)
+	orders.addDocument("1", map[string]any{"total": 10})
+
+	missing := encodeInvIdxKey([]byte("total"), encodeTaggedValue(10), []byte("1"))
+	orders.indexDb().Delete(missing)
+	report, _ := s.checkIndex(false)
+	assert.Equal(t, [][]byte{append(collectionPrefix("orders"), missing...)}, report.missing)
+
+	var out bytes.Buffer
+	report.print(&out)
+	assert.True(t, strings.Contains(out.String(), `missing inverted "1" total=`))
+	assert.True(t, strings.Contains(out.String(), "in collection orders"))
+
+	s.checkIndex(true)
+	ids, _ := lookupEq(orders.indexDb(), nil, "total", 10)
+	assert.Equal(t, []string{"1"}, ids)
+}
+
+func Test_prefixKV(t *testing.T) {
+	kv := NewMemoryKV()
+	for _, k := range []string{"a", "\x00x\x00a", "\x00x\x00b", "\x00y\x00a", "b"} {
+		kv.Set([]byte(k), []byte(k))
+	}
+
+	x := newPrefixKV(kv, []byte("\x00x\x00"), nil)
+	assert.Equal(t, []string{"a", "b"}, iterKeys(x.NewIter(nil)))
+	iter := x.NewIter(&IterOptions{UpperBound: []byte("b")})
+	assert.True(t, iter.SeekLT([]byte("b")))
+	assert.Equal(t, "a", string(iter.Key()))
+	assert.Equal(t, "\x00x\x00a", string(iter.Value()))
+	assert.False(t, iter.Next())
+	iter.Close()
+
+	b := x.NewBatch()
+	b.Set([]byte("c"), nil)
+	b.DeleteRange([]byte("a"), []byte("b"))
+	assert.Equal(t, []string{"b", "c"}, iterKeys(b.NewIter(nil)))
+	assert.NoError(t, x.Apply(b))
+
+	def := newPrefixKV(kv, nil, []byte{1})
+	assert.Equal(t, []string{"a", "b"}, iterKeys(def.NewIter(nil)))
+	assert.Equal(t, []string{"\x00x\x00b", "\x00x\x00c", "\x00y\x00a", "a", "b"}, iterKeys(kv.NewIter(nil)))
+}
+
+func Test_upgradeMetaKeys(t *testing.T) {
+	kv := NewMemoryKV()
+	seq := []byte{0, 0, 0, 0, 0, 0, 0, 7}
+	old := map[string]string{
+		"\x00\x00people":                           "{}",
+		"\x00\x00\x00people":                       "1",
+		"\x00\x00\x00\x00people\x00" + string(seq): "change",
+		"\x00\x00\x00\x00\x00people\x00hook\x00a":  "match",
+		"\x00\x00\x00\x00\x00\x00people":           "cursor",
+		"\x00\x00\x00\x00\x00\x00\x00people":       "schema",
+		"\x00people\x00a":                          "document",
+		"a":                                        "document",
+	}
+	for k, v := range old {
+		kv.Set([]byte(k), []byte(v))
+	}
+
+	assert.NoError(t, upgradeMetaKeys(kv))
+	expected := []string{
+		string(catalogKey("people")),
+		string(changeKey("people", 7)),
+		string(replicationKey("people")),
+		string(sequenceKey("people")),
+		string(schemaKey("people")),
+		string(webhookMatchKey("people", "hook", "a")),
+		"\x00people\x00a",
+		"a",
+	}
+	assert.Equal(t, expected, iterKeys(kv.NewIter(nil)))
+	value, closer, _ := kv.Get(changeKey("people", 7))
+	assert.Equal(t, "change", string(value))
+	closer.Close()
+
+	// Upgraded keys are left alone
+	assert.NoError(t, upgradeMetaKeys(kv))
+	assert.Equal(t, expected, iterKeys(kv.NewIter(nil)))
+}
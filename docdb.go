@@ -0,0 +1,421 @@
+// Package docdb is a JSON document database built on Pebble. Every
+// path value of every document is indexed, so documents can be found
+// by any of their fields without declaring indexes up front.
+//
+// Open a database, then put, get, delete and find documents:
+//
+//	db, err := docdb.Open("docdb.data", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//
+//	rev, err := db.Put(ctx, "mike", map[string]any{"name": "Mike", "age": 40})
+//	docs, err := db.Find(ctx, "age:>30")
+//
+// Queries are space separated path:value comparisons, all of which a
+// document must match, as described in the README.
+//
+// The methods of DB use the default collection. Other collections,
+// each with their own IDs and index options, are created with
+// CreateCollection.
+//
+// OpenMemory opens a database held in memory instead, for tests, and
+// OpenStorage one kept in any ordered key-value store that implements
+// KV.
+package docdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultCollection is the name of the collection that the methods
+// of DB operate on.
+const DefaultCollection = "default"
+
+var (
+	// ErrNotFound is returned when there's no document with an ID.
+	ErrNotFound = errors.New("Document not found")
+	// ErrConflict is returned when a write's expected revision
+	// doesn't match the revision of the stored document.
+	ErrConflict = errors.New("Document update conflict")
+	// ErrNoCollection is returned for collections that don't exist.
+	ErrNoCollection = errors.New("Collection not found")
+)
+
+// QueryError is returned for queries that can't be parsed.
+type QueryError struct {
+	Query string
+	Err   error
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("Bad query %q: %v", e.Query, e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Options control how the documents of a collection are indexed. A
+// nil *Options indexes every path value in the inverted index only.
+type Options struct {
+	// FullText lists dotted paths whose string values are also
+	// indexed for full-text queries, like description:~"fast db".
+	FullText []string `json:"full_text,omitempty"`
+	// Geo lists dotted paths holding {"lat": .., "lon": ..} points
+	// to index for @box and @radius queries.
+	Geo []string `json:"geo,omitempty"`
+	// Timestamps lists dotted paths whose RFC 3339 string values
+	// are indexed as instants.
+	Timestamps []string `json:"timestamps,omitempty"`
+	// DetectTimestamps indexes RFC 3339 string values at every
+	// path as instants.
+	DetectTimestamps bool `json:"detect_timestamps,omitempty"`
+	// Collation sets how strings are ordered and compared: "binary",
+	// the default, "fold" or "unicode". Changing it requires a
+	// reindex.
+	Collation string `json:"collation,omitempty"`
+	// IDs sets how IDs are generated for inserted documents:
+	// "uuid", random UUIDs and the default, "uuidv7" or "ulid",
+	// which sort in time order, or "counter", numbers from 1.
+	IDs string `json:"ids,omitempty"`
+	// TTL, such as "24h", sets how long documents live after they're
+	// written, unless they have their own _expires time. Expired
+	// documents are deleted by the reaper (see DB.StartReaper).
+	TTL string `json:"ttl,omitempty"`
+}
+
+// idStrategy returns the ID strategy of o, "" for the default.
+func (o *Options) idStrategy() string {
+	if o == nil {
+		return ""
+	}
+	return o.IDs
+}
+
+// ttl returns the TTL of documents in o, 0 for none.
+func (o *Options) ttl() (time.Duration, error) {
+	if o == nil || o.TTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(o.TTL)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New(fmt.Sprintf("Bad TTL %q", o.TTL))
+	}
+	return ttl, nil
+}
+
+// indexConfig returns the index options for o.
+func (o *Options) indexConfig() (*indexConfig, error) {
+	if o == nil {
+		return nil, nil
+	}
+	cfg := &indexConfig{
+		fullText:         o.FullText,
+		geo:              o.Geo,
+		timestamps:       o.Timestamps,
+		detectTimestamps: o.DetectTimestamps,
+	}
+	switch o.Collation {
+	case "", "binary":
+		cfg.collation = collationBinary
+	case "fold":
+		cfg.collation = collationFold
+	case "unicode":
+		cfg.collation = collationUnicode
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown collation %q", o.Collation))
+	}
+	return cfg, nil
+}
+
+// Document is a stored document.
+type Document struct {
+	ID   string
+	Rev  uint64
+	Body map[string]any
+	// Score is the BM25 score of the document for the full-text
+	// comparisons of a query, or 0.
+	Score float64
+}
+
+// DB is an open database. It's safe for concurrent use.
+type DB struct {
+	s   *server
+	def *Collection
+}
+
+// Collection is a set of documents in a database. It's safe for
+// concurrent use. Once the collection is dropped, writes return
+// ErrNoCollection.
+type Collection struct {
+	s *server
+}
+
+// Open opens the database at path, creating it if needed. Its index
+// is in a second directory, path with ".index" appended. opts are the
+// index options of the default collection.
+func Open(path string, opts *Options) (*DB, error) {
+	return OpenStorage(PebbleStorage(path), opts)
+}
+
+// OpenMemory opens a new, empty database held in memory, which is
+// lost when it's closed. It's meant for tests and scratch data.
+func OpenMemory(opts *Options) (*DB, error) {
+	return OpenStorage(MemoryStorage(), opts)
+}
+
+// OpenStorage opens the database kept in storage.
+func OpenStorage(storage Storage, opts *Options) (*DB, error) {
+	cfg, err := opts.indexConfig()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := newIDGenerator(opts.idStrategy())
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := opts.ttl()
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStorageServer(storage, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.ids = ids
+	s.ttl = ttl
+	return &DB{s: s, def: &Collection{s: s}}, nil
+}
+
+// Close stops any running reindex, which is resumed when the database
+// is next opened, and closes the database.
+func (db *DB) Close() error {
+	return db.s.close()
+}
+
+// Collection returns the collection called name, or ErrNoCollection.
+func (db *DB) Collection(name string) (*Collection, error) {
+	s, err := db.s.collection(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Collection{s: s}, nil
+}
+
+// CreateCollection adds an empty collection called name, whose
+// documents are indexed as opts says, or returns ErrCollectionExists.
+// Names are 1 to 64 lower case letters, digits, - or _.
+func (db *DB) CreateCollection(name string, opts *Options) (*Collection, error) {
+	s, err := db.s.createCollection(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Collection{s: s}, nil
+}
+
+// DropCollection deletes the collection called name and all of its
+// documents. The default collection can't be dropped.
+func (db *DB) DropCollection(name string) error {
+	return db.s.dropCollection(name)
+}
+
+// Collections returns the names of the collections, in order.
+func (db *DB) Collections() []string {
+	return db.s.listCollections()
+}
+
+// Put stores body in the default collection. See Collection.Put.
+func (db *DB) Put(ctx context.Context, id string, body map[string]any) (uint64, error) {
+	return db.def.Put(ctx, id, body)
+}
+
+// Insert stores body in the default collection with a new ID. See
+// Collection.Insert.
+func (db *DB) Insert(ctx context.Context, body map[string]any) (string, uint64, error) {
+	return db.def.Insert(ctx, body)
+}
+
+// PutIf conditionally stores body in the default collection. See
+// Collection.PutIf.
+func (db *DB) PutIf(ctx context.Context, id string, body map[string]any, rev uint64) (uint64, error) {
+	return db.def.PutIf(ctx, id, body, rev)
+}
+
+// Get returns a document from the default collection. See
+// Collection.Get.
+func (db *DB) Get(ctx context.Context, id string) (*Document, error) {
+	return db.def.Get(ctx, id)
+}
+
+// Delete removes a document from the default collection. See
+// Collection.Delete.
+func (db *DB) Delete(ctx context.Context, id string) error {
+	return db.def.Delete(ctx, id)
+}
+
+// DeleteIf conditionally removes a document from the default
+// collection. See Collection.DeleteIf.
+func (db *DB) DeleteIf(ctx context.Context, id string, rev uint64) error {
+	return db.def.DeleteIf(ctx, id, rev)
+}
+
+// Find returns the documents matching query in the default
+// collection. See Collection.Find.
+func (db *DB) Find(ctx context.Context, query string) ([]Document, error) {
+	return db.def.Find(ctx, query)
+}
+
+// Begin starts a transaction on the default collection. See
+// Collection.Begin.
+func (db *DB) Begin(ctx context.Context) (*Txn, error) {
+	return db.def.Begin(ctx)
+}
+
+// Handler returns the HTTP API for the database.
+func (db *DB) Handler() http.Handler {
+	return db.s.router()
+}
+
+// StartReindex rebuilds the index in the background, resuming an
+// unfinished reindex. The new index replaces the current one when
+// it's complete, and the database stays usable meanwhile.
+func (db *DB) StartReindex() error {
+	return db.s.startReindex(defaultReindexOptions)
+}
+
+// ResumeReindex continues a reindex that was unfinished when the
+// database was closed, in the background. It does nothing if there
+// isn't one.
+func (db *DB) ResumeReindex() error {
+	return db.s.resumeReindex(defaultReindexOptions)
+}
+
+// Check compares the index with the stored documents, writing any
+// differences to w, and returns true if they agree. With repair,
+// differences in the index are fixed. Nothing else may use the
+// database while it runs.
+func (db *DB) Check(repair bool, w io.Writer) (bool, error) {
+	report, err := db.s.checkIndex(repair)
+	if err != nil {
+		return false, err
+	}
+	report.print(w)
+	return report.ok() || (report.repaired && len(report.badDocuments) == 0), nil
+}
+
+// Migrate rewrites the index of the database at path, which mustn't
+// be open, in the current index format. It returns the version the
+// index was in and the current version.
+func Migrate(path string) (int, int, error) {
+	db, err := OpenPebbleKV(path + ".index")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+
+	from, err := migrateIndex(db)
+	return from, indexFormatVersion, err
+}
+
+// Put stores body as the document with id, replacing any existing
+// document, and returns its new revision. IDs can't be empty or
+// contain zero bytes.
+func (c *Collection) Put(ctx context.Context, id string, body map[string]any) (uint64, error) {
+	return c.PutIf(ctx, id, body, anyRevision)
+}
+
+// PutIf stores body as the document with id if rev is the revision
+// of the stored document, or 0 and there's no stored document, and
+// returns its new revision. Otherwise it returns ErrConflict.
+func (c *Collection) PutIf(ctx context.Context, id string, body map[string]any, rev uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.s.putDocument(id, body, rev)
+}
+
+// Insert stores body as a new document, with an ID generated as the
+// collection's Options.IDs says, and returns the ID and revision.
+func (c *Collection) Insert(ctx context.Context, body map[string]any) (string, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	return c.s.insertDocument(body)
+}
+
+// Get returns the document with id, or ErrNotFound.
+func (c *Collection) Get(ctx context.Context, id string) (*Document, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	body, rev, err := c.s.getDocument([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return &Document{ID: id, Rev: rev, Body: body}, nil
+}
+
+// Delete removes the document with id, or returns ErrNotFound.
+func (c *Collection) Delete(ctx context.Context, id string) error {
+	return c.DeleteIf(ctx, id, anyRevision)
+}
+
+// DeleteIf removes the document with id if rev is its revision, or
+// returns ErrConflict.
+func (c *Collection) DeleteIf(ctx context.Context, id string, rev uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.s.deleteDocument(id, rev)
+}
+
+// Find returns the documents matching query. When it has full-text
+// comparisons, documents are ordered by score, highest first, and
+// otherwise by ID. A query that can't be parsed returns *QueryError.
+func (c *Collection) Find(ctx context.Context, query string) ([]Document, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
+
+	results, err := c.s.find(q)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return newDocuments(results), nil
+}
+
+// Begin starts a transaction on the collection. See Txn.
+func (c *Collection) Begin(ctx context.Context) (*Txn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.s.begin(), nil
+}
+
+// newDocuments returns search results as Documents.
+func newDocuments(results []searchResult) []Document {
+	documents := make([]Document, 0, len(results))
+	for _, r := range results {
+		documents = append(documents, Document{
+			ID:    r.id,
+			Rev:   r.rev,
+			Body:  r.document,
+			Score: r.score,
+		})
+	}
+	return documents
+}
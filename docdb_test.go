@@ -0,0 +1,130 @@
+package docdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Open(t *testing.T) {
+	d := t.TempDir()
+	ctx := context.Background()
+	db, err := Open(d, &Options{FullText: []string{"bio"}, Collation: "fold"})
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+
+	rev, err := db.Put(ctx, "mike", map[string]any{"name": "Mike", "bio": "Writes databases"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), rev)
+	_, err = db.PutIf(ctx, "mike", map[string]any{"name": "Michael"}, 0)
+	assert.Equal(t, ErrConflict, err)
+	rev, err = db.PutIf(ctx, "phil", map[string]any{"name": "Phil"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), rev)
+
+	doc, err := db.Get(ctx, "mike")
+	assert.NoError(t, err)
+	assert.Equal(t, &Document{ID: "mike", Rev: 1, Body: map[string]any{
+		"name": "Mike", "bio": "Writes databases",
+	}}, doc)
+	_, err = db.Get(ctx, "tim")
+	assert.Equal(t, ErrNotFound, err)
+
+	docs, err := db.Find(ctx, "name:mike")
+	assert.NoError(t, err)
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, "mike", docs[0].ID)
+	}
+	docs, _ = db.Find(ctx, "bio:~database")
+	if assert.Len(t, docs, 1) {
+		assert.Greater(t, docs[0].Score, 0.0)
+	}
+	_, err = db.Find(ctx, "name:/[/")
+	var queryErr *QueryError
+	assert.True(t, errors.As(err, &queryErr))
+
+	assert.Equal(t, ErrConflict, db.DeleteIf(ctx, "phil", 2))
+	assert.NoError(t, db.Delete(ctx, "phil"))
+	assert.Equal(t, ErrNotFound, db.Delete(ctx, "phil"))
+
+	c, err := db.Collection(DefaultCollection)
+	assert.NoError(t, err)
+	doc, _ = c.Get(ctx, "mike")
+	assert.Equal(t, "Mike", doc.Body["name"])
+	_, err = db.Collection("other")
+	assert.Equal(t, ErrNoCollection, err)
+	other, err := db.CreateCollection("other", &Options{Collation: "fold"})
+	assert.NoError(t, err)
+	_, err = other.Put(ctx, "mike", map[string]any{"name": "Other Mike"})
+	assert.NoError(t, err)
+	docs, _ = other.Find(ctx, "name:\"other mike\"")
+	assert.Len(t, docs, 1)
+	assert.Equal(t, []string{"default", "other"}, db.Collections())
+	assert.NoError(t, db.DropCollection("other"))
+	_, err = other.Put(ctx, "tim", map[string]any{})
+	assert.Equal(t, ErrNoCollection, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = db.Put(cancelled, "tim", map[string]any{})
+	assert.Equal(t, context.Canceled, err)
+	_, err = db.Find(cancelled, "name:mike")
+	assert.Equal(t, context.Canceled, err)
+
+	var out bytes.Buffer
+	ok, err := db.Check(false, &out)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, db.Close())
+
+	// Documents persist, and the index can't be migrated while open
+	db, err = Open(d, nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	_, _, err = Migrate(d)
+	assert.Error(t, err)
+	doc, _ = db.Get(ctx, "mike")
+	assert.Equal(t, uint64(1), doc.Rev)
+	assert.NoError(t, db.Close())
+
+	from, to, err := Migrate(d)
+	assert.NoError(t, err)
+	assert.Equal(t, from, to)
+
+	_, err = Open(d, &Options{Collation: "klingon"})
+	assert.Error(t, err)
+}
+
+func Test_OpenMemory(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	_, err = db.Put(ctx, "mike", map[string]any{"name": "Mike"})
+	assert.NoError(t, err)
+	docs, err := db.Find(ctx, "name:Mike")
+	assert.NoError(t, err)
+	assert.Len(t, docs, 1)
+
+	tx, err := db.Begin(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Put(ctx, "kate", map[string]any{"name": "Kate"}))
+	assert.NoError(t, tx.Delete(ctx, "mike"))
+	assert.NoError(t, tx.Commit(ctx))
+	docs, _ = db.Find(ctx, "name:Kate")
+	assert.Len(t, docs, 1)
+	_, err = db.Get(ctx, "mike")
+	assert.Equal(t, ErrNotFound, err)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = db.Begin(canceled)
+	assert.Equal(t, context.Canceled, err)
+	assert.NoError(t, db.Close())
+}
@@ -1,9 +1,17 @@
-package main
+package docdb
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"log"
 	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
 )
 
 var sep []byte = []byte{0}
@@ -24,6 +32,58 @@ func encodeFloat(value float64) []byte {
 	return buf
 }
 
+// encodeTime encodes t as its nanoseconds since the Unix epoch, with
+// the sign bit flipped so that the bytes sort in time order. This
+// only covers the years 1678 to 2262, so is used for expiry times,
+// which are checked to be in range. Indexed values use
+// encodeTimestamp.
+func encodeTime(t time.Time) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano())^0x8000000000000000)
+	return buf
+}
+
+// decodeTime decodes a time encoded by encodeTime, in UTC.
+func decodeTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)^0x8000000000000000)).UTC()
+}
+
+// encodeTimestamp encodes t as its seconds since the Unix epoch, with
+// the sign bit flipped, then its nanoseconds, so that the bytes sort
+// in time order for any t.
+func encodeTimestamp(t time.Time) []byte {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf, uint64(t.Unix())^0x8000000000000000)
+	binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond()))
+	return buf
+}
+
+// decodeTimestamp decodes a time encoded by encodeTimestamp, in UTC.
+func decodeTimestamp(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint64(b) ^ 0x8000000000000000)
+	return time.Unix(secs, int64(binary.BigEndian.Uint32(b[8:]))).UTC()
+}
+
+// parseTimestamp returns the time in s if it's an RFC 3339 timestamp.
+func parseTimestamp(s string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// timestampTaggedValue returns taggedValue as a JSONTagTime tagged
+// value if it's a string containing an RFC 3339 timestamp, otherwise
+// taggedValue unchanged.
+func timestampTaggedValue(taggedValue []byte) []byte {
+	if len(taggedValue) == 0 || taggedValue[0] != JSONTagString {
+		return taggedValue
+	}
+	t, ok := parseTimestamp(string(taggedValue[1:]))
+	if !ok {
+		return taggedValue
+	}
+	return encodeTaggedValue(t)
+}
+
 func encodeTaggedValue(value interface{}) []byte {
 
 	// First, create the tagged value byte array representation
@@ -70,6 +130,8 @@ func encodeTaggedValue(value interface{}) []byte {
 	case string:
 		taggedS := append([]byte{JSONTagString}, []byte(value.(string))...)
 		taggedV = taggedS
+	case time.Time:
+		taggedV = append([]byte{JSONTagTime}, encodeTimestamp(t)...)
 	default:
 		// This should never happen from value JSON
 		log.Printf("Unexpected type in pathValueAsKey: %+v\n", value)
@@ -77,3 +139,121 @@ func encodeTaggedValue(value interface{}) []byte {
 	}
 	return taggedV
 }
+
+// collation determines how string values are ordered and compared
+// in the inverted index.
+type collation int
+
+const (
+	// collationBinary compares strings by their UTF-8 bytes.
+	collationBinary collation = iota
+	// collationFold compares strings by their Unicode case folded
+	// UTF-8 bytes, so "apple" equals "Apple" and sorts before "Zed".
+	collationFold
+	// collationUnicode orders strings using the Unicode Collation
+	// Algorithm's root collation, so they sort in dictionary order,
+	// with case and accents only used to break ties.
+	collationUnicode
+)
+
+// unicodeCollator is shared as creating collators is expensive, but
+// they are not safe for concurrent use, so it's guarded by a mutex.
+var unicodeCollator = struct {
+	sync.Mutex
+	c   *collate.Collator
+	buf collate.Buffer
+}{c: collate.New(language.Und)}
+
+// collateTaggedValue returns taggedValue with a string value replaced
+// by its collation key under c. Other types, and all values for
+// collationBinary, are returned unchanged.
+//
+// Collation keys are escaped so that they don't contain the 0x00
+// separator used in index keys: 0x00 becomes 0x01 0x01 and 0x01
+// becomes 0x01 0x02, which preserves their ordering.
+func collateTaggedValue(taggedValue []byte, c collation) []byte {
+	if c == collationBinary || len(taggedValue) == 0 || taggedValue[0] != JSONTagString {
+		return taggedValue
+	}
+
+	var key []byte
+	switch c {
+	case collationFold:
+		key = cases.Fold().Bytes(taggedValue[1:])
+	case collationUnicode:
+		unicodeCollator.Lock()
+		key = unicodeCollator.c.Key(&unicodeCollator.buf, taggedValue[1:])
+		key = append([]byte{}, key...)
+		unicodeCollator.buf.Reset()
+		unicodeCollator.Unlock()
+	default:
+		log.Printf("Unexpected collation: %d\n", c)
+		panic(1)
+	}
+
+	collated := make([]byte, 0, len(key)+2)
+	collated = append(collated, JSONTagString)
+	for _, b := range key {
+		switch b {
+		case 0x00:
+			collated = append(collated, 0x01, 0x01)
+		case 0x01:
+			collated = append(collated, 0x01, 0x02)
+		default:
+			collated = append(collated, b)
+		}
+	}
+	return collated
+}
+
+// Documents in the primary database are stored with a header that
+// holds their revision, followed by their JSON:
+//
+//	[ docFormatRevisioned, revision (8 bytes), JSON... ]
+//
+// Documents stored before revisions were added are bare JSON
+// objects, which are read as revision 1.
+const docFormatRevisioned byte = 0x01
+
+// encodeDocument serialises document with its revision rev.
+func encodeDocument(document map[string]any, rev uint64) ([]byte, error) {
+	bs, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 9, 9+len(bs))
+	buf[0] = docFormatRevisioned
+	binary.BigEndian.PutUint64(buf[1:9], rev)
+	return append(buf, bs...), nil
+}
+
+// decodeDocument deserialises a document stored by encodeDocument,
+// returning it and its revision.
+func decodeDocument(b []byte) (map[string]any, uint64, error) {
+	rev, err := decodeRevision(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	if b[0] == docFormatRevisioned {
+		b = b[9:]
+	}
+
+	var document map[string]any
+	err = json.Unmarshal(b, &document)
+	return document, rev, err
+}
+
+// decodeRevision returns the revision of a document stored by
+// encodeDocument, without deserialising the document.
+func decodeRevision(b []byte) (uint64, error) {
+	if len(b) == 0 {
+		return 0, errors.New("Empty document")
+	}
+	if b[0] != docFormatRevisioned {
+		return 1, nil
+	}
+	if len(b) < 9 {
+		return 0, errors.New("Truncated document header")
+	}
+	return binary.BigEndian.Uint64(b[1:9]), nil
+}
@@ -1,8 +1,9 @@
-package main
+package docdb
 
 import (
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -258,4 +259,91 @@ func Test_PVSortTypes(t *testing.T) {
 		"true should be less than number")
 	assert.True(t, slices.Compare(encodeTaggedValue(1234), encodeTaggedValue("1234")) < 0,
 		"number should be less than string")
+	assert.True(t, slices.Compare(encodeTaggedValue("1234"), encodeTaggedValue(time.Unix(0, 0))) < 0,
+		"string should be less than time")
+}
+
+func Test_makeTimeSort(t *testing.T) {
+	tests := []struct {
+		l string
+		h string
+	}{
+		{"2024-01-01T10:00:00Z", "2024-01-01T10:00:00.5Z"},
+		{"2024-01-01T10:00:00+01:00", "2024-01-01T10:00:00Z"},
+		{"1969-12-31T23:59:59Z", "1970-01-01T00:00:00Z"},
+		{"1900-01-01T00:00:00Z", "2200-01-01T00:00:00Z"},
+		{"1969-12-31T23:59:59.999999999Z", "1970-01-01T00:00:00Z"},
+		// Beyond the range of nanoseconds since the epoch
+		{"2024-01-01T00:00:00Z", "9999-12-31T23:59:59Z"},
+		{"0001-01-01T00:00:00Z", "1600-01-01T00:00:00Z"},
+	}
+	for _, test := range tests {
+		h := timestampTaggedValue(encodeTaggedValue(test.h))
+		l := timestampTaggedValue(encodeTaggedValue(test.l))
+		assert.Equal(t, byte(JSONTagTime), h[0])
+		assert.True(t, slices.Compare(h, l) > 0,
+			"%v %s !> %s %v", h, test.h, test.l, l)
+	}
+
+	far := time.Date(9999, 12, 31, 23, 59, 59, 5, time.UTC)
+	assert.Equal(t, far, decodeTimestamp(encodeTimestamp(far)))
+
+	// Non-timestamps are left alone
+	assert.Equal(t, encodeTaggedValue("Monday"), timestampTaggedValue(encodeTaggedValue("Monday")))
+	assert.Equal(t, encodeTaggedValue(12), timestampTaggedValue(encodeTaggedValue(12)))
+}
+
+func Test_collateTaggedValue(t *testing.T) {
+	collated := func(s string, c collation) []byte {
+		return collateTaggedValue(encodeTaggedValue(s), c)
+	}
+
+	// Binary is byte order: upper case sorts first
+	assert.True(t, slices.Compare(collated("Zed", collationBinary), collated("apple", collationBinary)) < 0)
+	assert.NotEqual(t, collated("apple", collationBinary), collated("Apple", collationBinary))
+
+	assert.True(t, slices.Compare(collated("apple", collationFold), collated("Zed", collationFold)) < 0)
+	assert.Equal(t, collated("apple", collationFold), collated("APPLE", collationFold))
+
+	assert.True(t, slices.Compare(collated("apple", collationUnicode), collated("Zed", collationUnicode)) < 0)
+	assert.True(t, slices.Compare(collated("apple", collationUnicode), collated("Apple", collationUnicode)) < 0)
+	assert.True(t, slices.Compare(collated("Apple", collationUnicode), collated("banana", collationUnicode)) < 0)
+	assert.True(t, slices.Compare(collated("cote", collationUnicode), collated("côte", collationUnicode)) < 0)
+	assert.True(t, slices.Compare(collated("côte", collationUnicode), collated("cotes", collationUnicode)) < 0)
+
+	// Collation keys must not contain separators
+	for _, c := range []collation{collationFold, collationUnicode} {
+		for _, s := range []string{"apple", "a\x00b", "a\x01b", "côte"} {
+			assert.NotContains(t, collated(s, c), byte(0), "%q %d", s, c)
+		}
+	}
+
+	// Other types aren't collated
+	assert.Equal(t, encodeTaggedValue(12), collateTaggedValue(encodeTaggedValue(12), collationUnicode))
+	assert.Equal(t, encodeTaggedValue(true), collateTaggedValue(encodeTaggedValue(true), collationFold))
+}
+
+func Test_encodeDocument(t *testing.T) {
+	doc := map[string]any{"name": "mike", "age": 40.0}
+	bs, err := encodeDocument(doc, 12)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	got, rev, err := decodeDocument(bs)
+	assert.NoError(t, err)
+	assert.Equal(t, doc, got)
+	assert.Equal(t, uint64(12), rev)
+	rev, _ = decodeRevision(bs)
+	assert.Equal(t, uint64(12), rev)
+
+	// Documents stored without a header are revision 1
+	got, rev, err = decodeDocument([]byte(`{"name":"mike","age":40}`))
+	assert.NoError(t, err)
+	assert.Equal(t, doc, got)
+	assert.Equal(t, uint64(1), rev)
+
+	_, _, err = decodeDocument([]byte{docFormatRevisioned, 0, 0})
+	assert.Error(t, err)
+	_, err = decodeRevision([]byte{})
+	assert.Error(t, err)
 }
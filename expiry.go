@@ -0,0 +1,270 @@
+package docdb
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// This file contains document expiry.
+//
+// A document expires at the time in its _expires field, an RFC 3339
+// timestamp or a number of seconds since the Unix epoch. A collection
+// with a TTL gives each document written without the field one, the
+// time of the write plus the TTL, so it's in the stored document and
+// can be read, queried and changed like any other field. A null
+// _expires never expires, even in a collection with a TTL.
+//
+// Expiry times are indexed in expIdxNamespace, in time order:
+//
+//	[ expIdxNamespace, 00, time, docID ]
+//
+// The time is fixed width, encoded by encodeTime. Each entry has a
+// forward index entry for the _expires path, with the encoded time as
+// its value and listing only expIdxNamespace, so unindex removes it
+// as it does geo points. As they're part of the index, reindexing and
+// checking the index cover them too.
+//
+// The reaper deletes expired documents in the background. Every
+// interval, it reads the expiry index of each collection up to the
+// current time, and deletes the documents a batch at a time with one
+// write to primary data and one to the index, like a bulk write. The
+// deletes are in the change feed, as any other. Expired documents can
+// be read until the reaper deletes them. Followers don't reap, as
+// they replicate their leader's deletes.
+
+var expIdxNamespace byte = 'x'
+
+// expiresField is the field holding a document's expiry time.
+const expiresField = "_expires"
+
+// errBadExpires is returned for documents whose _expires isn't a time.
+var errBadExpires = errors.New("_expires must be an RFC 3339 timestamp or seconds since the Unix epoch, from 1678 to 2262")
+
+// defaultReapInterval is how often the reaper looks for expired
+// documents.
+const defaultReapInterval = time.Second
+
+// reapBatchSize is the number of expired documents deleted together.
+const reapBatchSize = 100
+
+// encodeExpKey returns an expiry index key for the time at, encoded
+// by encodeTime. Supplying nil docID returns the lower bound of the
+// keys at that time.
+func encodeExpKey(at, docID []byte) []byte {
+	// [ expIdxNamespace, 00, time, docID ]
+	buf := make([]byte, 0, 10+len(docID))
+	buf = append(buf, expIdxNamespace, 0)
+	buf = append(buf, at...)
+	return append(buf, docID...)
+}
+
+// documentExpiry returns the time document expires at, and whether it
+// expires at all, or errBadExpires.
+func documentExpiry(document map[string]any) (time.Time, bool, error) {
+	var t time.Time
+	switch v := document[expiresField].(type) {
+	case nil:
+		return t, false, nil
+	case string:
+		var ok bool
+		if t, ok = parseTimestamp(v); !ok {
+			return t, false, errBadExpires
+		}
+	case float64:
+		if math.IsNaN(v) || math.Abs(v) > math.MaxInt64/1e9 {
+			return t, false, errBadExpires
+		}
+		sec, frac := math.Modf(v)
+		t = time.Unix(int64(sec), int64(frac*1e9))
+	default:
+		return t, false, errBadExpires
+	}
+	// Beyond the times encodeTime covers
+	if t.Before(time.Unix(0, math.MinInt64)) || t.After(time.Unix(0, math.MaxInt64)) {
+		return t, false, errBadExpires
+	}
+	return t, true, nil
+}
+
+// withExpiry returns document as s stores it: with an _expires field
+// if s has a TTL and document doesn't have one. It returns
+// errBadExpires if document's _expires isn't a time.
+func (s server) withExpiry(document map[string]any) (map[string]any, error) {
+	if _, _, err := documentExpiry(document); err != nil {
+		return nil, err
+	}
+	if _, ok := document[expiresField]; ok || s.ttl == 0 {
+		return document, nil
+	}
+
+	stored := make(map[string]any, len(document)+1)
+	for k, v := range document {
+		stored[k] = v
+	}
+	stored[expiresField] = time.Now().Add(s.ttl).UTC().Format(time.RFC3339)
+	return stored, nil
+}
+
+// expiredIDs returns the IDs of up to limit documents of s that had
+// expired by now, in expiry order.
+func (s server) expiredIDs(now time.Time, limit int) ([]string, error) {
+	s.idx.mu.RLock()
+	defer s.idx.mu.RUnlock()
+
+	iter := s.indexDb().NewIter(&IterOptions{
+		LowerBound: []byte{expIdxNamespace, 0},
+		UpperBound: encodeExpKey(encodeTime(now.Add(time.Nanosecond)), nil),
+	})
+	var ids []string
+	for iter.First(); iter.Valid() && len(ids) < limit; iter.Next() {
+		ids = append(ids, string(iter.Key()[10:]))
+	}
+	return ids, iter.Close()
+}
+
+// deleteExpired deletes the documents of s with ids that had expired
+// by now, and returns how many it deleted. Documents that no longer
+// exist, or have been given a later expiry, are left alone.
+func (s server) deleteExpired(ids []string, now time.Time) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return 0, err
+	}
+
+	b := s.db.NewBatch()
+	defer b.Close()
+	indexDb := s.indexDb()
+	ib := indexDb.NewBatch()
+	defer ib.Close()
+
+	var deleted []string
+	var changes []Change
+	for _, id := range ids {
+		document, rev, err := readDocument(b, []byte(id))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		t, ok, _ := documentExpiry(document)
+		if !ok || t.After(now) {
+			continue
+		}
+
+		if err := unindexBatch(ib, []byte(id)); err != nil {
+			return 0, err
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return 0, err
+		}
+		deleted = append(deleted, id)
+		changes = append(changes, Change{ID: id, Rev: rev, Deleted: true})
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	seq, err := s.logChanges(b, changes...)
+	if err != nil {
+		return 0, err
+	}
+
+	// As with deleteDocument, the index is written first
+	if err := indexDb.Apply(ib); err != nil {
+		return 0, err
+	}
+	if err := s.db.Apply(b); err != nil {
+		return 0, err
+	}
+	s.feed.publish(seq)
+	return len(deleted), s.updateShadow(deleted...)
+}
+
+// reap deletes the documents of every collection that had expired by
+// now, and returns how many it deleted.
+func (s server) reap(now time.Time) (int, error) {
+	if s.cols.readOnly() {
+		return 0, nil
+	}
+	total := 0
+	for _, name := range s.listCollections() {
+		c, err := s.collection(name)
+		if err != nil {
+			continue
+		}
+		for {
+			ids, err := c.expiredIDs(now, reapBatchSize)
+			if err != nil {
+				return total, err
+			}
+			n, err := c.deleteExpired(ids, now)
+			total += n
+			if err == ErrNoCollection {
+				break
+			} else if err != nil {
+				return total, err
+			}
+			// Stop at a batch with nothing to delete too, which
+			// only stale index entries can cause
+			if len(ids) < reapBatchSize || n == 0 {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// reaper deletes expired documents in the background.
+type reaper struct {
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+// startReaper starts deleting expired documents every interval, if
+// it isn't already.
+func (s server) startReaper(interval time.Duration) {
+	s.cols.mu.Lock()
+	defer s.cols.mu.Unlock()
+	if s.cols.reaper != nil {
+		return
+	}
+	r := &reaper{stop: make(chan struct{})}
+	s.cols.reaper = r
+
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		for {
+			select {
+			case <-time.After(interval):
+			case <-r.stop:
+				return
+			}
+			if _, err := s.reap(time.Now()); err != nil {
+				log.Printf("Could not delete expired documents: %v", err)
+			}
+		}
+	}()
+}
+
+// stopReaper stops the reaper, if it's running, and waits for it to
+// return.
+func (s server) stopReaper() {
+	s.cols.mu.Lock()
+	r := s.cols.reaper
+	s.cols.reaper = nil
+	s.cols.mu.Unlock()
+	if r != nil {
+		close(r.stop)
+		r.running.Wait()
+	}
+}
+
+// StartReaper starts deleting documents in the background once they
+// expire, until the database is closed. See Options.TTL.
+func (db *DB) StartReaper() {
+	db.s.startReaper(defaultReapInterval)
+}
@@ -0,0 +1,146 @@
+package docdb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_documentExpiry(t *testing.T) {
+	tests := []struct {
+		expires  any
+		expected time.Time
+		ok       bool
+		err      error
+	}{
+		{nil, time.Time{}, false, nil},
+		{"2030-01-02T03:04:05Z", time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), true, nil},
+		{1700000000.5, time.Unix(1700000000, 5e8), true, nil},
+		{"tomorrow", time.Time{}, false, errBadExpires},
+		{true, time.Time{}, false, errBadExpires},
+		{"9999-01-01T00:00:00Z", time.Time{}, false, errBadExpires},
+		{1e300, time.Time{}, false, errBadExpires},
+	}
+	for _, test := range tests {
+		at, ok, err := documentExpiry(map[string]any{"_expires": test.expires})
+		assert.Equal(t, test.err, err, "%v", test.expires)
+		assert.Equal(t, test.ok, ok, "%v", test.expires)
+		if ok {
+			assert.True(t, test.expected.Equal(at), "%v", test.expires)
+		}
+	}
+}
+
+func Test_reap(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.addDocument("past", map[string]any{"_expires": "2029-12-31T23:00:00Z"})
+	s.addDocument("now", map[string]any{"_expires": float64(now.Unix())})
+	s.addDocument("later", map[string]any{"_expires": "2030-01-01T01:00:00Z"})
+	s.addDocument("never", map[string]any{"_expires": nil})
+	s.addDocument("plain", map[string]any{})
+	// Extending a document's expiry moves its entry
+	s.addDocument("extended", map[string]any{"_expires": "2029-12-31T00:00:00Z"})
+	s.addDocument("extended", map[string]any{"_expires": "2031-01-01T00:00:00Z"})
+	_, err = s.putDocument("bad", map[string]any{"_expires": "soon"}, anyRevision)
+	assert.Equal(t, errBadExpires, err)
+
+	ids, err := s.expiredIDs(now, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"past", "now"}, ids)
+
+	n, err := s.reap(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	for _, id := range []string{"later", "never", "plain", "extended"} {
+		_, err := s.getDocumentById([]byte(id))
+		assert.Nil(t, err, id)
+	}
+	_, err = s.getDocumentById([]byte("past"))
+	assert.Equal(t, ErrNotFound, err)
+	report, _ := s.checkIndex(false)
+	assert.True(t, report.ok())
+
+	changes, err := s.changesSince(7, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Seq: 8, ID: "past", Rev: 1, Deleted: true},
+		{Seq: 9, ID: "now", Rev: 1, Deleted: true},
+	}, changes)
+
+	n, err = s.reap(now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	ids, err = s.expiredIDs(now.AddDate(10, 0, 0), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"extended"}, ids)
+}
+
+func Test_TTL(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open database")
+	}
+	defer db.Close()
+	_, err = db.CreateCollection("bad", &Options{TTL: "-1h"})
+	assert.Error(t, err)
+	sessions, err := db.CreateCollection("sessions", &Options{TTL: "1h"})
+	assert.Nil(t, err)
+
+	body := map[string]any{"user": "kate"}
+	_, err = sessions.Put(ctx, "s1", body)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"user": "kate"}, body)
+	doc, err := sessions.Get(ctx, "s1")
+	assert.Nil(t, err)
+	at, ok, err := documentExpiry(doc.Body)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), at, time.Minute)
+
+	// Documents can keep their own expiry, or none
+	sessions.Put(ctx, "s2", map[string]any{"_expires": nil})
+	writer := sessions.NewBulkWriter(0)
+	writer.Put(ctx, "s3", map[string]any{"user": "phil"})
+	results, err := writer.Flush(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, results[0].Err)
+	docs, err := sessions.Find(ctx, `_expires:>"2000"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(docs))
+
+	n, err := db.s.reap(time.Now().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	_, err = sessions.Get(ctx, "s2")
+	assert.Nil(t, err)
+}
+
+func Test_reaper(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	defer s.close()
+	s.startReaper(5 * time.Millisecond)
+	s.startReaper(5 * time.Millisecond)
+
+	expires := time.Now().Add(20 * time.Millisecond).Format(time.RFC3339Nano)
+	s.addDocument("a", map[string]any{"_expires": expires})
+	assert.Eventually(t, func() bool {
+		_, err := s.getDocumentById([]byte("a"))
+		return err == ErrNotFound
+	}, 5*time.Second, 5*time.Millisecond)
+
+	resp, _ := doRequest(t, s, "PUT", "/docs/b", `{"_expires": "soon"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/collections/c", `{"ttl": "often"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,71 @@
+package docdb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// This file contains exports, which write documents out as the lines
+// of the bulk API, {"id": .., "body": ..}, so that they can be
+// imported into another database or posted to /docs/_bulk.
+// Revisions are left out, as they belong to this database.
+
+// Export writes the documents of the collection that match query, or
+// all of them if it's empty, to w as newline-delimited JSON, and
+// returns how many it wrote. Documents are in the order Find returns
+// them, or ID order for every document.
+func (c *Collection) Export(ctx context.Context, w io.Writer, query string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	count := 0
+	write := func(id string, document map[string]any) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		count++
+		return enc.Encode(bulkLine{ID: id, Body: document})
+	}
+
+	var err error
+	if query == "" {
+		err = c.s.scanDocuments(write)
+	} else {
+		var docs []Document
+		docs, err = c.Find(ctx, query)
+		for i := 0; err == nil && i < len(docs); i++ {
+			err = write(docs[i].ID, docs[i].Body)
+		}
+	}
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// Export writes documents of the default collection. See
+// Collection.Export.
+func (db *DB) Export(ctx context.Context, w io.Writer, query string) (int, error) {
+	return db.def.Export(ctx, w, query)
+}
+
+// scanDocuments calls fn with every document of s in ID order, as of
+// when it's called, until fn returns an error.
+func (s server) scanDocuments(fn func(id string, document map[string]any) error) error {
+	snap := s.db.NewSnapshot()
+	defer snap.Close()
+	iter := snap.NewIter(nil)
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		document, _, err := decodeDocument(iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(string(iter.Key()), document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package docdb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Export(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	db.Put(ctx, "phil", map[string]any{"age": 41})
+	db.Put(ctx, "mike", map[string]any{"age": 40})
+	db.Put(ctx, "mike", map[string]any{"age": 40, "name": "Mike"})
+	other, _ := db.CreateCollection("other", nil)
+	other.Put(ctx, "tim", map[string]any{"age": 39})
+
+	var out bytes.Buffer
+	count, err := db.Export(ctx, &out, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, `{"id":"mike","body":{"age":40,"name":"Mike"}}
+{"id":"phil","body":{"age":41}}
+`, out.String())
+
+	var filtered bytes.Buffer
+	count, err = db.Export(ctx, &filtered, "age:>40")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "{\"id\":\"phil\",\"body\":{\"age\":41}}\n", filtered.String())
+	_, err = db.Export(ctx, &filtered, "age:/[/")
+	assert.Error(t, err)
+
+	// An export imports into another collection as it was
+	_, err = other.Import(ctx, &out, &ImportOptions{Format: "bulk"})
+	assert.NoError(t, err)
+	var copied bytes.Buffer
+	count, _ = other.Export(ctx, &copied, "age:<41")
+	assert.Equal(t, 2, count)
+	assert.Contains(t, copied.String(), `{"id":"mike","body":{"age":40,"name":"Mike"}}`)
+}
@@ -0,0 +1,228 @@
+package docdb
+
+import (
+	"encoding/binary"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/blevesearch/segment"
+	"github.com/blevesearch/snowballstem"
+	"github.com/blevesearch/snowballstem/english"
+)
+
+// This file contains the full-text index.
+//
+// The inverted index stores string values verbatim, so they can
+// only be matched exactly or by range. Paths listed in
+// indexConfig.fullText are additionally analysed into terms:
+// the text is split on word boundaries, lowercased and stemmed.
+// Each term is stored as a posting key in ftsIdxNamespace:
+//
+//     [ 't', 00, path, 00, term, 00, docID ] -> positions
+//
+// The value holds the positions of the term within the text as
+// uvarints, which allows phrase queries and gives us the term
+// frequency for scoring.
+//
+// We also store the number of terms in the text for each document
+// in ftsLenNamespace, which BM25 uses to normalise scores for
+// document length:
+//
+//     [ 'l', 00, path, 00, docID ] -> term count
+//
+// Both are removed by unindex, which re-analyses the value stored in
+// the forward index. This means that analysis must be deterministic.
+
+// BM25 tuning parameters, the commonly used defaults.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// analyze splits text into its terms, in order.
+func analyze(text string) []string {
+	var terms []string
+	seg := segment.NewWordSegmenterDirect([]byte(text))
+	for seg.Segment() {
+		if seg.Type() == segment.None {
+			// Whitespace and punctuation
+			continue
+		}
+		env := snowballstem.NewEnv(strings.ToLower(seg.Text()))
+		english.Stem(env)
+		terms = append(terms, env.Current())
+	}
+	if err := seg.Err(); err != nil {
+		log.Printf("Could not fully analyse text: %v", err)
+	}
+	return terms
+}
+
+// indexText adds the postings and length entry for text at path in
+// docID to b.
+func indexText(b KVBatch, path, text, docID []byte) error {
+	terms := analyze(string(text))
+
+	positions := map[string][]byte{}
+	for i, term := range terms {
+		positions[term] = binary.AppendUvarint(positions[term], uint64(i))
+	}
+	for term, pos := range positions {
+		err := b.Set(encodeFtsKey(path, []byte(term), docID), pos)
+		if err != nil {
+			return err
+		}
+	}
+
+	length := binary.AppendUvarint(nil, uint64(len(terms)))
+	return b.Set(encodeFtsLenKey(path, docID), length)
+}
+
+// unindexText removes the entries added by indexText from b.
+func unindexText(b KVBatch, path, text, docID []byte) error {
+	for _, term := range analyze(string(text)) {
+		err := b.Delete(encodeFtsKey(path, []byte(term), docID))
+		if err != nil {
+			return err
+		}
+	}
+	return b.Delete(encodeFtsLenKey(path, docID))
+}
+
+// decodePositions decodes the uvarint positions in a posting value.
+func decodePositions(v []byte) []int {
+	var positions []int
+	for len(v) > 0 {
+		p, n := binary.Uvarint(v)
+		if n <= 0 {
+			break
+		}
+		positions = append(positions, int(p))
+		v = v[n:]
+	}
+	return positions
+}
+
+// textPostings returns the positions of term at path for each document
+// containing it.
+func textPostings(indexDb KVReader, path, term string) (map[string][]int, error) {
+	postings := map[string][]int{}
+	startKey := encodeFtsKey([]byte(path), []byte(term), nil)
+	endKey := append(startKey[:len(startKey)-1:len(startKey)-1], 1)
+
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	iter := indexDb.NewIter(readOptions)
+	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
+		k := decodeFtsKey(iter.Key())
+		postings[string(k.docID)] = decodePositions(iter.Value())
+	}
+	return postings, iter.Close()
+}
+
+// lookupText returns the IDs of documents where the text at path
+// contains the terms of text as a phrase. A single term is a
+// phrase of length one.
+func lookupText(indexDb KVReader, path string, text string) ([]string, error) {
+	ids := []string{}
+	terms := analyze(text)
+	if len(terms) == 0 {
+		return ids, nil
+	}
+
+	termPostings := make([]map[string][]int, len(terms))
+	for i, term := range terms {
+		postings, err := textPostings(indexDb, path, term)
+		if err != nil {
+			return nil, err
+		}
+		termPostings[i] = postings
+	}
+
+	for id, starts := range termPostings[0] {
+		if phraseAt(termPostings, id, starts) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// phraseAt returns true if, for one of the starts, each term i of the
+// phrase appears in id at start+i.
+func phraseAt(termPostings []map[string][]int, id string, starts []int) bool {
+	for _, start := range starts {
+		found := true
+		for i := 1; i < len(termPostings) && found; i++ {
+			found = false
+			for _, p := range termPostings[i][id] {
+				if p == start+i {
+					found = true
+					break
+				}
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// textStats returns the number of documents with full-text indexed
+// values at path, and their average length in terms.
+func textStats(indexDb KVReader, path string) (int, float64, error) {
+	startKey := encodeFtsLenKey([]byte(path), nil)
+	endKey := append(startKey[:len(startKey)-1:len(startKey)-1], 1)
+
+	count, total := 0, uint64(0)
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	iter := indexDb.NewIter(readOptions)
+	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
+		l, _ := binary.Uvarint(iter.Value())
+		count++
+		total += l
+	}
+	if count == 0 {
+		return 0, 0, iter.Close()
+	}
+	return count, float64(total) / float64(count), iter.Close()
+}
+
+// scoreText returns the BM25 score of text at path for each of ids.
+// Phrases are scored as the sum of the scores of their terms.
+func scoreText(indexDb KVReader, path string, text string, ids []string) (map[string]float64, error) {
+	scores := map[string]float64{}
+	n, avgLen, err := textStats(indexDb, path)
+	if err != nil || n == 0 {
+		return scores, err
+	}
+
+	lengths := map[string]float64{}
+	for _, id := range ids {
+		v, closer, err := indexDb.Get(encodeFtsLenKey([]byte(path), []byte(id)))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		l, _ := binary.Uvarint(v)
+		lengths[id] = float64(l)
+		closer.Close()
+	}
+
+	for _, term := range analyze(text) {
+		postings, err := textPostings(indexDb, path, term)
+		if err != nil {
+			return nil, err
+		}
+		df := float64(len(postings))
+		idf := math.Log((float64(n)-df+0.5)/(df+0.5) + 1)
+
+		for id, length := range lengths {
+			tf := float64(len(postings[id]))
+			norm := bm25K1 * (1 - bm25B + bm25B*length/avgLen)
+			scores[id] += idf * tf * (bm25K1 + 1) / (tf + norm)
+		}
+	}
+	return scores, nil
+}
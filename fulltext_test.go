@@ -0,0 +1,111 @@
+package docdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_analyze(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"fast database", []string{"fast", "databas"}},
+		{"The FAST databases, running!", []string{"the", "fast", "databas", "run"}},
+		{"  ", nil},
+		{"version 2 of it", []string{"version", "2", "of", "it"}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, analyze(test.text), test.text)
+	}
+}
+
+func Test_lookupText(t *testing.T) {
+	db := NewMemoryKV()
+	cfg := &indexConfig{fullText: []string{"description"}}
+	index(db, cfg, "doc1", map[string]any{
+		"description": "A fast database for documents",
+		"name":        "fast database",
+	})
+	index(db, cfg, "doc2", map[string]any{
+		"description": "Databases that are fast",
+	})
+	index(db, cfg, "doc3", map[string]any{
+		"description": "A slow key value store",
+	})
+
+	ids, _ := lookupText(db, "description", "fast")
+	assert.ElementsMatch(t, []string{"doc1", "doc2"}, ids)
+	ids, _ = lookupText(db, "description", "DATABASE")
+	assert.ElementsMatch(t, []string{"doc1", "doc2"}, ids)
+	ids, _ = lookupText(db, "description", "fast database")
+	assert.ElementsMatch(t, []string{"doc1"}, ids)
+	ids, _ = lookupText(db, "description", "database fast")
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupText(db, "description", "store")
+	assert.ElementsMatch(t, []string{"doc3"}, ids)
+
+	// Only configured paths are analysed
+	ids, _ = lookupText(db, "name", "fast")
+	assert.ElementsMatch(t, []string{}, ids)
+
+	// Reindexing replaces old terms, unindexing removes them
+	index(db, cfg, "doc2", map[string]any{
+		"description": "A slow thing",
+	})
+	ids, _ = lookupText(db, "description", "fast")
+	assert.ElementsMatch(t, []string{"doc1"}, ids)
+	unindex(db, []byte("doc3"))
+	ids, _ = lookupText(db, "description", "slow")
+	assert.ElementsMatch(t, []string{"doc2"}, ids)
+	n, _, _ := textStats(db, "description")
+	assert.Equal(t, 2, n)
+}
+
+func Test_scoreText(t *testing.T) {
+	db := NewMemoryKV()
+	cfg := &indexConfig{fullText: []string{"description"}}
+	index(db, cfg, "short", map[string]any{
+		"description": "fast database",
+	})
+	index(db, cfg, "long", map[string]any{
+		"description": "a database which is not especially fast at anything",
+	})
+	index(db, cfg, "repeated", map[string]any{
+		"description": "fast fast fast database",
+	})
+	index(db, cfg, "other", map[string]any{
+		"description": "a key value store",
+	})
+
+	ids := []string{"short", "long", "repeated"}
+	scores, err := scoreText(db, "description", "fast", ids)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.Len(t, scores, 3)
+	assert.Greater(t, scores["short"], scores["long"])
+	assert.Greater(t, scores["repeated"], scores["short"])
+}
+
+// Unindexing full-text entries needs the original text, which
+// isn't in the keys when strings are collated.
+func Test_unindexTextCollated(t *testing.T) {
+	db := NewMemoryKV()
+	cfg := &indexConfig{
+		fullText:  []string{"description"},
+		collation: collationUnicode,
+	}
+	index(db, cfg, "doc1", map[string]any{"description": "A Fast Database"})
+
+	ids, _ := lookupText(db, "description", "fast")
+	assert.ElementsMatch(t, []string{"doc1"}, ids)
+
+	unindex(db, []byte("doc1"))
+	ids, _ = lookupText(db, "description", "fast")
+	assert.ElementsMatch(t, []string{}, ids)
+	n, _, _ := textStats(db, "description")
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,299 @@
+package docdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+)
+
+// This file contains the geospatial index.
+//
+// Paths listed in indexConfig.geo hold points, objects like
+// {"lat": 51.5, "lon": -0.12}. The inverted index has the lat
+// and lon as two unrelated numbers, which can't be used to
+// efficiently find points near each other. So we also index
+// each point by its cell in geoIdxNamespace:
+//
+//     [ 'g', 00, path, 00, cell (8 bytes), 00, docID ] -> lat, lon
+//
+// The cell is a geohash-like Z-order curve value: 32 bits each
+// of latitude and longitude, interleaved starting with longitude.
+// Any prefix of the cell's bits is a larger cell that contains it,
+// and the points within a cell have contiguous keys. Queries find a
+// small set of cells covering the area they're interested in, scan
+// the key range for each cell, then filter the points in the range
+// by their exact position, which is stored in the value.
+//
+// The forward index entry for a point has the point's path, the
+// encoded point as its value and lists only geoIdxNamespace.
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+// maxGeoCells is the maximum number of cells a query area is
+// covered by. More cells mean more, but smaller, range scans.
+const maxGeoCells = 16
+
+type geoPoint struct {
+	lat, lon float64
+}
+
+// geoBox is an area bounded by lines of latitude and longitude.
+// When minLon > maxLon, the box crosses the antimeridian.
+type geoBox struct {
+	minLat, minLon, maxLat, maxLon float64
+}
+
+// geoCircle is the area within meters of a center point.
+type geoCircle struct {
+	center geoPoint
+	meters float64
+}
+
+// asFloat returns v as a float64 if it is a number.
+func asFloat(v any) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int8:
+		return float64(t), true
+	case int16:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint:
+		return float64(t), true
+	case uint8:
+		return float64(t), true
+	case uint16:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+// geoPointFromValue returns the point in a document value, which
+// must be an object with numeric lat and lon fields in range.
+func geoPointFromValue(v any) (geoPoint, error) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return geoPoint{}, errors.New("Point must be an object")
+	}
+	lat, latOk := asFloat(m["lat"])
+	lon, lonOk := asFloat(m["lon"])
+	if !latOk || !lonOk {
+		return geoPoint{}, errors.New("Point must have numeric lat and lon")
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return geoPoint{}, errors.New(
+			fmt.Sprintf("Point (%f, %f) is out of range", lat, lon))
+	}
+	return geoPoint{lat, lon}, nil
+}
+
+// encodeGeoPoint serialises p to 16 bytes.
+func encodeGeoPoint(p geoPoint) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], math.Float64bits(p.lat))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(p.lon))
+	return buf
+}
+
+// decodeGeoPoint deserialises a point encoded by encodeGeoPoint.
+func decodeGeoPoint(b []byte) (geoPoint, error) {
+	if len(b) != 16 {
+		return geoPoint{}, errors.New("Encoded point must be 16 bytes")
+	}
+	return geoPoint{
+		lat: math.Float64frombits(binary.BigEndian.Uint64(b[:8])),
+		lon: math.Float64frombits(binary.BigEndian.Uint64(b[8:])),
+	}, nil
+}
+
+// geoCellIndexes returns the row and column, from the south west,
+// of the cell containing p on a grid of 2^bits by 2^bits cells.
+func geoCellIndexes(p geoPoint, bits int) (uint64, uint64) {
+	n := float64(uint64(1) << bits)
+	lat := uint64((p.lat + 90) / 180 * n)
+	lon := uint64((p.lon + 180) / 360 * n)
+	// The north pole and antimeridian fall on the far edge
+	max := uint64(1)<<bits - 1
+	if lat > max {
+		lat = max
+	}
+	if lon > max {
+		lon = max
+	}
+	return lat, lon
+}
+
+// interleave returns the bits of lon and lat interleaved, starting
+// with the most significant bit of lon.
+func interleave(lat, lon uint32) uint64 {
+	var cell uint64
+	for i := 31; i >= 0; i-- {
+		cell = cell<<1 | uint64(lon>>i&1)
+		cell = cell<<1 | uint64(lat>>i&1)
+	}
+	return cell
+}
+
+// geoCell returns the full resolution cell of p.
+func geoCell(p geoPoint) uint64 {
+	lat, lon := geoCellIndexes(p, 32)
+	return interleave(uint32(lat), uint32(lon))
+}
+
+// geoCellRange is the range of full resolution cells [start, end].
+type geoCellRange struct {
+	start, end uint64
+}
+
+// geoCovering returns ranges of cells that together cover box, using
+// the smallest cells that need no more than maxGeoCells to do so.
+func geoCovering(box geoBox) []geoCellRange {
+	if box.minLon > box.maxLon {
+		east := geoBox{box.minLat, box.minLon, box.maxLat, 180}
+		west := geoBox{box.minLat, -180, box.maxLat, box.maxLon}
+		return append(geoCovering(east), geoCovering(west)...)
+	}
+
+	for bits := 32; bits > 0; bits-- {
+		minLat, minLon := geoCellIndexes(geoPoint{box.minLat, box.minLon}, bits)
+		maxLat, maxLon := geoCellIndexes(geoPoint{box.maxLat, box.maxLon}, bits)
+		if (maxLat-minLat+1)*(maxLon-minLon+1) > maxGeoCells {
+			continue
+		}
+
+		var ranges []geoCellRange
+		shift := 32 - bits
+		size := uint64(1)<<(2*shift) - 1
+		for lat := minLat; lat <= maxLat; lat++ {
+			for lon := minLon; lon <= maxLon; lon++ {
+				start := interleave(uint32(lat<<shift), uint32(lon<<shift))
+				ranges = append(ranges, geoCellRange{start, start + size})
+			}
+		}
+		return ranges
+	}
+
+	return nil // Not reached, one bit needs at most four cells
+}
+
+// boundingBox returns a box containing all of c.
+func (c geoCircle) boundingBox() geoBox {
+	dLat := c.meters / earthRadius * 180 / math.Pi
+	minLat, maxLat := c.center.lat-dLat, c.center.lat+dLat
+	if minLat <= -90 || maxLat >= 90 {
+		// Includes a pole, so all longitudes
+		return geoBox{math.Max(minLat, -90), -180, math.Min(maxLat, 90), 180}
+	}
+
+	// Longitude degrees get shorter away from the equator, so use
+	// the latitude of the box furthest from it.
+	widest := math.Max(math.Abs(minLat), math.Abs(maxLat))
+	dLon := dLat / math.Cos(widest*math.Pi/180)
+	if dLon >= 180 {
+		return geoBox{minLat, -180, maxLat, 180}
+	}
+	minLon, maxLon := c.center.lon-dLon, c.center.lon+dLon
+	if minLon < -180 {
+		minLon += 360
+	}
+	if maxLon > 180 {
+		maxLon -= 360
+	}
+	return geoBox{minLat, minLon, maxLat, maxLon}
+}
+
+// contains returns true if p is within b.
+func (b geoBox) contains(p geoPoint) bool {
+	if p.lat < b.minLat || p.lat > b.maxLat {
+		return false
+	}
+	if b.minLon > b.maxLon {
+		return p.lon >= b.minLon || p.lon <= b.maxLon
+	}
+	return p.lon >= b.minLon && p.lon <= b.maxLon
+}
+
+// contains returns true if p is within c.
+func (c geoCircle) contains(p geoPoint) bool {
+	return geoDistance(c.center, p) <= c.meters
+}
+
+// geoDistance returns the great circle distance between a and b in
+// meters, using the haversine formula.
+func geoDistance(a, b geoPoint) float64 {
+	toRad := math.Pi / 180
+	dLat := (b.lat - a.lat) * toRad
+	dLon := (b.lon - a.lon) * toRad
+	h := math.Pow(math.Sin(dLat/2), 2) +
+		math.Cos(a.lat*toRad)*math.Cos(b.lat*toRad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// indexGeo adds the geo index entry for point p at path in docID to b.
+func indexGeo(b KVBatch, path []byte, p geoPoint, docID []byte) error {
+	k := encodeGeoKey(path, geoCell(p), docID)
+	return b.Set(k, encodeGeoPoint(p))
+}
+
+// unindexGeo removes the entry added by indexGeo from b.
+func unindexGeo(b KVBatch, path []byte, p geoPoint, docID []byte) error {
+	return b.Delete(encodeGeoKey(path, geoCell(p), docID))
+}
+
+// lookupGeoBox returns IDs of documents with a point at path within box.
+func lookupGeoBox(indexDb KVReader, path string, box geoBox) ([]string, error) {
+	return scanGeo(indexDb, path, box, box.contains)
+}
+
+// lookupGeoRadius returns IDs of documents with a point at path within
+// circle.
+func lookupGeoRadius(indexDb KVReader, path string, circle geoCircle) ([]string, error) {
+	return scanGeo(indexDb, path, circle.boundingBox(), circle.contains)
+}
+
+// scanGeo returns IDs of documents with a point at path within box for
+// which match returns true.
+func scanGeo(indexDb KVReader, path string, box geoBox, match func(geoPoint) bool) ([]string, error) {
+	ids := []string{}
+	for _, r := range geoCovering(box) {
+		startKey := encodeGeoKey([]byte(path), r.start, nil)
+		endKey := prefixEndKey(encodeGeoKey([]byte(path), r.end, nil))
+
+		readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+		iter := indexDb.NewIter(readOptions)
+		for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
+			gk, err := decodeGeoKey(iter.Key())
+			if err != nil {
+				log.Printf("Bad geo index key found %v: %v", iter.Key(), err)
+				continue
+			}
+			p, err := decodeGeoPoint(iter.Value())
+			if err != nil {
+				log.Printf("Bad geo index value found %v: %v", iter.Key(), err)
+				continue
+			}
+			if match(p) {
+				ids = append(ids, string(gk.docID))
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
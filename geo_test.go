@@ -0,0 +1,110 @@
+package docdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_geoKey(t *testing.T) {
+	cell := geoCell(geoPoint{51.5, -0.12})
+	k := encodeGeoKey([]byte("location"), cell, []byte("london"))
+	gk, err := decodeGeoKey(k)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.Equal(t, []byte("location"), gk.path)
+	assert.Equal(t, cell, gk.cell)
+	assert.Equal(t, []byte("london"), gk.docID)
+
+	// The truncated key is a prefix of the full key
+	assert.Equal(t, encodeGeoKey([]byte("location"), cell, nil), k[:len(k)-7])
+}
+
+func Test_geoCell(t *testing.T) {
+	// The first bit splits east and west, the second north and south
+	assert.Equal(t, uint64(0b00), geoCell(geoPoint{-45, -90})>>62)
+	assert.Equal(t, uint64(0b01), geoCell(geoPoint{45, -90})>>62)
+	assert.Equal(t, uint64(0b10), geoCell(geoPoint{-45, 90})>>62)
+	assert.Equal(t, uint64(0b11), geoCell(geoPoint{45, 90})>>62)
+	assert.Equal(t, uint64(0b11), geoCell(geoPoint{90, 180})>>62)
+
+	// Every point in a box is in one of its covering ranges
+	box := geoBox{51.2, -0.6, 51.8, 0.4}
+	ranges := geoCovering(box)
+	assert.LessOrEqual(t, len(ranges), maxGeoCells)
+	for _, p := range []geoPoint{{51.2, -0.6}, {51.5, -0.12}, {51.8, 0.4}, {51.3, 0.3}} {
+		cell := geoCell(p)
+		found := false
+		for _, r := range ranges {
+			found = found || (cell >= r.start && cell <= r.end)
+		}
+		assert.True(t, found, "%v not in covering", p)
+	}
+}
+
+func Test_geoDistance(t *testing.T) {
+	london := geoPoint{51.5074, -0.1278}
+	paris := geoPoint{48.8566, 2.3522}
+	assert.InDelta(t, 343500, geoDistance(london, paris), 1000)
+	assert.Equal(t, 0.0, geoDistance(london, london))
+}
+
+func Test_lookupGeo(t *testing.T) {
+	db := NewMemoryKV()
+	cfg := &indexConfig{geo: []string{"location"}}
+	points := map[string]geoPoint{
+		"london":    {51.5074, -0.1278},
+		"greenwich": {51.4826, 0.0077},
+		"paris":     {48.8566, 2.3522},
+		"nyc":       {40.7128, -74.0060},
+		"fiji":      {-17.7134, 178.0650},
+		"samoa":     {-13.7590, -172.1046},
+	}
+	for id, p := range points {
+		index(db, cfg, id, map[string]any{
+			"location": map[string]any{"lat": p.lat, "lon": p.lon},
+		})
+	}
+	index(db, cfg, "bad", map[string]any{"location": "nowhere"})
+
+	ids, _ := lookupGeoBox(db, "location", geoBox{51, -1, 52, 1})
+	assert.ElementsMatch(t, []string{"london", "greenwich"}, ids)
+	ids, _ = lookupGeoBox(db, "location", geoBox{40, -80, 55, 5})
+	assert.ElementsMatch(t, []string{"london", "greenwich", "paris", "nyc"}, ids)
+	ids, _ = lookupGeoBox(db, "location", geoBox{-20, 170, -10, -170})
+	assert.ElementsMatch(t, []string{"fiji", "samoa"}, ids)
+
+	ids, _ = lookupGeoRadius(db, "location", geoCircle{points["london"], 10000})
+	assert.ElementsMatch(t, []string{"london", "greenwich"}, ids)
+	ids, _ = lookupGeoRadius(db, "location", geoCircle{points["london"], 5000})
+	assert.ElementsMatch(t, []string{"london"}, ids)
+	ids, _ = lookupGeoRadius(db, "location", geoCircle{points["london"], 400000})
+	assert.ElementsMatch(t, []string{"london", "greenwich", "paris"}, ids)
+	ids, _ = lookupGeoRadius(db, "location", geoCircle{points["fiji"], 1500000})
+	assert.ElementsMatch(t, []string{"fiji", "samoa"}, ids)
+
+	// The lat and lon are still indexed as numbers
+	ids, _ = lookupGT(db, cfg, "location.lat", 50)
+	assert.ElementsMatch(t, []string{"london", "greenwich"}, ids)
+
+	// Moving and removing documents updates the geo index
+	index(db, cfg, "greenwich", map[string]any{
+		"location": map[string]any{"lat": 40.7, "lon": -74.0},
+	})
+	unindex(db, []byte("nyc"))
+	ids, _ = lookupGeoRadius(db, "location", geoCircle{points["london"], 10000})
+	assert.ElementsMatch(t, []string{"london"}, ids)
+	ids, _ = lookupGeoRadius(db, "location", geoCircle{points["nyc"], 10000})
+	assert.ElementsMatch(t, []string{"greenwich"}, ids)
+
+	q, _ := parseQuery(`location:@radius(51.5074,-0.1278,400km) location.lat:>50`)
+	ids, err := searchIndex(db, cfg, q)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.ElementsMatch(t, []string{"london"}, ids)
+	q, _ = parseQuery(`location:@box(-20,170,-10,-170)`)
+	ids, _ = searchIndex(db, cfg, q)
+	assert.ElementsMatch(t, []string{"fiji", "samoa"}, ids)
+}
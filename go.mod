@@ -3,11 +3,16 @@ module github.com/eatonphil/docdb
 go 1.18
 
 require (
+	github.com/blevesearch/segment v0.9.0
+	github.com/blevesearch/snowballstem v0.9.0
 	github.com/blugelabs/query_string v0.3.0
 	github.com/cockroachdb/pebble v0.0.0-20220325223901-d7fb4eb296d0
-	github.com/google/uuid v1.3.0
+	github.com/google/btree v1.1.2
+	github.com/google/uuid v1.6.0
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/oklog/ulid v1.3.1
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/text v0.3.2
 )
 
 require (
@@ -17,8 +22,6 @@ require (
 	github.com/bits-and-blooms/bitset v1.2.0 // indirect
 	github.com/blevesearch/go-porterstemmer v1.0.3 // indirect
 	github.com/blevesearch/mmap-go v1.0.2 // indirect
-	github.com/blevesearch/segment v0.9.0 // indirect
-	github.com/blevesearch/snowballstem v0.9.0 // indirect
 	github.com/blevesearch/vellum v1.0.5 // indirect
 	github.com/blugelabs/bluge v0.1.7 // indirect
 	github.com/blugelabs/bluge_segment_api v0.2.0 // indirect
@@ -41,6 +44,5 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/exp v0.0.0-20200513190911-00229845015e // indirect
 	golang.org/x/sys v0.0.0-20210909193231-528a39cd75f3 // indirect
-	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
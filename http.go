@@ -0,0 +1,722 @@
+package docdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// This file contains the HTTP API. Responses are JSON objects with
+// a status of "ok" and the result in body, or a status of "error"
+// and a message in error.
+//
+// POST to /docs inserts a document with an ID generated by the
+// server, and PUT to /docs/:id stores one with the caller's ID. POST
+// to /docs/_bulk stores many documents at once.
+//
+// PATCH to /docs/:id changes part of a document, with a JSON Patch
+// body of Content-Type application/json-patch+json, or a JSON Merge
+// Patch of application/merge-patch+json.
+//
+// A document's revision is its ETag. Writes can be made conditional
+// on the stored revision with If-Match, or on there being no stored
+// document with If-None-Match: *. Failed conditions return 412.
+//
+// GET /_changes returns the change feed. A continuous feed is
+// newline-delimited changes rather than a response object.
+//
+// POST /_backup with a body of {"dir": ..} writes a backup of the
+// database to dir, a new directory on the server.
+//
+// A follower, replicating another docdb, reports how far behind it is
+// at GET /_replication, and refuses writes with 403.
+//
+// PUT /_webhooks/:webhook adds a webhook, with a body of its query
+// and url, and DELETE removes it.
+//
+// PUT /_schema sets the JSON Schema that written documents must
+// match, and DELETE removes it. Writes of documents that don't match
+// return 400, with the ways they don't in errors.
+//
+// Collections other than the default one are under
+// /collections/:collection, with the same /docs routes as the
+// default collection. PUT on a collection creates it, with a body of
+// its Options, and DELETE drops it. Each has its own /_changes,
+// /_webhooks and /_schema.
+
+// errBadETag is returned for conditional headers that don't hold
+// a revision.
+var errBadETag = errors.New("Bad ETag in conditional header")
+
+// router returns the HTTP handler for the API.
+func (s server) router() *httprouter.Router {
+	router := httprouter.New()
+	router.GET("/docs", s.searchHandler)
+	router.POST("/docs", s.insertDocumentHandler)
+	router.POST("/docs/_bulk", s.bulkHandler)
+	router.GET("/docs/:id", s.getDocumentHandler)
+	router.PUT("/docs/:id", s.putDocumentHandler)
+	router.PATCH("/docs/:id", s.patchDocumentHandler)
+	router.DELETE("/docs/:id", s.deleteDocumentHandler)
+	router.GET("/_changes", s.changesHandler)
+	router.GET("/_replication", s.replicationHandler)
+	router.GET("/_webhooks", s.listWebhooksHandler)
+	router.PUT("/_webhooks/:webhook", s.putWebhookHandler)
+	router.DELETE("/_webhooks/:webhook", s.deleteWebhookHandler)
+	router.GET("/_schema", s.getSchemaHandler)
+	router.PUT("/_schema", s.putSchemaHandler)
+	router.DELETE("/_schema", s.deleteSchemaHandler)
+	router.POST("/_backup", s.backupHandler)
+	router.GET("/_reindex", s.reindexProgressHandler)
+	router.POST("/_reindex", s.startReindexHandler)
+
+	router.GET("/collections", s.listCollectionsHandler)
+	router.GET("/collections/:collection", s.inCollection(server.getCollectionHandler))
+	router.PUT("/collections/:collection", s.createCollectionHandler)
+	router.DELETE("/collections/:collection", s.dropCollectionHandler)
+	router.GET("/collections/:collection/docs", s.inCollection(server.searchHandler))
+	router.POST("/collections/:collection/docs", s.inCollection(server.insertDocumentHandler))
+	router.POST("/collections/:collection/docs/_bulk", s.inCollection(server.bulkHandler))
+	router.GET("/collections/:collection/docs/:id", s.inCollection(server.getDocumentHandler))
+	router.PUT("/collections/:collection/docs/:id", s.inCollection(server.putDocumentHandler))
+	router.PATCH("/collections/:collection/docs/:id", s.inCollection(server.patchDocumentHandler))
+	router.DELETE("/collections/:collection/docs/:id", s.inCollection(server.deleteDocumentHandler))
+	router.GET("/collections/:collection/_changes", s.inCollection(server.changesHandler))
+	router.GET("/collections/:collection/_webhooks", s.inCollection(server.listWebhooksHandler))
+	router.PUT("/collections/:collection/_webhooks/:webhook", s.inCollection(server.putWebhookHandler))
+	router.DELETE("/collections/:collection/_webhooks/:webhook", s.inCollection(server.deleteWebhookHandler))
+	router.GET("/collections/:collection/_schema", s.inCollection(server.getSchemaHandler))
+	router.PUT("/collections/:collection/_schema", s.inCollection(server.putSchemaHandler))
+	router.DELETE("/collections/:collection/_schema", s.inCollection(server.deleteSchemaHandler))
+	return router
+}
+
+// inCollection returns a handler that calls h with the collection
+// named in the request.
+func (s server) inCollection(h func(server, http.ResponseWriter, *http.Request, httprouter.Params)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		c, err := s.collection(ps.ByName("collection"))
+		if err != nil {
+			jsonError(w, errorStatus(err), err)
+			return
+		}
+		h(*c, w, r, ps)
+	}
+}
+
+func (s server) listCollectionsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jsonResponse(w, http.StatusOK, map[string]any{"collections": s.listCollections()})
+}
+
+func (s server) createCollectionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var opts *Options
+	err := json.NewDecoder(r.Body).Decode(&opts)
+	if err == nil || err == io.EOF {
+		_, err = opts.indexConfig()
+	}
+	if err == nil {
+		_, err = newIDGenerator(opts.idStrategy())
+	}
+	if err == nil {
+		_, err = opts.ttl()
+	}
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	name := ps.ByName("collection")
+	_, err = s.createCollection(name, opts)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusCreated, map[string]any{"name": name})
+}
+
+// getCollectionHandler returns the name and Options of a collection.
+// The default collection's options aren't stored, so they're null.
+func (s server) getCollectionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	opts, err := s.collectionOptions()
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{"name": s.name, "options": opts})
+}
+
+func (s server) dropCollectionHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("collection")
+	err := s.dropCollection(name)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{"name": name})
+}
+
+func (s server) searchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q, err := parseQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := s.searchDocuments(q)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, result)
+}
+
+func (s server) insertDocumentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var document map[string]any
+	err := json.NewDecoder(r.Body).Decode(&document)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	id, rev, err := s.insertDocument(document)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(rev))
+	w.Header().Set("Location", r.URL.Path+"/"+url.PathEscape(id))
+	jsonResponse(w, http.StatusCreated, map[string]any{"id": id, "rev": rev})
+}
+
+// bulkHandler stores the documents in the request body, which is
+// newline-delimited JSON of bulkLines, defaultBulkBatchSize at a
+// time. The response has a result for each line: its id and rev, or
+// an error.
+func (s server) bulkHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var results []map[string]any
+	var writes []bulkWrite
+	var lines []int // Index in results of each write
+	flush := func() error {
+		written, err := s.bulkWrite(writes)
+		if err != nil {
+			return err
+		}
+		for i, result := range written {
+			var validationErr *ValidationError
+			if errors.As(result.Err, &validationErr) {
+				results[lines[i]]["errors"] = validationErr.Errors
+			}
+			if result.Err != nil {
+				results[lines[i]]["error"] = result.Err.Error()
+			} else {
+				results[lines[i]]["rev"] = result.Rev
+			}
+		}
+		writes, lines = writes[:0], lines[:0]
+		return nil
+	}
+
+	reader := bufio.NewReader(r.Body)
+	for {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			jsonError(w, http.StatusBadRequest, readErr)
+			return
+		}
+
+		if len(bytes.TrimSpace(data)) > 0 {
+			write, err := s.parseBulkLine(data)
+			result := map[string]any{"id": write.id}
+			if err != nil {
+				result["error"] = err.Error()
+			} else {
+				writes = append(writes, write)
+				lines = append(lines, len(results))
+			}
+			results = append(results, result)
+		}
+
+		if len(writes) == defaultBulkBatchSize || (readErr == io.EOF && len(writes) > 0) {
+			if err := flush(); err != nil {
+				jsonError(w, errorStatus(err), err)
+				return
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (s server) getDocumentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	document, rev, err := s.getDocument([]byte(id))
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(rev))
+	jsonResponse(w, http.StatusOK, document)
+}
+
+func (s server) putDocumentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	var document map[string]any
+	err := json.NewDecoder(r.Body).Decode(&document)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rev, err := s.expectedRevision(r, id)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+
+	rev, err = s.putDocument(id, document, rev)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(rev))
+	jsonResponse(w, http.StatusOK, map[string]any{"id": id, "rev": rev})
+}
+
+// patchDocumentHandler applies the patch in the request body to a
+// document, as a JSON Patch or JSON Merge Patch as its Content-Type
+// says. A failed test operation returns 409.
+func (s server) patchDocumentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	var patch func(map[string]any) (map[string]any, error)
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json-patch+json":
+		var ops []PatchOperation
+		err = json.NewDecoder(r.Body).Decode(&ops)
+		patch = func(document map[string]any) (map[string]any, error) {
+			return applyPatch(document, ops)
+		}
+	case "application/merge-patch+json":
+		var merge map[string]any
+		err = json.NewDecoder(r.Body).Decode(&merge)
+		patch = func(document map[string]any) (map[string]any, error) {
+			return mergePatch(document, merge).(map[string]any), nil
+		}
+	default:
+		w.Header().Set("Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+		jsonError(w, http.StatusUnsupportedMediaType, errors.New(fmt.Sprintf("Unsupported patch type %q", mediaType)))
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rev, err := s.expectedRevision(r, id)
+	if err == nil {
+		rev, err = s.patchDocument(id, patch, rev)
+	}
+	var patchErr *PatchError
+	if errors.Is(err, errPatchTestFailed) {
+		jsonError(w, http.StatusConflict, err)
+		return
+	} else if errors.As(err, &patchErr) {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(rev))
+	jsonResponse(w, http.StatusOK, map[string]any{"id": id, "rev": rev})
+}
+
+func (s server) deleteDocumentHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	rev, err := s.expectedRevision(r, id)
+	if err == nil {
+		err = s.deleteDocument(id, rev)
+	}
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]any{"id": id})
+}
+
+// Defaults of the _changes parameters
+const (
+	defaultLongpollTimeout     = time.Minute
+	defaultContinuousHeartbeat = 30 * time.Second
+)
+
+// changesHandler returns the changes after the since parameter, up to
+// limit of them, and the number pending after those. With
+// include_docs=true, each has the current revision and body of its
+// document, or a null doc once it's deleted. With feed=longpoll, it
+// waits up to timeout milliseconds for a change if there are none
+// yet. With feed=continuous, it streams changes as newline-delimited
+// JSON until the client disconnects, writing a blank line every
+// heartbeat milliseconds while there are none.
+func (s server) changesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	params := r.URL.Query()
+	since, err := queryUint(params, "since", 0)
+	var limit, timeout, heartbeat uint64
+	if err == nil {
+		limit, err = queryUint(params, "limit", 0)
+	}
+	if err == nil {
+		timeout, err = queryUint(params, "timeout", uint64(defaultLongpollTimeout/time.Millisecond))
+	}
+	if err == nil {
+		heartbeat, err = queryUint(params, "heartbeat", uint64(defaultContinuousHeartbeat/time.Millisecond))
+	}
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch params.Get("feed") {
+	case "", "normal":
+	case "longpoll":
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+		err := s.waitForChanges(ctx, since)
+		if err != nil && err != context.DeadlineExceeded {
+			jsonError(w, errorStatus(err), err)
+			return
+		}
+	case "continuous":
+		s.continuousChanges(w, r, since, time.Duration(heartbeat)*time.Millisecond)
+		return
+	default:
+		jsonError(w, http.StatusBadRequest, errors.New(fmt.Sprintf("Unknown feed %q", params.Get("feed"))))
+		return
+	}
+
+	changes, err := s.changesSince(since, int(limit))
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	last := since
+	if len(changes) > 0 {
+		last = changes[len(changes)-1].Seq
+	}
+	var pending uint64
+	if head := s.feed.last(); head > last {
+		pending = head - last
+	}
+
+	var results any = changes
+	if params.Get("include_docs") == "true" {
+		withDocs := make([]replicatedChange, len(changes))
+		for i, c := range changes {
+			withDocs[i].Change = c
+			body, rev, err := s.getDocument([]byte(c.ID))
+			if err == nil {
+				withDocs[i].Doc = &replicatedDoc{Rev: rev, Body: body}
+			} else if err != ErrNotFound {
+				jsonError(w, errorStatus(err), err)
+				return
+			}
+		}
+		results = withDocs
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{"results": results, "last_seq": last, "pending": pending})
+}
+
+// continuousChanges streams the changes after since to w, as described
+// by changesHandler.
+func (s server) continuousChanges(w http.ResponseWriter, r *http.Request, since uint64, heartbeat time.Duration) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for {
+		changes, err := s.changesSince(since, subscriptionBatchSize)
+		if err != nil {
+			log.Printf("Could not read changes: %v", err)
+			return
+		}
+		for _, c := range changes {
+			if err := enc.Encode(c); err != nil {
+				return
+			}
+			since = c.Seq
+		}
+
+		if len(changes) == 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), heartbeat)
+			err = s.waitForChanges(ctx, since)
+			cancel()
+			if r.Context().Err() != nil || err == ErrNoCollection {
+				return
+			}
+			if err == context.DeadlineExceeded {
+				if _, err := w.Write([]byte("\n")); err != nil {
+					return
+				}
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// queryUint returns the unsigned integer parameter name of params, or
+// def if it's not set.
+func queryUint(params url.Values, name string, def uint64) (uint64, error) {
+	value := params.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Bad %s parameter %q", name, value))
+	}
+	return n, nil
+}
+
+func (s server) listWebhooksHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := s.listWebhooks()
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{"webhooks": list})
+}
+
+func (s server) putWebhookHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var hook Webhook
+	err := json.NewDecoder(r.Body).Decode(&hook)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	hook.Name = ps.ByName("webhook")
+	err = s.putWebhook(hook)
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, hook)
+}
+
+func (s server) deleteWebhookHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := s.deleteWebhook(ps.ByName("webhook"))
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{"name": ps.ByName("webhook")})
+}
+
+func (s server) getSchemaHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	schema, err := s.getSchema()
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, schema)
+}
+
+func (s server) putSchemaHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var schema any
+	err := json.NewDecoder(r.Body).Decode(&schema)
+	if err == nil {
+		_, err = compileSchema(schema)
+	}
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.setSchema(schema)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, schema)
+}
+
+func (s server) deleteSchemaHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	_, err := s.getSchema()
+	if err == nil {
+		err = s.setSchema(nil)
+	}
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]any{"name": s.name})
+}
+
+func (s server) replicationHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.cols.mu.RLock()
+	f := s.cols.follower
+	s.cols.mu.RUnlock()
+	if f == nil {
+		jsonError(w, http.StatusNotFound, errNotFollower)
+		return
+	}
+	jsonResponse(w, http.StatusOK, f.replicationStatus().toMap())
+}
+
+func (s server) backupHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req struct {
+		Dir string `json:"dir"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && req.Dir == "" {
+		err = errors.New("Missing backup dir")
+	}
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	dir, err := s.backupPath(req.Dir)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	info, err := s.backup(dir)
+	if errors.Is(err, os.ErrExist) {
+		jsonError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, info)
+}
+
+func (s server) reindexProgressHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	jsonResponse(w, http.StatusOK, s.reindexProgress().toMap())
+}
+
+func (s server) startReindexHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := s.startReindex(defaultReindexOptions)
+	if err != nil {
+		jsonError(w, errorStatus(err), err)
+		return
+	}
+	jsonResponse(w, http.StatusAccepted, s.reindexProgress().toMap())
+}
+
+// expectedRevision returns the revision that the request r requires
+// the stored document with id to have, from its conditional headers.
+func (s server) expectedRevision(r *http.Request, id string) (uint64, error) {
+	if r.Header.Get("If-None-Match") == "*" {
+		return 0, nil
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return anyRevision, nil
+	}
+	if ifMatch == "*" {
+		// Any revision, as long as there is one. Using the
+		// current revision means a write that races us to
+		// delete the document causes a conflict.
+		rev, err := s.getRevision([]byte(id))
+		if err == nil && rev == 0 {
+			return 0, ErrConflict
+		}
+		return rev, err
+	}
+	return parseETag(ifMatch)
+}
+
+// formatETag returns the ETag for revision rev.
+func formatETag(rev uint64) string {
+	return `"` + strconv.FormatUint(rev, 10) + `"`
+}
+
+// parseETag returns the revision in etag.
+func parseETag(etag string) (uint64, error) {
+	etag = strings.TrimPrefix(etag, "W/")
+	rev, err := strconv.ParseUint(strings.Trim(etag, `"`), 10, 64)
+	if err != nil {
+		return 0, errBadETag
+	}
+	return rev, nil
+}
+
+// errorStatus returns the HTTP status code for err.
+func errorStatus(err error) int {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return http.StatusBadRequest
+	}
+	switch err {
+	case ErrNotFound, ErrNoCollection, ErrNoWebhook, errNoSchema:
+		return http.StatusNotFound
+	case ErrConflict:
+		return http.StatusPreconditionFailed
+	case errBadETag, errBadID, errBadCollectionName, errDropDefault,
+		errBadWebhookName, errBadWebhookURL, errBadExpires, errBadBackupDir:
+		return http.StatusBadRequest
+	case ErrReadOnly, errBackupsDisabled:
+		return http.StatusForbidden
+	case errReindexRunning, ErrCollectionExists, errFollowing:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// jsonResponse writes body as an ok response with status code.
+func jsonResponse(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"body":   body,
+		"status": "ok",
+	})
+}
+
+// jsonError writes err as an error response with status code. The
+// response of a *ValidationError lists its SchemaErrors in errors.
+func jsonError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	response := map[string]any{
+		"error":  err.Error(),
+		"status": "error",
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		response["errors"] = validationErr.Errors
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,253 @@
+package docdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// doRequest makes a request to the API of s and returns the response
+// and its decoded JSON body.
+func doRequest(t *testing.T, s *server, method, url, body string, headers map[string]string) (*http.Response, map[string]any) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.router().ServeHTTP(w, req)
+
+	resp := w.Result()
+	var decoded map[string]any
+	err := json.NewDecoder(resp.Body).Decode(&decoded)
+	if err != nil {
+		t.Fatalf("Bad JSON response: %v", err)
+	}
+	return resp, decoded
+}
+
+func Test_httpRevisions(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	resp, body := doRequest(t, s, "PUT", "/docs/mike", `{"age": 40}`,
+		map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	assert.Equal(t, "ok", body["status"])
+
+	resp, _ = doRequest(t, s, "PUT", "/docs/mike", `{"age": 40}`,
+		map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, body = doRequest(t, s, "GET", "/docs/mike", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	assert.Equal(t, map[string]any{"age": 40.0}, body["body"])
+
+	resp, _ = doRequest(t, s, "PUT", "/docs/mike", `{"age": 41}`,
+		map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+	resp, body = doRequest(t, s, "PUT", "/docs/mike", `{"age": 42}`,
+		map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	assert.Equal(t, "error", body["status"])
+
+	resp, _ = doRequest(t, s, "PUT", "/docs/mike", `{"age": 42}`,
+		map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/docs/phil", `{"age": 42}`,
+		map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/docs/mike", `{"age": 42}`,
+		map[string]string{"If-Match": "nonsense"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/docs/mike", `{"age": `, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, body = doRequest(t, s, "GET", "/docs?q=age:>40", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1.0, body["body"].(map[string]any)["count"])
+
+	resp, _ = doRequest(t, s, "DELETE", "/docs/mike", "",
+		map[string]string{"If-Match": `"2"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = doRequest(t, s, "DELETE", "/docs/mike", "",
+		map[string]string{"If-Match": `"3"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/docs/mike", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_httpCollections(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	resp, _ := doRequest(t, s, "PUT", "/collections/orders", `{"full_text": ["note"]}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/collections/orders", "", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/collections/customers", `{"collation": "klingon"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, body := doRequest(t, s, "GET", "/collections", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []any{"default", "orders"}, body["body"].(map[string]any)["collections"])
+
+	resp, _ = doRequest(t, s, "PUT", "/collections/orders/docs/1", `{"note": "Fragile"}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/docs/1", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, body = doRequest(t, s, "GET", "/collections/orders/docs?q=note:~fragile", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1.0, body["body"].(map[string]any)["count"])
+	resp, _ = doRequest(t, s, "GET", "/collections/customers/docs/1", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, s, "DELETE", "/collections/default", "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "DELETE", "/collections/orders", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/collections/orders/docs/1", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_httpInsert(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	resp, body := doRequest(t, s, "POST", "/docs", `{"name": "Kevin"}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	id := body["body"].(map[string]any)["id"].(string)
+	assert.Equal(t, "/docs/"+id, resp.Header.Get("Location"))
+	resp, body = doRequest(t, s, "GET", "/docs/"+id, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Kevin", body["body"].(map[string]any)["name"])
+
+	doRequest(t, s, "PUT", "/collections/orders", `{"ids": "counter"}`, nil)
+	resp, body = doRequest(t, s, "POST", "/collections/orders/docs", `{"total": 10}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "00000000000000000001", body["body"].(map[string]any)["id"])
+	resp, _ = doRequest(t, s, "POST", "/docs", `[]`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func Test_httpBulk(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("phil", map[string]any{"name": "Phil"})
+
+	lines := []string{
+		`{"id": "mike", "body": {"name": "Mike"}}`,
+		`{"body": {"name": "Kevin"}}`,
+		``,
+		`{"id": "phil", "rev": 0, "body": {"name": "Phil"}}`,
+		`{"id": "tim"`,
+		`{"id": "tim"}`,
+		`{"id": "phil", "rev": 1, "body": {"name": "Phil", "age": 41}}`,
+	}
+	resp, body := doRequest(t, s, "POST", "/docs/_bulk", strings.Join(lines, "\n"), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	results := body["body"].(map[string]any)["results"].([]any)
+	if !assert.Len(t, results, 6) {
+		return
+	}
+	assert.Equal(t, map[string]any{"id": "mike", "rev": 1.0}, results[0])
+	assert.Equal(t, 1.0, results[1].(map[string]any)["rev"])
+	assert.Equal(t, ErrConflict.Error(), results[2].(map[string]any)["error"])
+	assert.Contains(t, results[3], "error")
+	assert.Equal(t, errMissingBody.Error(), results[4].(map[string]any)["error"])
+	assert.Equal(t, map[string]any{"id": "phil", "rev": 2.0}, results[5])
+
+	resp, body = doRequest(t, s, "GET", "/docs?q=name:Kevin", "", nil)
+	assert.Equal(t, 1.0, body["body"].(map[string]any)["count"])
+
+	doRequest(t, s, "PUT", "/collections/orders", "", nil)
+	resp, _ = doRequest(t, s, "POST", "/collections/orders/docs/_bulk", `{"id": "1", "body": {}}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/collections/orders/docs/1", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func Test_httpChanges(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike", map[string]any{})
+	s.addDocument("phil", map[string]any{})
+	s.deleteDocument("mike", anyRevision)
+
+	resp, body := doRequest(t, s, "GET", "/_changes?since=1", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]any{
+		"results": []any{
+			map[string]any{"seq": 2.0, "id": "phil", "rev": 1.0},
+			map[string]any{"seq": 3.0, "id": "mike", "rev": 1.0, "deleted": true},
+		},
+		"last_seq": 3.0,
+		"pending":  0.0,
+	}, body["body"])
+	_, body = doRequest(t, s, "GET", "/_changes?since=3&feed=longpoll&timeout=10", "", nil)
+	assert.Equal(t, map[string]any{"results": []any{}, "last_seq": 3.0, "pending": 0.0}, body["body"])
+	_, body = doRequest(t, s, "GET", "/_changes?limit=2&include_docs=true", "", nil)
+	assert.Equal(t, map[string]any{
+		"results": []any{
+			map[string]any{"seq": 1.0, "id": "mike", "rev": 1.0, "doc": nil},
+			map[string]any{"seq": 2.0, "id": "phil", "rev": 1.0, "doc": map[string]any{"rev": 1.0, "body": map[string]any{}}},
+		},
+		"last_seq": 2.0,
+		"pending":  1.0,
+	}, body["body"])
+	resp, _ = doRequest(t, s, "GET", "/_changes?since=x", "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/_changes?feed=eventsource", "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/collections/none/_changes", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// A long poll returns when there's a change
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.addDocument("tim", map[string]any{})
+	}()
+	_, body = doRequest(t, s, "GET", "/_changes?since=3&feed=longpoll", "", nil)
+	assert.Equal(t, 4.0, body["body"].(map[string]any)["last_seq"])
+
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+	resp, err = http.Get(server.URL + "/_changes?since=2&feed=continuous&heartbeat=10")
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, _ := lines.ReadString('\n')
+		return line
+	}
+	assert.Equal(t, "{\"seq\":3,\"id\":\"mike\",\"rev\":1,\"deleted\":true}\n", readLine())
+	assert.Equal(t, "{\"seq\":4,\"id\":\"tim\",\"rev\":1}\n", readLine())
+	assert.Equal(t, "\n", readLine())
+	s.addDocument("kim", map[string]any{})
+	line := readLine()
+	for line == "\n" {
+		line = readLine()
+	}
+	assert.Equal(t, "{\"seq\":5,\"id\":\"kim\",\"rev\":1}\n", line)
+}
@@ -0,0 +1,129 @@
+package docdb
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+)
+
+// This file contains server-generated document IDs, for documents
+// inserted without one. Each collection generates IDs with the
+// strategy in its Options.IDs:
+//
+// - "uuid", the default, random version 4 UUIDs;
+// - "uuidv7", version 7 UUIDs, which start with the time;
+// - "ulid", ULIDs, which also start with the time;
+// - "counter", a sequence of numbers from 1, zero padded to 20
+//   digits.
+//
+// Time-ordered and counter IDs sort in the order documents were
+// inserted, so new documents' keys are close together in primary
+// data and the index rather than spread across them.
+//
+// The last number a counter generated is kept in primary data under
+// sequenceKey, and written before the ID is used, so numbers aren't
+// reused after a restart. Inserts skip numbers whose IDs were taken by
+// documents put with them.
+
+// idStrategies lists the ID strategies.
+var idStrategies = []string{"uuid", "uuidv7", "ulid", "counter"}
+
+// idGenerator generates IDs for a collection.
+type idGenerator struct {
+	strategy string
+
+	mu      sync.Mutex
+	entropy io.Reader // Monotonic ULID entropy, guarded by mu
+}
+
+// newIDGenerator returns the generator for strategy, "" for the
+// default.
+func newIDGenerator(strategy string) (*idGenerator, error) {
+	if strategy == "" {
+		strategy = "uuid"
+	}
+	for _, known := range idStrategies {
+		if strategy == known {
+			g := &idGenerator{strategy: strategy}
+			if strategy == "ulid" {
+				g.entropy = ulid.Monotonic(rand.Reader, 0)
+			}
+			return g, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown ID strategy %q", strategy))
+}
+
+// sequenceKey returns the primary data key of the last number that
+// the counter of collection name generated.
+func sequenceKey(name string) []byte {
+	return metaKey(sequenceMeta, name)
+}
+
+// newID returns a new document ID for s.
+func (s server) newID() (string, error) {
+	switch s.ids.strategy {
+	case "uuidv7":
+		id, err := uuid.NewV7()
+		return id.String(), err
+	case "ulid":
+		s.ids.mu.Lock()
+		defer s.ids.mu.Unlock()
+		id, err := ulid.New(ulid.Timestamp(time.Now()), s.ids.entropy)
+		return id.String(), err
+	case "counter":
+		return s.nextCounterID()
+	}
+	return uuid.NewString(), nil
+}
+
+// nextCounterID returns the next number from the counter of s.
+func (s server) nextCounterID() (string, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return "", err
+	}
+
+	var n uint64
+	key := sequenceKey(s.name)
+	v, closer, err := s.cols.root.Get(key)
+	if err == nil {
+		n, _ = binary.Uvarint(v)
+		closer.Close()
+	} else if err != ErrNotFound {
+		return "", err
+	}
+
+	n++
+	err = s.cols.root.Set(key, binary.AppendUvarint(nil, n))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d", n), nil
+}
+
+// insertDocument adds and indexes document with a new ID, and returns
+// the ID and the document's revision.
+func (s server) insertDocument(document map[string]any) (string, uint64, error) {
+	for {
+		id, err := s.newID()
+		if err != nil {
+			return "", 0, err
+		}
+		rev, err := s.putDocument(id, document, 0)
+		if err == ErrConflict && s.ids.strategy == "counter" {
+			// Documents can be put with IDs the counter hasn't
+			// reached, so skip them
+			continue
+		}
+		return id, rev, err
+	}
+}
@@ -0,0 +1,87 @@
+package docdb
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_insertDocument(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	_, err = s.createCollection("bad", &Options{IDs: "guid"})
+	assert.Error(t, err)
+
+	parse := map[string]func(string) error{
+		"uuid": func(id string) error {
+			_, err := uuid.Parse(id)
+			return err
+		},
+		"uuidv7": func(id string) error {
+			_, err := uuid.Parse(id)
+			return err
+		},
+		"ulid": func(id string) error {
+			_, err := ulid.Parse(id)
+			return err
+		},
+		"counter": func(string) error { return nil },
+	}
+	for _, strategy := range idStrategies {
+		c, err := s.createCollection(strategy, &Options{IDs: strategy})
+		if err != nil {
+			t.Fatalf("Failed due to error: %v", err)
+		}
+
+		var ids []string
+		for i := 0; i < 5; i++ {
+			id, rev, err := c.insertDocument(map[string]any{"i": i})
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(1), rev)
+			assert.NoError(t, parse[strategy](id), strategy)
+			ids = append(ids, id)
+		}
+		if strategy != "uuid" {
+			assert.True(t, sort.StringsAreSorted(ids), strategy)
+		}
+		document, _ := c.getDocumentById([]byte(ids[4]))
+		assert.Equal(t, 4.0, document["i"])
+	}
+
+	// Counters carry on after a restart, and start again once their
+	// collection is dropped
+	c, _ := s.collection("counter")
+	id, _, _ := c.insertDocument(map[string]any{})
+	assert.Equal(t, "00000000000000000006", id)
+	assert.NoError(t, s.close())
+	s, err = newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not reopen s")
+	}
+	c, _ = s.collection("counter")
+	id, _, _ = c.insertDocument(map[string]any{})
+	assert.Equal(t, "00000000000000000007", id)
+	assert.Equal(t, []string{"counter", "default", "ulid", "uuid", "uuidv7"}, s.listCollections())
+
+	assert.NoError(t, s.dropCollection("counter"))
+	_, err = c.newID()
+	assert.Equal(t, ErrNoCollection, err)
+	c, _ = s.createCollection("counter", &Options{IDs: "counter"})
+	id, _, _ = c.insertDocument(map[string]any{})
+	assert.Equal(t, "00000000000000000001", id)
+
+	// IDs taken by documents put with them are skipped
+	c.addDocument("00000000000000000002", map[string]any{})
+	c.addDocument("00000000000000000003", map[string]any{})
+	id, rev, err := c.insertDocument(map[string]any{})
+	assert.NoError(t, err)
+	assert.Equal(t, "00000000000000000004", id)
+	assert.Equal(t, uint64(1), rev)
+	assert.NoError(t, s.close())
+}
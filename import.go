@@ -0,0 +1,387 @@
+package docdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file contains imports, which load documents from a file in
+// one of these formats:
+//
+// - "json", an array of documents;
+// - "ndjson", one document per line;
+// - "csv", a header row of field names, then one document per row.
+//   Values that look like numbers, booleans or null are stored as
+//   those, empty values are left out and the rest are strings;
+// - "bulk", lines of {"id": .., "rev": .., "body": ..}, as taken by
+//   the bulk API and written by export.
+//
+// Documents are written with bulk writes, so an import is much faster
+// than putting each document. Records that can't be stored, such as a
+// document with a bad ID, are reported and skipped, but a file that
+// can't be parsed stops the import, after the batches before the
+// error have been written.
+
+// ImportOptions control how documents are imported.
+type ImportOptions struct {
+	// Format is the format of the input: "json", "ndjson", "csv" or
+	// "bulk". If it's empty, JSON arrays and NDJSON are detected.
+	Format string
+	// IDField is the dotted path of each document's ID, which must
+	// be a string or number. Documents without one, and all of them
+	// if it's empty, get new IDs. It's ignored by the bulk format.
+	IDField string
+	// BatchSize is the number of documents written together, or
+	// 1000 if it's 0.
+	BatchSize int
+}
+
+// ImportError is a record of the input that wasn't stored. Readers of
+// the input return it, without its Record, for records that can't be
+// stored.
+type ImportError struct {
+	Record int // Position in the input, from 1
+	ID     string
+	Err    error
+}
+
+func (e ImportError) Error() string {
+	return fmt.Sprintf("Record %d (%q): %v", e.Record, e.ID, e.Err)
+}
+
+// ImportStats describes a finished import.
+type ImportStats struct {
+	Imported int
+	Failed   []ImportError
+}
+
+// importReader reads the records of an input.
+type importReader interface {
+	// next returns the next record, or io.EOF. A record that can't
+	// be stored returns an ImportError, and other errors stop the
+	// import.
+	next() (bulkWrite, error)
+}
+
+// Import stores the documents read from r in the collection. It
+// returns an error if the input can't be read or parsed, when stats
+// cover the records before it.
+func (c *Collection) Import(ctx context.Context, r io.Reader, opts *ImportOptions) (*ImportStats, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	in, err := c.s.newImportReader(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBulkBatchSize
+	}
+
+	stats := &ImportStats{}
+	// Records that fail when written are added after ones that fail
+	// when read, so put them back in order
+	defer func() {
+		sort.Slice(stats.Failed, func(i, j int) bool {
+			return stats.Failed[i].Record < stats.Failed[j].Record
+		})
+	}()
+	var writes []bulkWrite
+	var records []int // Position of each write in the input
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		results, err := c.s.bulkWrite(writes)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			if result.Err != nil {
+				stats.Failed = append(stats.Failed, ImportError{records[i], result.ID, result.Err})
+			} else {
+				stats.Imported++
+			}
+		}
+		writes, records = writes[:0], records[:0]
+		return nil
+	}
+
+	for record := 1; ; record++ {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		write, err := in.next()
+		if err == io.EOF {
+			break
+		}
+		var recordErr ImportError
+		if errors.As(err, &recordErr) {
+			recordErr.Record = record
+			stats.Failed = append(stats.Failed, recordErr)
+			continue
+		}
+		if err != nil {
+			if flushErr := flush(); flushErr != nil {
+				return stats, flushErr
+			}
+			return stats, err
+		}
+
+		writes = append(writes, write)
+		records = append(records, record)
+		if len(writes) == batchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, flush()
+}
+
+// Import stores documents in the default collection. See
+// Collection.Import.
+func (db *DB) Import(ctx context.Context, r io.Reader, opts *ImportOptions) (*ImportStats, error) {
+	return db.def.Import(ctx, r, opts)
+}
+
+// parseError returns the error for input that can't be parsed at
+// line, or 0 if the line isn't known.
+func parseError(line int, err error) error {
+	if line == 0 {
+		return errors.New(fmt.Sprintf("Could not parse input: %v", err))
+	}
+	return errors.New(fmt.Sprintf("Could not parse line %d: %v", line, err))
+}
+
+// newImportReader returns the reader of r in the format opts says.
+func (s server) newImportReader(r io.Reader, opts *ImportOptions) (importReader, error) {
+	br := bufio.NewReader(r)
+	format := opts.Format
+	if format == "" {
+		format = detectImportFormat(br)
+	}
+
+	ids := documentIDs{s, strings.Split(opts.IDField, ".")}
+	if opts.IDField == "" {
+		ids.path = nil
+	}
+	switch format {
+	case "json":
+		dec := json.NewDecoder(br)
+		if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+			return nil, parseError(0, errors.New("Expected a JSON array"))
+		}
+		return &jsonImportReader{dec, ids}, nil
+	case "ndjson":
+		return &ndjsonImportReader{lineReader{r: br}, ids}, nil
+	case "bulk":
+		return &bulkImportReader{lineReader{r: br}, s}, nil
+	case "csv":
+		cr := csv.NewReader(br)
+		cr.ReuseRecord = true
+		header, err := cr.Read()
+		if err != nil {
+			return nil, parseError(1, err)
+		}
+		return &csvImportReader{cr, append([]string(nil), header...), ids}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown import format %q", format))
+}
+
+// detectImportFormat returns "json" if the input in r starts with an
+// array and "ndjson" otherwise.
+func detectImportFormat(r *bufio.Reader) string {
+	for i := 1; ; i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			return "ndjson"
+		}
+		switch b[i-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '[':
+			return "json"
+		}
+		return "ndjson"
+	}
+}
+
+// documentIDs gives the documents of an import their IDs.
+type documentIDs struct {
+	s    server
+	path []string // Path of the ID field, or nil
+}
+
+// write returns the write of document, with the ID at the ID field,
+// or a new ID, or an ImportError for a bad ID field.
+func (d documentIDs) write(document map[string]any) (bulkWrite, error) {
+	if d.path != nil {
+		value, ok := getValueAtPath(document, d.path)
+		switch id := value.(type) {
+		case string:
+			return bulkWrite{id: id, document: document, rev: anyRevision}, nil
+		case float64:
+			s := strconv.FormatFloat(id, 'f', -1, 64)
+			return bulkWrite{id: s, document: document, rev: anyRevision}, nil
+		}
+		if ok {
+			err := errors.New(fmt.Sprintf("ID field %s must be a string or number", strings.Join(d.path, ".")))
+			return bulkWrite{}, ImportError{Err: err}
+		}
+	}
+
+	id, err := d.s.newID()
+	return bulkWrite{id: id, document: document, rev: 0}, err
+}
+
+// jsonImportReader reads the documents of a JSON array.
+type jsonImportReader struct {
+	dec *json.Decoder
+	ids documentIDs
+}
+
+func (j *jsonImportReader) next() (bulkWrite, error) {
+	if !j.dec.More() {
+		if t, err := j.dec.Token(); err != nil || t != json.Delim(']') {
+			return bulkWrite{}, parseError(0, errors.New("Expected the end of the JSON array"))
+		}
+		return bulkWrite{}, io.EOF
+	}
+	var document map[string]any
+	if err := j.dec.Decode(&document); err != nil {
+		return bulkWrite{}, parseError(0, err)
+	}
+	if document == nil {
+		return bulkWrite{}, ImportError{Err: errMissingBody}
+	}
+	return j.ids.write(document)
+}
+
+// lineReader reads the non-blank lines of an input.
+type lineReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// next returns the next non-blank line, or io.EOF.
+func (l *lineReader) next() ([]byte, error) {
+	for {
+		data, err := l.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		l.line++
+		if len(bytes.TrimSpace(data)) > 0 {
+			return data, nil
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+}
+
+// ndjsonImportReader reads documents, one per line.
+type ndjsonImportReader struct {
+	lines lineReader
+	ids   documentIDs
+}
+
+func (n *ndjsonImportReader) next() (bulkWrite, error) {
+	data, err := n.lines.next()
+	if err != nil {
+		return bulkWrite{}, err
+	}
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return bulkWrite{}, parseError(n.lines.line, err)
+	}
+	if document == nil {
+		return bulkWrite{}, ImportError{Err: errMissingBody}
+	}
+	return n.ids.write(document)
+}
+
+// bulkImportReader reads bulkLines.
+type bulkImportReader struct {
+	lines lineReader
+	s     server
+}
+
+func (b *bulkImportReader) next() (bulkWrite, error) {
+	data, err := b.lines.next()
+	if err != nil {
+		return bulkWrite{}, err
+	}
+	write, err := b.s.parseBulkLine(data)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return bulkWrite{}, parseError(b.lines.line, err)
+	}
+	if err != nil {
+		return bulkWrite{}, ImportError{ID: write.id, Err: err}
+	}
+	return write, nil
+}
+
+// csvImportReader reads documents, one per row, with the fields named
+// by the header row.
+type csvImportReader struct {
+	r      *csv.Reader
+	header []string
+	ids    documentIDs
+}
+
+func (c *csvImportReader) next() (bulkWrite, error) {
+	row, err := c.r.Read()
+	if err == io.EOF {
+		return bulkWrite{}, err
+	}
+	if err != nil {
+		return bulkWrite{}, parseError(0, err)
+	}
+
+	document := map[string]any{}
+	for i, field := range c.header {
+		if row[i] != "" {
+			document[field] = inferCSVValue(row[i])
+		}
+	}
+	return c.ids.write(document)
+}
+
+// inferCSVValue returns the JSON value that s looks like: a number, a
+// boolean or null, or otherwise s itself.
+func inferCSVValue(s string) any {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+
+	// Leave values like zip codes with leading zeros as strings,
+	// as they would change when written back out
+	digits := strings.TrimPrefix(s, "-")
+	if len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+		return s
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) || strings.ContainsAny(s, "xXpP_") {
+		return s
+	}
+	return f
+}
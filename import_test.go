@@ -0,0 +1,101 @@
+package docdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Import(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(&Options{IDs: "counter"})
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		opts     *ImportOptions
+		imported int
+		failed   []int
+		err      string
+	}{
+		{"json", `[{"sku": "a1", "n": 1}, {"sku": 2}, {"n": 3}, null, {"sku": true}]`,
+			&ImportOptions{IDField: "sku", BatchSize: 2}, 3, []int{4, 5}, ""},
+		{"ndjson", "{\"user\": {\"id\": \"u1\"}}\n\n{\"user\": {\"id\": \"u2\"}}\n",
+			&ImportOptions{IDField: "user.id"}, 2, nil, ""},
+		{"bad ndjson", "{\"user\": {\"id\": \"u3\"}}\n{\"user\"\n{}\n",
+			&ImportOptions{IDField: "user.id"}, 1, nil, "Could not parse line 2"},
+		{"bulk", "{\"id\": \"b1\", \"body\": {}}\n{\"id\": \"b1\", \"rev\": 0, \"body\": {}}\n{\"id\": \"b2\"}\n",
+			&ImportOptions{Format: "bulk"}, 1, []int{2, 3}, ""},
+		{"csv", "code,zip,price,active,note\nc1,01234,9.5,true,\nc2,1e3,-2,false,null\n",
+			&ImportOptions{Format: "csv", IDField: "code"}, 2, nil, ""},
+		{"short csv", "code,price\nc3,1\nc4\n",
+			&ImportOptions{Format: "csv", IDField: "code"}, 1, nil, "wrong number of fields"},
+		{"unknown format", "", &ImportOptions{Format: "xml"}, 0, nil, "Unknown import format"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats, err := db.Import(ctx, strings.NewReader(test.input), test.opts)
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.err)
+			}
+			if stats == nil {
+				return
+			}
+			assert.Equal(t, test.imported, stats.Imported)
+			var failed []int
+			for _, f := range stats.Failed {
+				failed = append(failed, f.Record)
+			}
+			assert.Equal(t, test.failed, failed)
+		})
+	}
+
+	doc, _ := db.Get(ctx, "2")
+	assert.Equal(t, map[string]any{"sku": 2.0}, doc.Body)
+	doc, _ = db.Get(ctx, "00000000000000000001")
+	assert.Equal(t, map[string]any{"n": 3.0}, doc.Body)
+	doc, _ = db.Get(ctx, "u2")
+	assert.NotNil(t, doc)
+	doc, _ = db.Get(ctx, "u3")
+	assert.NotNil(t, doc)
+	doc, _ = db.Get(ctx, "c1")
+	assert.Equal(t, map[string]any{"code": "c1", "zip": "01234", "price": 9.5, "active": true}, doc.Body)
+	doc, _ = db.Get(ctx, "c2")
+	assert.Equal(t, map[string]any{"code": "c2", "zip": 1000.0, "price": -2.0, "active": false, "note": nil}, doc.Body)
+	doc, _ = db.Get(ctx, "c3")
+	assert.NotNil(t, doc)
+
+	docs, _ := db.Find(ctx, "price:<0")
+	assert.Len(t, docs, 1)
+}
+
+func Test_inferCSVValue(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected any
+	}{
+		{"0", 0.0},
+		{"-0.5", -0.5},
+		{"0.5", 0.5},
+		{"12", 12.0},
+		{"007", "007"},
+		{"-01", "-01"},
+		{"NaN", "NaN"},
+		{"Inf", "Inf"},
+		{"0x10", "0x10"},
+		{"1_000", "1_000"},
+		{"True", "True"},
+		{"null", nil},
+		{" 1", " 1"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, inferCSVValue(test.s), test.s)
+	}
+}
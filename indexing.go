@@ -1,9 +1,11 @@
-package main
+package docdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"log"
-
-	"github.com/cockroachdb/pebble"
+	"strings"
 )
 
 // This file contains the two key functions for maintaining the index:
@@ -32,69 +34,292 @@ import (
 //
 // When updating, we use the forward index to first remove the
 // existing forward index keys, then proceed to index the new
-// document content from scratch. We could decrease the write
-// amplication that this creates by instead calculating a
-// delta to apply to the inverted index, but for now we don't.
+// document content from scratch, all in one batch. Patches, which
+// know which paths they changed, replace only the entries for those
+// paths instead (see reindexPathsBatch), which cuts the write
+// amplification of small changes to large documents.
 //
 // The inverted and forward indexes are stored in the same
 // Pebble database, we use a key prefix to namespace the two
 // indexes.
+//
+// Some paths can also be indexed into other structures, such as
+// the full-text index (see fulltext.go). Each of these has its own
+// namespace. The value of a forward index entry lists the namespaces
+// that the path value was written into, so that unindex knows what
+// to clean up. Indexes from before this had empty values, which
+// migrateForwardNamespaces rewrites (see migrate.go).
 
 var invIdxNamespace byte = 'i'
 var fwdIdxNamespace byte = 'f'
+var ftsIdxNamespace byte = 't'
+var ftsLenNamespace byte = 'l'
+var geoIdxNamespace byte = 'g'
+
+// expIdxNamespace, of expiry times, is in expiry.go.
+
+// indexConfig holds the options that control which index structures,
+// beyond the inverted index of every path value, are maintained
+// for documents. A nil *indexConfig is valid and uses the defaults.
+type indexConfig struct {
+	// fullText lists dotted paths whose string values are also
+	// analysed into the full-text index.
+	fullText []string
+	// geo lists dotted paths holding {"lat": .., "lon": ..} points
+	// that are also indexed into the geo index.
+	geo []string
+	// timestamps lists dotted paths whose RFC 3339 string values
+	// are indexed as instants, rather than strings, so that they
+	// compare correctly across offsets and fractional seconds.
+	timestamps []string
+	// detectTimestamps indexes RFC 3339 string values at every
+	// path as instants.
+	detectTimestamps bool
+	// collation sets how string values are ordered and compared in
+	// the inverted index. It's part of the index format, so must not
+	// be changed without reindexing.
+	collation collation
+}
+
+// isTimestamp returns true if string values at path should be
+// indexed as instants when they're RFC 3339 timestamps.
+func (c *indexConfig) isTimestamp(path []byte) bool {
+	if c == nil {
+		return false
+	}
+	if c.detectTimestamps {
+		return true
+	}
+	for _, p := range c.timestamps {
+		if p == string(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoPaths returns the paths configured for geo indexing.
+func (c *indexConfig) geoPaths() []string {
+	if c == nil {
+		return nil
+	}
+	return c.geo
+}
+
+// stringCollation returns the collation for string values.
+func (c *indexConfig) stringCollation() collation {
+	if c == nil {
+		return collationBinary
+	}
+	return c.collation
+}
+
+// isFullText returns true if path is configured for full-text indexing.
+func (c *indexConfig) isFullText(path []byte) bool {
+	if c == nil {
+		return false
+	}
+	for _, p := range c.fullText {
+		if p == string(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// index adds document to indexDB, associated with id. It reads the
+// document's forward index entries and then writes a batch based on
+// them, so it mustn't run at the same time as another index or
+// unindex of id: servers call it holding writeMu.
+func index(indexDB KV, cfg *indexConfig, id string, document map[string]any) {
+	b := indexDB.NewBatch()
+	err := indexBatch(b, cfg, id, document)
+	if err == nil {
+		err = indexDB.Apply(b)
+	}
+	if err != nil {
+		log.Printf("Could not index %q: %v", id, err)
+	}
+}
 
-// index adds document to the index, associated with id.
-func index(indexDB *pebble.DB, id string, document map[string]any) {
+// indexBatch adds the changes that index document with id, replacing
+// any existing entries for id, to the indexed batch b. This allows
+// callers to combine several changes to the index into one batch.
+func indexBatch(b KVBatch, cfg *indexConfig, id string, document map[string]any) error {
 	docID := []byte(id)
 	// First, unindex the document
-	err := unindex(indexDB, docID)
+	err := unindexBatch(b, docID)
 	if err != nil {
-		log.Printf("Could not unindex %q: %v", id, err)
-		return
+		return errors.New(fmt.Sprintf("Could not unindex %q: %v", id, err))
 	}
 
-	b := indexDB.NewBatch()
-
 	// Now, index the new values for the document
+	return indexEntries(b, cfg, id, document, nil)
+}
+
+// reindexPathsBatch adds the changes that index document with id to
+// the indexed batch b, like indexBatch, but only replaces the entries
+// for paths, the dotted paths that changed since it was indexed, and
+// whatever is under or above them. The rest are left as they are.
+func reindexPathsBatch(b KVBatch, cfg *indexConfig, id string, document map[string]any, paths []string) error {
+	affected := func(path []byte) bool {
+		for _, p := range paths {
+			q := string(path)
+			if q == p || strings.HasPrefix(q, p+".") || strings.HasPrefix(p, q+".") {
+				return true
+			}
+		}
+		return false
+	}
+	if err := unindexEntries(b, []byte(id), affected); err != nil {
+		return errors.New(fmt.Sprintf("Could not unindex %q: %v", id, err))
+	}
+	return indexEntries(b, cfg, id, document, affected)
+}
+
+// indexEntries adds the index entries of document with id to the
+// indexed batch b, only for the paths that affected returns true
+// for, or all of them if it's nil.
+func indexEntries(b KVBatch, cfg *indexConfig, id string, document map[string]any, affected func(path []byte) bool) error {
+	docID := []byte(id)
 	pv := getPathValues(document, "")
 
 	for _, pathValue := range pv {
-		invIdxKey := encodeInvIdxKey(
-			pathValue.path, pathValue.taggedValue, docID)
+		if affected != nil && !affected(pathValue.path) {
+			continue
+		}
+		taggedValue := pathValue.taggedValue
+		if cfg.isTimestamp(pathValue.path) {
+			taggedValue = timestampTaggedValue(taggedValue)
+		}
+		taggedValue = collateTaggedValue(taggedValue, cfg.stringCollation())
+		invIdxKey := encodeInvIdxKey(pathValue.path, taggedValue, docID)
+
+		// When a string is indexed as a timestamp or collation key,
+		// we keep the original in the entry so it can be displayed.
+		var original []byte
+		if !bytes.Equal(taggedValue, pathValue.taggedValue) {
+			original = pathValue.taggedValue[1:]
+		}
 
-		err = b.Set(invIdxKey, nil, pebble.Sync)
+		err := b.Set(invIdxKey, original)
 		if err != nil {
 			log.Printf("Could not update inverted index: %s", err)
 		}
+		namespaces := []byte{invIdxNamespace}
+
+		if cfg.isFullText(pathValue.path) && pathValue.taggedValue[0] == JSONTagString {
+			err = indexText(b, pathValue.path, pathValue.taggedValue[1:], docID)
+			if err != nil {
+				log.Printf("Could not update full-text index: %s", err)
+			}
+			namespaces = append(namespaces, ftsIdxNamespace)
+		}
 
 		// Create the fwd index entries for this field of the document
 		fwdIdxKey := fwdIdxKey{
 			id:          docID,
 			path:        pathValue.path,
-			taggedValue: pathValue.taggedValue,
+			taggedValue: taggedValue,
 		}
-		err = b.Set(encodeFwdIdxKey(fwdIdxKey), []byte{}, pebble.Sync)
+		err = b.Set(encodeFwdIdxKey(fwdIdxKey), namespaces)
 		// log.Printf("fwd key bytes: %v", encodeFwdIdxKey(fwdIdxKey))
 		if err != nil {
 			log.Printf("Could not update forward index: %s", err)
 		}
 	}
 
-	err = indexDB.Apply(b, pebble.Sync)
+	// Points are indexed as a whole, so aren't among the path values.
+	for _, path := range cfg.geoPaths() {
+		if affected != nil && !affected([]byte(path)) {
+			continue
+		}
+		v, ok := getValueAtPath(document, strings.Split(path, "."))
+		if !ok {
+			continue
+		}
+		p, err := geoPointFromValue(v)
+		if err != nil {
+			log.Printf("Could not index point at %s for %q: %v", path, id, err)
+			continue
+		}
+		err = indexGeo(b, []byte(path), p, docID)
+		if err != nil {
+			log.Printf("Could not update geo index: %s", err)
+		}
+
+		fwdIdxKey := fwdIdxKey{
+			id:          docID,
+			path:        []byte(path),
+			taggedValue: encodeGeoPoint(p),
+		}
+		err = b.Set(encodeFwdIdxKey(fwdIdxKey), []byte{geoIdxNamespace})
+		if err != nil {
+			log.Printf("Could not update forward index: %s", err)
+		}
+	}
+
+	// Expiry times are indexed whole too, see expiry.go.
+	if affected == nil || affected([]byte(expiresField)) {
+		indexExpiry(b, id, document)
+	}
+	return nil
+}
+
+// indexExpiry adds the expiry index entry of document with id to the
+// indexed batch b, if it expires.
+func indexExpiry(b KVBatch, id string, document map[string]any) {
+	docID := []byte(id)
+	t, ok, err := documentExpiry(document)
 	if err != nil {
-		log.Printf("Could not index %q: %v", id, err)
+		log.Printf("Could not index expiry for %q: %v", id, err)
+	}
+	if !ok {
 		return
 	}
+
+	at := encodeTime(t)
+	err = b.Set(encodeExpKey(at, docID), nil)
+	if err != nil {
+		log.Printf("Could not update expiry index: %s", err)
+	}
+
+	fwdIdxKey := fwdIdxKey{
+		id:          docID,
+		path:        []byte(expiresField),
+		taggedValue: at,
+	}
+	err = b.Set(encodeFwdIdxKey(fwdIdxKey), []byte{expIdxNamespace})
+	if err != nil {
+		log.Printf("Could not update forward index: %s", err)
+	}
+}
+
+// unindex removes index entries for id from indexDb. As with index,
+// servers call it holding writeMu.
+func unindex(indexDb KV, docID []byte) error {
+	b := indexDb.NewBatch()
+	err := unindexBatch(b, docID)
+	if err != nil {
+		return err
+	}
+	return indexDb.Apply(b)
 }
 
-// unindex removes index entries for id from indexDb
-func unindex(indexDb *pebble.DB, docID []byte) error {
+// unindexBatch adds the changes that remove index entries for id to
+// the indexed batch b.
+func unindexBatch(b KVBatch, docID []byte) error {
+	return unindexEntries(b, docID, nil)
+}
+
+// unindexEntries adds the changes that remove the index entries for
+// id to the indexed batch b, only for the paths that affected returns
+// true for, or all of them if it's nil.
+func unindexEntries(b KVBatch, docID []byte, affected func(path []byte) bool) error {
 	// To unindex, we use the forward index (id -> pathValueKeys) to
 	// find all the keys in the inverted index to remove. After removing
 	// those, we clean up the forward index.
 
-	b := indexDb.NewIndexedBatch()
-
 	// 1. Get the range for id from the forward index. Everything
 	//    is encoded into the keys.
 	startKey := packTuple([]byte{fwdIdxNamespace}, docID)
@@ -104,26 +329,93 @@ func unindex(indexDb *pebble.DB, docID []byte) error {
 	// 2. Read all the keys. Deserialise each key to find the
 	//    pathValueKey that is in the inverted index, and delete
 	//    that from the inverted index.
-	readOptions := &pebble.IterOptions{LowerBound: startKey, UpperBound: endKey}
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
 	iter := b.NewIter(readOptions)
+	var fwdKeys [][]byte
 	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
 		fik := decodeFwdIdxKey(iter.Key())
+		if affected != nil {
+			if !affected(fik.path) {
+				continue
+			}
+			fwdKeys = append(fwdKeys, append([]byte{}, iter.Key()...))
+		}
 		// log.Printf("unindex fwd key bytes: %v", encodeFwdIdxKey(fik))
 		// log.Printf("fik: %+v", fik)
+		namespaces := iter.Value()
 		invIdxKey := encodeInvIdxKey(fik.path, fik.taggedValue, fik.id)
-		err := b.Delete(invIdxKey, pebble.Sync)
-		if err != nil {
-			log.Printf(
-				"Couldn't delete/set invIdxKey %v in index: %v",
-				invIdxKey, err)
+		if bytes.IndexByte(namespaces, ftsIdxNamespace) >= 0 {
+			text, err := invIdxEntryValue(b, invIdxKey)
+			if err == nil {
+				err = unindexText(b, fik.path, text, fik.id)
+			}
+			if err != nil {
+				log.Printf(
+					"Couldn't delete full-text entries for %q in index: %v",
+					fik.path, err)
+			}
+		}
+		if bytes.IndexByte(namespaces, geoIdxNamespace) >= 0 {
+			p, err := decodeGeoPoint(fik.taggedValue)
+			if err == nil {
+				err = unindexGeo(b, fik.path, p, fik.id)
+			}
+			if err != nil {
+				log.Printf(
+					"Couldn't delete geo entry for %q in index: %v",
+					fik.path, err)
+			}
 		}
+		if bytes.IndexByte(namespaces, expIdxNamespace) >= 0 {
+			err := b.Delete(encodeExpKey(fik.taggedValue, fik.id))
+			if err != nil {
+				log.Printf(
+					"Couldn't delete expiry entry for %q in index: %v",
+					fik.id, err)
+			}
+		}
+		if bytes.IndexByte(namespaces, invIdxNamespace) >= 0 {
+			err := b.Delete(invIdxKey)
+			if err != nil {
+				log.Printf(
+					"Couldn't delete/set invIdxKey %v in index: %v",
+					invIdxKey, err)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
 	}
-	iter.Close()
 
-	// 3. Remove all the entries for id in the forward index.
-	b.DeleteRange(startKey, endKey, pebble.Sync)
+	// 3. Remove the entries for id in the forward index.
+	if affected == nil {
+		return b.DeleteRange(startKey, endKey)
+	}
+	for _, key := range fwdKeys {
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return indexDb.Apply(b, pebble.Sync)
+// invIdxEntryValue returns the original value, without its tag, of
+// the inverted index entry at invIdxKey. This is the value stored in
+// the entry if it has one, otherwise the value in the key.
+func invIdxEntryValue(b KVBatch, invIdxKey []byte) ([]byte, error) {
+	v, closer, err := b.Get(invIdxKey)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	if len(v) > 0 {
+		return append([]byte{}, v...), nil
+	}
+	iik, err := decodeInvIndexKey(invIdxKey)
+	if err != nil {
+		return nil, err
+	}
+	return iik.TaggedValue[1:], nil
 }
 
 type pathValue struct {
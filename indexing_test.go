@@ -1,9 +1,10 @@
-package main
+package docdb
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 
-	"github.com/cockroachdb/pebble"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,23 +29,22 @@ func Test_fwdIndexKey(t *testing.T) {
 }
 
 func Test_unindex(t *testing.T) {
-	d := t.TempDir()
-	db, _ := pebble.Open(d, &pebble.Options{})
+	db := NewMemoryKV()
 	doc := map[string]any{
 		"a": map[string]any{
 			"b": 1,
 		},
 	}
-	index(db, "doc1", doc)
-	index(db, "doc2", doc)
-	index(db, "doc3", doc)
+	index(db, nil, "doc1", doc)
+	index(db, nil, "doc2", doc)
+	index(db, nil, "doc3", doc)
 
-	ids, _ := lookupEq(db, "a.b", 1)
+	ids, _ := lookupEq(db, nil, "a.b", 1)
 	assert.ElementsMatch(t, []string{"doc1", "doc2", "doc3"}, ids)
 
 	unindex(db, []byte("doc1"))
 
-	ids, _ = lookupEq(db, "a.b", 1)
+	ids, _ = lookupEq(db, nil, "a.b", 1)
 	assert.ElementsMatch(t, []string{"doc2", "doc3"}, ids)
 }
 
@@ -52,18 +52,17 @@ func Test_unindex(t *testing.T) {
 // are updated in the index (at least from the point of
 // view of searches).
 func Test_reindex(t *testing.T) {
-	d := t.TempDir()
-	db, _ := pebble.Open(d, &pebble.Options{})
+	db := NewMemoryKV()
 	doc := map[string]any{
 		"a": map[string]any{
 			"b": 1,
 		},
 	}
-	index(db, "doc1", doc)
-	index(db, "doc2", doc)
-	index(db, "doc3", doc)
+	index(db, nil, "doc1", doc)
+	index(db, nil, "doc2", doc)
+	index(db, nil, "doc3", doc)
 
-	ids, _ := lookupEq(db, "a.b", 1)
+	ids, _ := lookupEq(db, nil, "a.b", 1)
 	assert.ElementsMatch(t, []string{"doc1", "doc2", "doc3"}, ids)
 
 	doc2 := map[string]any{
@@ -71,10 +70,45 @@ func Test_reindex(t *testing.T) {
 			"c": 2,
 		},
 	}
-	index(db, "doc2", doc2)
+	index(db, nil, "doc2", doc2)
 
-	ids, _ = lookupEq(db, "a.b", 1)
+	ids, _ = lookupEq(db, nil, "a.b", 1)
 	assert.ElementsMatch(t, []string{"doc1", "doc3"}, ids)
-	ids, _ = lookupEq(db, "a.c", 2)
+	ids, _ = lookupEq(db, nil, "a.c", 2)
 	assert.ElementsMatch(t, []string{"doc2"}, ids)
 }
+
+// Writing the same documents from many goroutines must leave the
+// index agreeing with the stored documents. Run with -race.
+func Test_indexRace(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	ids := []string{"doc1", "doc2", "doc3"}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				id := ids[(w+i)%len(ids)]
+				if i%7 == 6 {
+					s.deleteDocument(id, anyRevision)
+					continue
+				}
+				_, err := s.putDocument(id, map[string]any{
+					"writer":                  float64(w),
+					fmt.Sprintf("field%d", w): i,
+				}, anyRevision)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	report, err := s.checkIndex(false)
+	assert.NoError(t, err)
+	assert.True(t, report.ok(), "%+v", report)
+}
@@ -1,7 +1,8 @@
-package main
+package docdb
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 )
@@ -20,8 +21,15 @@ const (
 	JSONTagNumber = 0x2b // char: +
 	JSONTagString = 0x2c // char: ,
 
+	// Not a JSON type, but RFC 3339 strings at timestamp
+	// paths are indexed as instants with this tag.
+	JSONTagTime = 0x2e // char: .
 )
 
+// jsonTagNanoTime tagged instants in index format version 2, as
+// nanoseconds since the Unix epoch. Only migrations read it.
+const jsonTagNanoTime = 0x2d // char: -
+
 type fwdIdxKey struct {
 	id          []byte
 	path        []byte
@@ -123,6 +131,10 @@ func decodeInvIndexKey(k []byte) (InvIndexKey, error) {
 		n := 9 // tag + 8 byte float encoding
 		iik.TaggedValue = k[0:n]
 		k = k[n+len(sep):]
+	case JSONTagTime:
+		n := 13 // tag + 8 byte seconds + 4 byte nanoseconds
+		iik.TaggedValue = k[0:n]
+		k = k[n+len(sep):]
 	case JSONTagString:
 		m = bytes.Index(k, sep)
 		if m < 0 {
@@ -165,3 +177,83 @@ func unpackTuple(packed []byte) [][]byte {
 func unpackTupleN(packed []byte, n int) [][]byte {
 	return bytes.SplitN(packed, sep, n)
 }
+
+type ftsKey struct {
+	path, term, docID []byte
+}
+
+// encodeFtsKey returns a full-text posting key. Supplying nil docID
+// results in a key truncated just after the separator following
+// term, which is the lower bound of the postings for path and term.
+func encodeFtsKey(path, term, docID []byte) []byte {
+	// [ ftsIdxNamespace, path, term, docID ]
+	if docID == nil {
+		docID = []byte{}
+	}
+	return packTuple([]byte{ftsIdxNamespace}, path, term, docID)
+}
+
+// decodeFtsKey deserialises a full-text posting key from b.
+func decodeFtsKey(b []byte) ftsKey {
+	// The doc ID is last so, as with decodeFwdIdxKey, we can
+	// take it as the remainder of the key.
+	parts := unpackTupleN(b, 4)
+	return ftsKey{
+		path:  parts[1],
+		term:  parts[2],
+		docID: parts[3],
+	}
+}
+
+// encodeFtsLenKey returns the key holding the analysed length of the
+// text at path for docID. Supplying nil docID returns the lower bound
+// of the length keys for path.
+func encodeFtsLenKey(path, docID []byte) []byte {
+	// [ ftsLenNamespace, path, docID ]
+	if docID == nil {
+		docID = []byte{}
+	}
+	return packTuple([]byte{ftsLenNamespace}, path, docID)
+}
+
+type geoKey struct {
+	path  []byte
+	cell  uint64
+	docID []byte
+}
+
+// encodeGeoKey returns a geo index key. Supplying nil docID results
+// in a key truncated immediately after cell, for use as a bound when
+// scanning cell ranges.
+func encodeGeoKey(path []byte, cell uint64, docID []byte) []byte {
+	// [ geoIdxNamespace, 00, path, 00, cell, 00, docID ]
+	// The cell is fixed width so may contain 00 bytes.
+	buf := make([]byte, 0, 13+len(path)+len(docID))
+	buf = append(buf, geoIdxNamespace, 0)
+	buf = append(buf, path...)
+	buf = append(buf, 0)
+	buf = binary.BigEndian.AppendUint64(buf, cell)
+	if docID != nil {
+		buf = append(buf, 0)
+		buf = append(buf, docID...)
+	}
+	return buf
+}
+
+// decodeGeoKey deserialises a geo index key.
+func decodeGeoKey(k []byte) (geoKey, error) {
+	gk := geoKey{}
+	if len(k) < 2 || k[0] != geoIdxNamespace || k[1] != 0 {
+		return gk, errors.New("Invalid namespace for geo index key")
+	}
+	k = k[2:]
+
+	m := bytes.IndexByte(k, 0)
+	if m < 0 || len(k) < m+10 {
+		return gk, errors.New("Truncated geo index key")
+	}
+	gk.path = k[:m:m]
+	gk.cell = binary.BigEndian.Uint64(k[m+1 : m+9])
+	gk.docID = k[m+10:]
+	return gk, nil
+}
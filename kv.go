@@ -0,0 +1,314 @@
+package docdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// This file contains the key-value storage interface that primary
+// data and the index are kept in, its Pebble implementation, and
+// Storage, which opens the stores of a database.
+//
+// The interface is the subset of Pebble's that docdb uses, so
+// Pebble's iterators satisfy KVIterator as they are. Writes through
+// it are durable once they return. See kv_memory.go for the in-memory
+// implementation.
+
+// IterOptions bound the keys an iterator visits. A nil bound leaves
+// that end open.
+type IterOptions struct {
+	LowerBound []byte // Inclusive
+	UpperBound []byte // Exclusive
+}
+
+// KVIterator iterates over keys in order. The positioning methods
+// return whether the iterator is at a key afterwards. Key and Value
+// are only valid until the iterator moves.
+type KVIterator interface {
+	First() bool
+	Last() bool
+	SeekGE(key []byte) bool
+	SeekLT(key []byte) bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Close() error
+}
+
+// KVReader reads keys.
+type KVReader interface {
+	// Get returns the value of key, or ErrNotFound. The value is
+	// only valid until closer is closed.
+	Get(key []byte) (value []byte, closer io.Closer, err error)
+	// NewIter returns an iterator over the keys within o, which may
+	// be nil. It sees the keys as they were when it was created.
+	NewIter(o *IterOptions) KVIterator
+}
+
+// KVBatch stages writes to apply to a KV atomically. Reads through it
+// see its writes on top of the KV's keys.
+type KVBatch interface {
+	KVReader
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// DeleteRange deletes the keys from start, inclusive, to end,
+	// exclusive.
+	DeleteRange(start, end []byte) error
+	// Count returns the number of writes staged.
+	Count() uint32
+	Close() error
+}
+
+// KVSnapshot is a read-only view of a KV at a point in time.
+type KVSnapshot interface {
+	KVReader
+	Close() error
+}
+
+// KV is an ordered key-value store. It's safe for concurrent use.
+type KV interface {
+	KVReader
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	NewBatch() KVBatch
+	// Apply applies the writes of b, which must come from the same
+	// KV's NewBatch, atomically.
+	Apply(b KVBatch) error
+	NewSnapshot() KVSnapshot
+	Close() error
+}
+
+// Storage opens the KV stores of a database: its primary data, its
+// index, and the shadow index that a reindex builds to replace the
+// index. Each is opened at most once at a time.
+type Storage interface {
+	OpenPrimary() (KV, error)
+	OpenIndex() (KV, error)
+	// OpenShadow opens the shadow index. If fresh, anything left in
+	// it from before is removed first.
+	OpenShadow(fresh bool) (KV, error)
+	// ReplaceIndex closes index and shadow, makes the shadow index
+	// the index, and returns it opened. If it fails, it returns the
+	// index and shadow index it leaves, opened, with the error, so
+	// they can still be used.
+	ReplaceIndex(index, shadow KV) (KV, KV, error)
+}
+
+// pebbleKV is a KV in a Pebble database.
+type pebbleKV struct {
+	db *pebble.DB
+}
+
+// OpenPebbleKV opens, or creates, the Pebble database at path as a KV.
+func OpenPebbleKV(path string) (KV, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return pebbleKV{db}, nil
+}
+
+// pebbleGet returns r.Get(key), with ErrNotFound for missing keys.
+func pebbleGet(r pebble.Reader, key []byte) ([]byte, io.Closer, error) {
+	v, closer, err := r.Get(key)
+	if err == pebble.ErrNotFound {
+		return nil, nil, ErrNotFound
+	}
+	return v, closer, err
+}
+
+// pebbleIterOptions returns o as Pebble iterator options.
+func pebbleIterOptions(o *IterOptions) *pebble.IterOptions {
+	if o == nil {
+		return nil
+	}
+	return &pebble.IterOptions{LowerBound: o.LowerBound, UpperBound: o.UpperBound}
+}
+
+func (p pebbleKV) Get(key []byte) ([]byte, io.Closer, error) {
+	return pebbleGet(p.db, key)
+}
+
+func (p pebbleKV) NewIter(o *IterOptions) KVIterator {
+	return p.db.NewIter(pebbleIterOptions(o))
+}
+
+func (p pebbleKV) Set(key, value []byte) error {
+	return p.db.Set(key, value, pebble.Sync)
+}
+
+func (p pebbleKV) Delete(key []byte) error {
+	return p.db.Delete(key, pebble.Sync)
+}
+
+func (p pebbleKV) NewBatch() KVBatch {
+	return pebbleBatch{p.db.NewIndexedBatch()}
+}
+
+func (p pebbleKV) Apply(b KVBatch) error {
+	return p.db.Apply(b.(pebbleBatch).b, pebble.Sync)
+}
+
+func (p pebbleKV) NewSnapshot() KVSnapshot {
+	return pebbleSnapshot{p.db.NewSnapshot()}
+}
+
+func (p pebbleKV) Close() error {
+	return p.db.Close()
+}
+
+// Checkpoint writes a copy of the database to dir, hard linking its
+// files where it can. See backup.go.
+func (p pebbleKV) Checkpoint(dir string) error {
+	return p.db.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
+// pebbleBatch is a KVBatch in an indexed Pebble batch.
+type pebbleBatch struct {
+	b *pebble.Batch
+}
+
+func (p pebbleBatch) Get(key []byte) ([]byte, io.Closer, error) {
+	return pebbleGet(p.b, key)
+}
+
+func (p pebbleBatch) NewIter(o *IterOptions) KVIterator {
+	return p.b.NewIter(pebbleIterOptions(o))
+}
+
+func (p pebbleBatch) Set(key, value []byte) error {
+	return p.b.Set(key, value, nil)
+}
+
+func (p pebbleBatch) Delete(key []byte) error {
+	return p.b.Delete(key, nil)
+}
+
+func (p pebbleBatch) DeleteRange(start, end []byte) error {
+	return p.b.DeleteRange(start, end, nil)
+}
+
+func (p pebbleBatch) Count() uint32 {
+	return p.b.Count()
+}
+
+func (p pebbleBatch) Close() error {
+	return p.b.Close()
+}
+
+// pebbleSnapshot is a KVSnapshot of a Pebble database.
+type pebbleSnapshot struct {
+	s *pebble.Snapshot
+}
+
+func (p pebbleSnapshot) Get(key []byte) ([]byte, io.Closer, error) {
+	return pebbleGet(p.s, key)
+}
+
+func (p pebbleSnapshot) NewIter(o *IterOptions) KVIterator {
+	return p.s.NewIter(pebbleIterOptions(o))
+}
+
+func (p pebbleSnapshot) Close() error {
+	return p.s.Close()
+}
+
+// pebbleStorage keeps a database in Pebble databases on disk.
+type pebbleStorage struct {
+	path string
+}
+
+// PebbleStorage returns the Storage for a database in Pebble
+// databases at path, and at path with ".index" appended for its
+// index.
+func PebbleStorage(path string) Storage {
+	return pebbleStorage{path}
+}
+
+func (p pebbleStorage) indexPath() string {
+	return p.path + ".index"
+}
+
+func (p pebbleStorage) shadowPath() string {
+	return p.indexPath() + ".reindex"
+}
+
+func (p pebbleStorage) OpenPrimary() (KV, error) {
+	return OpenPebbleKV(p.path)
+}
+
+func (p pebbleStorage) OpenIndex() (KV, error) {
+	if err := recoverIndexSwap(p.indexPath()); err != nil {
+		return nil, err
+	}
+	return OpenPebbleKV(p.indexPath())
+}
+
+func (p pebbleStorage) OpenShadow(fresh bool) (KV, error) {
+	if fresh {
+		if err := os.RemoveAll(p.shadowPath()); err != nil {
+			return nil, err
+		}
+	}
+	return OpenPebbleKV(p.shadowPath())
+}
+
+// ReplaceIndex swaps the index directories by renaming them. If it's
+// interrupted, recoverIndexSwap finishes the swap.
+func (p pebbleStorage) ReplaceIndex(index, shadow KV) (KV, KV, error) {
+	if err := p.renameShadow(index, shadow); err != nil {
+		return p.reopenIndexes(err)
+	}
+	db, err := OpenPebbleKV(p.indexPath())
+	if err != nil {
+		return p.reopenIndexes(err)
+	}
+	return db, nil, nil
+}
+
+// renameShadow closes index and shadow and renames the shadow
+// index's directory to the index's.
+func (p pebbleStorage) renameShadow(index, shadow KV) error {
+	if err := shadow.Close(); err != nil {
+		index.Close()
+		return err
+	}
+	if err := index.Close(); err != nil {
+		return err
+	}
+
+	path := p.indexPath()
+	if err := os.Rename(path, path+".old"); err != nil {
+		return err
+	}
+	if err := os.Rename(p.shadowPath(), path); err != nil {
+		return err
+	}
+	return os.RemoveAll(path + ".old")
+}
+
+// reopenIndexes opens the index, and the shadow index if the swap
+// didn't get as far as moving it, after ReplaceIndex failed with err.
+func (p pebbleStorage) reopenIndexes(err error) (KV, KV, error) {
+	if rerr := recoverIndexSwap(p.indexPath()); rerr != nil {
+		return nil, nil, errors.New(fmt.Sprintf("%v, and could not recover the index: %v", err, rerr))
+	}
+	index, rerr := OpenPebbleKV(p.indexPath())
+	if rerr != nil {
+		return nil, nil, errors.New(fmt.Sprintf("%v, and could not reopen the index: %v", err, rerr))
+	}
+	if _, serr := os.Stat(p.shadowPath()); serr != nil {
+		return index, nil, err
+	}
+	shadow, rerr := OpenPebbleKV(p.shadowPath())
+	if rerr != nil {
+		return index, nil, errors.New(fmt.Sprintf("%v, and could not reopen the shadow index: %v", err, rerr))
+	}
+	return index, shadow, err
+}
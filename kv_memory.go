@@ -0,0 +1,345 @@
+package docdb
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// This file contains the in-memory KV, for tests and ephemeral
+// databases.
+//
+// Keys are kept in a copy-on-write B-tree. Iterators, snapshots and
+// batches each work on a clone of the tree, which is cheap to take,
+// so they see the keys as they were when they were created and don't
+// hold any lock while they're used. Unlike a Pebble batch, a batch
+// doesn't see writes made to the KV after it was created.
+
+// memoryItem is a key and its value in a memory tree.
+type memoryItem struct {
+	key, value []byte
+}
+
+func lessMemoryItem(a, b memoryItem) bool {
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+type memoryTree = btree.BTreeG[memoryItem]
+
+// deleteMemoryRange deletes the keys from start, inclusive, to end,
+// exclusive, from tree.
+func deleteMemoryRange(tree *memoryTree, start, end []byte) {
+	var deleted []memoryItem
+	tree.AscendRange(memoryItem{key: start}, memoryItem{key: end}, func(item memoryItem) bool {
+		deleted = append(deleted, item)
+		return true
+	})
+	for _, item := range deleted {
+		tree.Delete(item)
+	}
+}
+
+// getMemory returns the value of key in tree, or ErrNotFound.
+func getMemory(tree *memoryTree, key []byte) ([]byte, io.Closer, error) {
+	item, ok := tree.Get(memoryItem{key: key})
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	return item.value, noopCloser{}, nil
+}
+
+// noopCloser is the closer for values read from memory, which don't
+// need releasing.
+type noopCloser struct{}
+
+func (noopCloser) Close() error {
+	return nil
+}
+
+// memoryKV is a KV in memory.
+type memoryKV struct {
+	mu   sync.RWMutex
+	tree *memoryTree
+}
+
+// NewMemoryKV returns an empty KV held in memory. Closing it does
+// nothing, and its keys are lost when it's no longer referenced.
+func NewMemoryKV() KV {
+	return &memoryKV{tree: btree.NewG(32, lessMemoryItem)}
+}
+
+// clone returns a copy of the tree that later writes don't change.
+func (m *memoryKV) clone() *memoryTree {
+	// Cloning updates the tree's copy-on-write state, so it needs
+	// the write lock.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tree.Clone()
+}
+
+func (m *memoryKV) Get(key []byte) ([]byte, io.Closer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return getMemory(m.tree, key)
+}
+
+func (m *memoryKV) NewIter(o *IterOptions) KVIterator {
+	return newMemoryIter(m.clone(), o)
+}
+
+func (m *memoryKV) Set(key, value []byte) error {
+	item := memoryItem{append([]byte(nil), key...), append([]byte{}, value...)}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tree.ReplaceOrInsert(item)
+	return nil
+}
+
+func (m *memoryKV) Delete(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tree.Delete(memoryItem{key: key})
+	return nil
+}
+
+func (m *memoryKV) NewBatch() KVBatch {
+	return &memoryBatch{tree: m.clone()}
+}
+
+func (m *memoryKV) Apply(b KVBatch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, op := range b.(*memoryBatch).ops {
+		switch {
+		case op.end != nil:
+			deleteMemoryRange(m.tree, op.key, op.end)
+		case op.value != nil:
+			m.tree.ReplaceOrInsert(memoryItem{op.key, op.value})
+		default:
+			m.tree.Delete(memoryItem{key: op.key})
+		}
+	}
+	return nil
+}
+
+func (m *memoryKV) NewSnapshot() KVSnapshot {
+	return memorySnapshot{m.clone()}
+}
+
+func (m *memoryKV) Close() error {
+	return nil
+}
+
+// memoryOp is a write staged in a memoryBatch: a set if value isn't
+// nil, a range deletion if end isn't nil, and otherwise a deletion.
+type memoryOp struct {
+	key, value, end []byte
+}
+
+// memoryBatch is a KVBatch for a memoryKV. Its writes are applied to
+// its own clone of the KV's tree, for reads, and recorded to replay
+// on the KV when it's applied.
+type memoryBatch struct {
+	tree *memoryTree
+	ops  []memoryOp
+}
+
+func (b *memoryBatch) Get(key []byte) ([]byte, io.Closer, error) {
+	return getMemory(b.tree, key)
+}
+
+func (b *memoryBatch) NewIter(o *IterOptions) KVIterator {
+	return newMemoryIter(b.tree.Clone(), o)
+}
+
+func (b *memoryBatch) Set(key, value []byte) error {
+	item := memoryItem{append([]byte(nil), key...), append([]byte{}, value...)}
+	b.tree.ReplaceOrInsert(item)
+	b.ops = append(b.ops, memoryOp{key: item.key, value: item.value})
+	return nil
+}
+
+func (b *memoryBatch) Delete(key []byte) error {
+	key = append([]byte(nil), key...)
+	b.tree.Delete(memoryItem{key: key})
+	b.ops = append(b.ops, memoryOp{key: key})
+	return nil
+}
+
+func (b *memoryBatch) DeleteRange(start, end []byte) error {
+	op := memoryOp{key: append([]byte(nil), start...), end: append([]byte{}, end...)}
+	deleteMemoryRange(b.tree, op.key, op.end)
+	b.ops = append(b.ops, op)
+	return nil
+}
+
+func (b *memoryBatch) Count() uint32 {
+	return uint32(len(b.ops))
+}
+
+func (b *memoryBatch) Close() error {
+	b.tree, b.ops = nil, nil
+	return nil
+}
+
+// memorySnapshot is a KVSnapshot of a memoryKV.
+type memorySnapshot struct {
+	tree *memoryTree
+}
+
+func (s memorySnapshot) Get(key []byte) ([]byte, io.Closer, error) {
+	return getMemory(s.tree, key)
+}
+
+func (s memorySnapshot) NewIter(o *IterOptions) KVIterator {
+	return newMemoryIter(s.tree, o)
+}
+
+func (s memorySnapshot) Close() error {
+	return nil
+}
+
+// memoryIter is a KVIterator over a tree that isn't written to. Each
+// move searches the tree from the current key.
+type memoryIter struct {
+	tree         *memoryTree
+	lower, upper []byte
+	item         memoryItem
+	valid        bool
+}
+
+func newMemoryIter(tree *memoryTree, o *IterOptions) *memoryIter {
+	it := &memoryIter{tree: tree}
+	if o != nil {
+		it.lower, it.upper = o.LowerBound, o.UpperBound
+	}
+	return it
+}
+
+// seekAfter moves to the first key within bounds that is after key,
+// or at it if inclusive. A nil key is before every key.
+func (it *memoryIter) seekAfter(key []byte, inclusive bool) bool {
+	if it.lower != nil && (key == nil || bytes.Compare(key, it.lower) < 0) {
+		key, inclusive = it.lower, true
+	}
+
+	it.valid = false
+	visit := func(item memoryItem) bool {
+		if !inclusive && bytes.Equal(item.key, key) {
+			return true
+		}
+		it.item, it.valid = item, true
+		return false
+	}
+	if key == nil {
+		it.tree.Ascend(visit)
+	} else {
+		it.tree.AscendGreaterOrEqual(memoryItem{key: key}, visit)
+	}
+
+	if it.valid && it.upper != nil && bytes.Compare(it.item.key, it.upper) >= 0 {
+		it.valid = false
+	}
+	return it.valid
+}
+
+// seekBefore moves to the last key within bounds that is before key,
+// or at it if inclusive. A nil key is after every key.
+func (it *memoryIter) seekBefore(key []byte, inclusive bool) bool {
+	if it.upper != nil && (key == nil || bytes.Compare(key, it.upper) >= 0) {
+		key, inclusive = it.upper, false
+	}
+
+	it.valid = false
+	visit := func(item memoryItem) bool {
+		if !inclusive && bytes.Equal(item.key, key) {
+			return true
+		}
+		it.item, it.valid = item, true
+		return false
+	}
+	if key == nil {
+		it.tree.Descend(visit)
+	} else {
+		it.tree.DescendLessOrEqual(memoryItem{key: key}, visit)
+	}
+
+	if it.valid && it.lower != nil && bytes.Compare(it.item.key, it.lower) < 0 {
+		it.valid = false
+	}
+	return it.valid
+}
+
+func (it *memoryIter) First() bool {
+	return it.seekAfter(nil, true)
+}
+
+func (it *memoryIter) Last() bool {
+	return it.seekBefore(nil, true)
+}
+
+func (it *memoryIter) SeekGE(key []byte) bool {
+	return it.seekAfter(key, true)
+}
+
+func (it *memoryIter) SeekLT(key []byte) bool {
+	return it.seekBefore(key, false)
+}
+
+func (it *memoryIter) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekAfter(it.item.key, false)
+}
+
+func (it *memoryIter) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.seekBefore(it.item.key, false)
+}
+
+func (it *memoryIter) Valid() bool {
+	return it.valid
+}
+
+func (it *memoryIter) Key() []byte {
+	return it.item.key
+}
+
+func (it *memoryIter) Value() []byte {
+	return it.item.value
+}
+
+func (it *memoryIter) Close() error {
+	it.valid = false
+	return nil
+}
+
+// memoryStorage keeps a database in memory.
+type memoryStorage struct{}
+
+// MemoryStorage returns the Storage for a database held in memory,
+// which is lost when it's closed.
+func MemoryStorage() Storage {
+	return memoryStorage{}
+}
+
+func (memoryStorage) OpenPrimary() (KV, error) {
+	return NewMemoryKV(), nil
+}
+
+func (memoryStorage) OpenIndex() (KV, error) {
+	return NewMemoryKV(), nil
+}
+
+func (memoryStorage) OpenShadow(fresh bool) (KV, error) {
+	return NewMemoryKV(), nil
+}
+
+func (memoryStorage) ReplaceIndex(index, shadow KV) (KV, KV, error) {
+	return shadow, nil, index.Close()
+}
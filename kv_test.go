@@ -0,0 +1,106 @@
+package docdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// iterKeys returns the keys iter visits from First to the end.
+func iterKeys(iter KVIterator) []string {
+	keys := []string{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	return keys
+}
+
+func Test_KV(t *testing.T) {
+	pebbleKV, err := OpenPebbleKV(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	kvs := map[string]KV{"pebble": pebbleKV, "memory": NewMemoryKV()}
+
+	for name, kv := range kvs {
+		t.Run(name, func(t *testing.T) {
+			for _, k := range []string{"a", "b", "c", "d", "e"} {
+				assert.NoError(t, kv.Set([]byte(k), []byte(k+k)))
+			}
+			v, closer, err := kv.Get([]byte("c"))
+			assert.NoError(t, err)
+			assert.Equal(t, "cc", string(v))
+			closer.Close()
+			_, _, err = kv.Get([]byte("z"))
+			assert.Equal(t, ErrNotFound, err)
+
+			// Bounded iteration in both directions
+			iter := kv.NewIter(&IterOptions{LowerBound: []byte("b"), UpperBound: []byte("e")})
+			assert.True(t, iter.Last())
+			assert.Equal(t, "d", string(iter.Key()))
+			assert.True(t, iter.Prev())
+			assert.Equal(t, "c", string(iter.Key()))
+			assert.True(t, iter.SeekLT([]byte("c")))
+			assert.Equal(t, "b", string(iter.Key()))
+			assert.False(t, iter.Prev())
+			assert.True(t, iter.SeekGE([]byte("bb")))
+			assert.Equal(t, "cc", string(iter.Value()))
+			assert.False(t, iter.SeekGE([]byte("e")))
+			iter.Close()
+			assert.Equal(t, []string{"a", "b", "c", "d", "e"}, iterKeys(kv.NewIter(nil)))
+
+			// Batches read their own writes, and are applied at once
+			snap := kv.NewSnapshot()
+			iter = kv.NewIter(nil)
+			b := kv.NewBatch()
+			assert.NoError(t, b.DeleteRange([]byte("b"), []byte("d")))
+			assert.NoError(t, b.Set([]byte("bb"), []byte("x")))
+			assert.NoError(t, b.Delete([]byte("e")))
+			assert.Equal(t, uint32(3), b.Count())
+			assert.Equal(t, []string{"a", "bb", "d"}, iterKeys(b.NewIter(nil)))
+			_, _, err = b.Get([]byte("c"))
+			assert.Equal(t, ErrNotFound, err)
+			_, closer, err = kv.Get([]byte("c"))
+			if assert.NoError(t, err) {
+				closer.Close()
+			}
+			assert.NoError(t, kv.Apply(b))
+			b.Close()
+			assert.Equal(t, []string{"a", "bb", "d"}, iterKeys(kv.NewIter(nil)))
+
+			// Snapshots and iterators don't see later writes
+			assert.Equal(t, []string{"a", "b", "c", "d", "e"}, iterKeys(iter))
+			assert.Equal(t, []string{"a", "b", "c", "d", "e"}, iterKeys(snap.NewIter(nil)))
+			v, closer, err = snap.Get([]byte("e"))
+			assert.NoError(t, err)
+			assert.Equal(t, "ee", string(v))
+			closer.Close()
+			snap.Close()
+
+			assert.NoError(t, kv.Delete([]byte("a")))
+			assert.Equal(t, []string{"bb", "d"}, iterKeys(kv.NewIter(nil)))
+			assert.NoError(t, kv.Close())
+		})
+	}
+}
+
+func Test_memoryServerReindex(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		s.addDocument(id, map[string]any{"n": 1})
+	}
+	old := s.idx.db
+
+	assert.NoError(t, s.reindex(reindexOptions{batchSize: 2}))
+	assert.NotEqual(t, old, s.idx.db)
+	assert.Nil(t, s.idx.shadow)
+	ids, _ := lookupEq(s.idx.db, nil, "n", 1)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, ids)
+	report, _ := s.checkIndex(false)
+	assert.True(t, report.ok())
+	assert.NoError(t, s.close())
+}
@@ -0,0 +1,248 @@
+package docdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// This file contains index format versioning and migrations.
+//
+// The layout of index keys and values, the namespaces, tags and
+// value encodings, is the index format. The index records the
+// version of the format it was written in under indexVersionKey,
+// and the server refuses to open an index in any version other
+// than indexFormatVersion, rather than misreading it.
+//
+// Indexes written before versioning have no version key. They're
+// version 1 if they have any keys, and an index with no keys at all
+// is new, so gets the current version.
+//
+// Changing the format means increasing indexFormatVersion and adding
+// a migration to indexMigrations, which rewrites the entries of an
+// index in the previous version. Migrate, run by `docdb migrate`,
+// runs migrations until the index is in the current version.
+//
+// The versions are:
+//
+// 1. The original format.
+// 2. Forward index values list the namespaces the path value was
+//    written into. Before, they were empty.
+// 3. Instants at timestamp paths are encoded as seconds and
+//    nanoseconds, with JSONTagTime. Before, they were nanoseconds,
+//    with jsonTagNanoTime, which overflowed outside 1678 to 2262.
+//    Values that overflowed stay wrong until `docdb check -repair`.
+
+// indexFormatVersion is the version of the index format written by
+// this code.
+const indexFormatVersion = 3
+
+// indexVersionKey holds the index format version as a uvarint.
+var indexVersionKey = packTuple([]byte{metaNamespace}, []byte("version"))
+
+// migrationBatchSize is the number of index entries a migration
+// rewrites in each batch.
+const migrationBatchSize = 1000
+
+// migration rewrites an index from version to-1 to version to.
+type migration struct {
+	to int
+	// rewrite returns the new key and value for an index entry, or
+	// a nil key to delete it. It's called for every entry outside
+	// metaNamespace, and must leave entries already in the new
+	// format as they are, as a migration may be run again after
+	// it's interrupted.
+	rewrite func(key, value []byte) ([]byte, []byte)
+}
+
+// indexMigrations lists the migrations in version order.
+var indexMigrations = []migration{
+	{to: 2, rewrite: migrateForwardNamespaces},
+	{to: 3, rewrite: migrateTimestamps},
+}
+
+// migrateForwardNamespaces gives empty forward index values, from
+// version 1, the inverted index namespace they imply.
+func migrateForwardNamespaces(key, value []byte) ([]byte, []byte) {
+	if key[0] == fwdIdxNamespace && len(value) == 0 {
+		return key, []byte{invIdxNamespace}
+	}
+	return key, value
+}
+
+// migrateTimestamps re-encodes the instants in inverted and forward
+// index keys, in the default collection or any other, from
+// jsonTagNanoTime to JSONTagTime.
+func migrateTimestamps(key, value []byte) ([]byte, []byte) {
+	full := key
+	var prefix []byte
+	if key[0] == collectionNamespace {
+		i := bytes.IndexByte(key[1:], 0)
+		if i < 0 || len(key) <= i+2 {
+			return full, value
+		}
+		prefix, key = key[:i+2], key[i+2:]
+	}
+
+	var head, nanoTime, tail []byte
+	switch key[0] {
+	case invIdxNamespace:
+		// [ i 00 path 00 tag time8 00 docID ]
+		m := bytes.IndexByte(key[2:], 0)
+		if m < 0 || len(key) < 2+m+11 || key[2+m+1] != jsonTagNanoTime {
+			return full, value
+		}
+		head = key[:2+m+1]
+		nanoTime = key[2+m+2 : 2+m+10]
+		tail = key[2+m+10:]
+	case fwdIdxNamespace:
+		// [ f 00 docID 00 path 00 tag time8 ]
+		parts := unpackTupleN(key, 4)
+		if len(parts) < 4 || len(parts[3]) != 9 || parts[3][0] != jsonTagNanoTime {
+			return full, value
+		}
+		head = key[:len(key)-9]
+		nanoTime = parts[3][1:]
+	default:
+		return full, value
+	}
+
+	migrated := append([]byte{}, prefix...)
+	migrated = append(migrated, head...)
+	migrated = append(migrated, JSONTagTime)
+	migrated = append(migrated, encodeTimestamp(decodeTime(nanoTime))...)
+	migrated = append(migrated, tail...)
+	return migrated, value
+}
+
+// readIndexVersion returns the index format version of db, or 0 if
+// db is empty.
+func readIndexVersion(db KV) (int, error) {
+	v, closer, err := db.Get(indexVersionKey)
+	if err == nil {
+		defer closer.Close()
+		version, n := binary.Uvarint(v)
+		if n <= 0 {
+			return 0, errors.New("Bad index format version")
+		}
+		return int(version), nil
+	} else if err != ErrNotFound {
+		return 0, err
+	}
+
+	iter := db.NewIter(nil)
+	empty := !iter.First()
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	if empty {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// writeIndexVersion records version as the index format version of
+// db.
+func writeIndexVersion(db KV, version int) error {
+	v := binary.AppendUvarint(nil, uint64(version))
+	return db.Set(indexVersionKey, v)
+}
+
+// checkIndexVersion returns an error if db isn't in the current
+// index format version. New indexes are given the current version.
+func checkIndexVersion(db KV) error {
+	version, err := readIndexVersion(db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == 0:
+		return writeIndexVersion(db, indexFormatVersion)
+	case version < indexFormatVersion:
+		return errors.New(fmt.Sprintf(
+			"Index format version %d is older than %d, run docdb migrate",
+			version, indexFormatVersion))
+	case version > indexFormatVersion:
+		return errors.New(fmt.Sprintf(
+			"Index format version %d is newer than %d, upgrade docdb",
+			version, indexFormatVersion))
+	}
+	return nil
+}
+
+// migrateIndex runs the migrations needed to bring db to the current
+// index format version, and returns the version it started at.
+func migrateIndex(db KV) (int, error) {
+	from, err := readIndexVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if from > indexFormatVersion {
+		return from, checkIndexVersion(db)
+	}
+	if from == 0 {
+		return from, writeIndexVersion(db, indexFormatVersion)
+	}
+
+	for _, m := range indexMigrations {
+		if m.to <= from {
+			continue
+		}
+		err := runMigration(db, m)
+		if err != nil {
+			return from, errors.New(fmt.Sprintf(
+				"Could not migrate index to version %d: %v", m.to, err))
+		}
+		err = writeIndexVersion(db, m.to)
+		if err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+// runMigration rewrites the entries of db with m, in batches. It
+// reads from a snapshot so that rewritten keys aren't visited again.
+func runMigration(db KV, m migration) error {
+	snap := db.NewSnapshot()
+	defer snap.Close()
+	iter := snap.NewIter(nil)
+	b := db.NewBatch()
+
+	var err error
+	for iter.First(); iter.Valid() && err == nil; iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if key[0] == metaNamespace {
+			continue
+		}
+
+		newKey, newValue := m.rewrite(key, value)
+		switch {
+		case newKey == nil:
+			err = b.Delete(key)
+		case !bytes.Equal(newKey, key):
+			err = b.Delete(key)
+			if err == nil {
+				err = b.Set(newKey, newValue)
+			}
+		case !bytes.Equal(newValue, value):
+			err = b.Set(key, newValue)
+		}
+
+		if err == nil && b.Count() >= migrationBatchSize {
+			err = db.Apply(b)
+			b.Close()
+			b = db.NewBatch()
+		}
+	}
+	if err == nil {
+		err = db.Apply(b)
+	}
+	b.Close()
+
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package docdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_migrateIndex(t *testing.T) {
+	d := t.TempDir()
+	db, _ := OpenPebbleKV(d + ".index")
+	version, _ := readIndexVersion(db)
+	assert.Equal(t, 0, version)
+
+	// Write a version 1 index: no version key and empty forward
+	// index values
+	for _, id := range []string{"mike", "phil"} {
+		index(db, nil, id, map[string]any{"age": 40, "name": id})
+	}
+	iter := db.NewIter(&IterOptions{
+		LowerBound: []byte{fwdIdxNamespace},
+		UpperBound: []byte{fwdIdxNamespace + 1},
+	})
+	for iter.First(); iter.Valid(); iter.Next() {
+		db.Set(iter.Key(), nil)
+	}
+	iter.Close()
+	version, _ = readIndexVersion(db)
+	assert.Equal(t, 1, version)
+	db.Close()
+
+	_, err := newServer(d, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "run docdb migrate")
+	}
+
+	db, _ = OpenPebbleKV(d + ".index")
+	from, err := migrateIndex(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, from)
+	version, _ = readIndexVersion(db)
+	assert.Equal(t, indexFormatVersion, version)
+
+	// Unindexing relies on the migrated forward index values
+	assert.NoError(t, unindex(db, []byte("mike")))
+	ids, _ := lookupEq(db, nil, "age", 40)
+	assert.Equal(t, []string{"phil"}, ids)
+
+	from, err = migrateIndex(db)
+	assert.NoError(t, err)
+	assert.Equal(t, indexFormatVersion, from)
+
+	// Indexes from the future aren't opened
+	writeIndexVersion(db, indexFormatVersion+1)
+	db.Close()
+	_, err = newServer(d, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "upgrade docdb")
+	}
+}
+
+func Test_newServerIndexVersion(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	version, _ := readIndexVersion(s.idx.db)
+	assert.Equal(t, indexFormatVersion, version)
+
+	// The shadow index of a reindex has the version too, so keeps
+	// it when it replaces the live index
+	s.addDocument("mike", map[string]any{"age": 40})
+	assert.NoError(t, s.reindex(reindexOptions{batchSize: 10}))
+	version, _ = readIndexVersion(s.idx.db)
+	assert.Equal(t, indexFormatVersion, version)
+	s.idx.db.Close()
+	s.cols.root.Close()
+}
+
+func Test_migrateTimestamps(t *testing.T) {
+	at := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	v2 := append([]byte{jsonTagNanoTime}, encodeTime(at)...)
+	v3 := encodeTaggedValue(at)
+	prefix := collectionPrefix("people")
+	fwd := func(taggedValue []byte) []byte {
+		return encodeFwdIdxKey(fwdIdxKey{[]byte("a"), []byte("created"), taggedValue})
+	}
+	inv := func(taggedValue []byte) []byte {
+		return encodeInvIdxKey([]byte("created"), taggedValue, []byte("a"))
+	}
+
+	tests := []struct {
+		key, expected []byte
+	}{
+		{inv(v2), inv(v3)},
+		{fwd(v2), fwd(v3)},
+		{append(prefix, inv(v2)...), append(prefix, inv(v3)...)},
+		{append(prefix, fwd(v2)...), append(prefix, fwd(v3)...)},
+		// Other values, and raw expiry times, are left alone
+		{inv(encodeTaggedValue(12)), inv(encodeTaggedValue(12))},
+		{fwd(encodeTaggedValue("x")), fwd(encodeTaggedValue("x"))},
+		{encodeFwdIdxKey(fwdIdxKey{[]byte("a"), []byte(expiresField), encodeTime(at)}),
+			encodeFwdIdxKey(fwdIdxKey{[]byte("a"), []byte(expiresField), encodeTime(at)})},
+		{encodeExpKey(encodeTime(at), []byte("a")), encodeExpKey(encodeTime(at), []byte("a"))},
+	}
+	for _, test := range tests {
+		key, value := migrateTimestamps(test.key, []byte{invIdxNamespace})
+		assert.Equal(t, test.expected, key, "%v", test.key)
+		assert.Equal(t, []byte{invIdxNamespace}, value)
+	}
+
+	iik, err := decodeInvIndexKey(inv(v3))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), iik.DocID)
+}
@@ -0,0 +1,448 @@
+package docdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file contains partial updates of documents, with JSON Patch
+// (RFC 6902) and JSON Merge Patch (RFC 7386).
+//
+// A patch is applied to the stored document under writeMu, so no
+// other write can come between reading the document and writing the
+// patched one, and either every operation of a JSON Patch applies or
+// none do. The patched document is stored as a put would store it,
+// with its expiry and checked against the schema, as the next
+// revision.
+//
+// Rather than replacing every index entry of the document, as a put
+// does, only the entries of the paths whose values changed are
+// replaced, by reindexPathsBatch. The paths are found by comparing
+// the stored and patched documents, so it doesn't matter how the
+// patch said to change them. The index and primary data are each
+// written in one batch.
+
+var (
+	// errPatchTestFailed is returned for JSON Patches whose test
+	// operation fails.
+	errPatchTestFailed = errors.New("Test failed")
+	// errPatchNotObject is returned for patches that would leave a
+	// document that isn't a JSON object.
+	errPatchNotObject = errors.New("Patched documents must be JSON objects")
+)
+
+// PatchOperation is an operation of a JSON Patch. Op is one of add,
+// remove, replace, move, copy and test. Path and From are JSON
+// pointers.
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+// PatchError is returned for patches that can't be applied, with the
+// index of the JSON Patch operation that failed.
+type PatchError struct {
+	Op  int
+	Err error
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("Patch operation %d: %v", e.Op, e.Err)
+}
+
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// parsePointer returns the reference tokens of the JSON pointer p.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, errors.New(fmt.Sprintf("Bad JSON pointer %q", p))
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex returns the index of token in array, which may be len(array)
+// if end is true, when token can also be "-".
+func arrayIndex(array []any, token string, end bool) (int, error) {
+	if token == "-" && end {
+		return len(array), nil
+	}
+	i, err := strconv.Atoi(token)
+	limit := len(array)
+	if end {
+		limit++
+	}
+	if err != nil || i < 0 || i >= limit || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, errors.New(fmt.Sprintf("Array index %q out of range", token))
+	}
+	return i, nil
+}
+
+// pointerValue returns the value at tokens in node.
+func pointerValue(node any, tokens []string) (any, error) {
+	for _, token := range tokens {
+		switch n := node.(type) {
+		case map[string]any:
+			v, ok := n[token]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("No member %q", token))
+			}
+			node = v
+		case []any:
+			i, err := arrayIndex(n, token, false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, errors.New(fmt.Sprintf("Can't find %q in a scalar", token))
+		}
+	}
+	return node, nil
+}
+
+// pointerAdd adds value at tokens in node, and returns node with it.
+func pointerAdd(node any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch n := node.(type) {
+	case map[string]any:
+		if len(rest) == 0 {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("No member %q", token))
+		}
+		child, err := pointerAdd(child, rest, value)
+		n[token] = child
+		return n, err
+	case []any:
+		i, err := arrayIndex(n, token, len(rest) == 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		n[i], err = pointerAdd(n[i], rest, value)
+		return n, err
+	}
+	return nil, errors.New(fmt.Sprintf("Can't add %q to a scalar", token))
+}
+
+// pointerRemove removes the value at tokens in node, and returns node
+// without it.
+func pointerRemove(node any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("Can't remove the whole document")
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch n := node.(type) {
+	case map[string]any:
+		child, ok := n[token]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("No member %q", token))
+		}
+		if len(rest) == 0 {
+			delete(n, token)
+			return n, nil
+		}
+		child, err := pointerRemove(child, rest)
+		n[token] = child
+		return n, err
+	case []any:
+		i, err := arrayIndex(n, token, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return append(n[:i], n[i+1:]...), nil
+		}
+		n[i], err = pointerRemove(n[i], rest)
+		return n, err
+	}
+	return nil, errors.New(fmt.Sprintf("Can't remove %q from a scalar", token))
+}
+
+// copyValue returns a deep copy of v, a JSON value.
+func copyValue(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(t))
+		for k, e := range t {
+			c[k] = copyValue(e)
+		}
+		return c
+	case []any:
+		c := make([]any, len(t))
+		for i, e := range t {
+			c[i] = copyValue(e)
+		}
+		return c
+	}
+	return v
+}
+
+// applyOperation applies op to document and returns the result.
+func applyOperation(document any, op PatchOperation) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add":
+		return pointerAdd(document, path, copyValue(op.Value))
+	case "remove":
+		return pointerRemove(document, path)
+	case "replace":
+		if _, err := pointerValue(document, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return copyValue(op.Value), nil
+		}
+		document, err = pointerRemove(document, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(document, path, copyValue(op.Value))
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := pointerValue(document, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			return pointerAdd(document, path, copyValue(value))
+		}
+		if op.Path == op.From {
+			return document, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, errors.New("Can't move a value into itself")
+		}
+		document, err = pointerRemove(document, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(document, path, value)
+	case "test":
+		value, err := pointerValue(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !jsonEqual(value, op.Value) {
+			return nil, errPatchTestFailed
+		}
+		return document, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown op %q", op.Op))
+}
+
+// applyPatch returns document with the JSON Patch ops applied, or a
+// *PatchError. document is changed.
+func applyPatch(document map[string]any, ops []PatchOperation) (map[string]any, error) {
+	var patched any = document
+	for i, op := range ops {
+		var err error
+		patched, err = applyOperation(patched, op)
+		if err != nil {
+			return nil, &PatchError{Op: i, Err: err}
+		}
+	}
+	object, ok := patched.(map[string]any)
+	if !ok {
+		return nil, &PatchError{Op: len(ops) - 1, Err: errPatchNotObject}
+	}
+	return object, nil
+}
+
+// mergePatch returns target with the JSON Merge Patch patch applied.
+// target is changed.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return copyValue(patch)
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// changedPaths returns the dotted paths, under prefix, whose values
+// differ between the documents a and b, without descending into
+// values that aren't objects in both.
+func changedPaths(a, b map[string]any, prefix string) []string {
+	var paths []string
+	check := func(key string) {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		av, aok := a[key]
+		bv, bok := b[key]
+		am, aObject := av.(map[string]any)
+		bm, bObject := bv.(map[string]any)
+		if aok && bok && aObject && bObject {
+			paths = append(paths, changedPaths(am, bm, path)...)
+		} else if aok != bok || !jsonEqual(av, bv) {
+			paths = append(paths, path)
+		}
+	}
+	for key := range a {
+		check(key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			check(key)
+		}
+	}
+	return paths
+}
+
+// patchDocument applies patch to the document with id, if rev is its
+// revision, and returns its new revision. If rev doesn't match, it
+// returns ErrConflict, and if there's no document, ErrNotFound.
+func (s server) patchDocument(id string, patch func(map[string]any) (map[string]any, error), rev uint64) (uint64, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return 0, err
+	}
+
+	stored, current, err := s.getDocument([]byte(id))
+	if err != nil {
+		return 0, err
+	}
+	if rev != anyRevision && rev != current {
+		return 0, ErrConflict
+	}
+	// patch changes the document it's given
+	document, err := patch(copyValue(stored).(map[string]any))
+	if err != nil {
+		return 0, err
+	}
+	document, err = s.storedDocument(document)
+	if err != nil {
+		return 0, err
+	}
+
+	indexDb := s.indexDb()
+	ib := indexDb.NewBatch()
+	defer ib.Close()
+	err = reindexPathsBatch(ib, s.cfg, id, document, changedPaths(stored, document, ""))
+	if err != nil {
+		return 0, err
+	}
+
+	bs, err := encodeDocument(document, current+1)
+	if err != nil {
+		return 0, err
+	}
+	b := s.db.NewBatch()
+	defer b.Close()
+	err = b.Set([]byte(id), bs)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := s.logChanges(b, Change{ID: id, Rev: current + 1})
+	if err != nil {
+		return 0, err
+	}
+
+	// As with putDocument, the index is written first
+	if err := indexDb.Apply(ib); err != nil {
+		return 0, err
+	}
+	if err := s.db.Apply(b); err != nil {
+		return 0, err
+	}
+	s.feed.publish(seq)
+
+	return current + 1, s.updateShadow(id)
+}
+
+// Patch applies the JSON Patch (RFC 6902) ops to the document with id
+// and returns its new revision. Either every operation applies or
+// none do, and the document isn't written. An operation that can't
+// be applied, or whose test fails, returns a *PatchError. If there's
+// no document, it returns ErrNotFound.
+func (c *Collection) Patch(ctx context.Context, id string, ops []PatchOperation) (uint64, error) {
+	return c.PatchIf(ctx, id, ops, anyRevision)
+}
+
+// PatchIf applies the JSON Patch ops to the document with id if rev
+// is its revision, or returns ErrConflict. See Patch.
+func (c *Collection) PatchIf(ctx context.Context, id string, ops []PatchOperation, rev uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.s.patchDocument(id, func(document map[string]any) (map[string]any, error) {
+		return applyPatch(document, ops)
+	}, rev)
+}
+
+// MergePatch applies the JSON Merge Patch (RFC 7386) patch to the
+// document with id and returns its new revision: members of patch
+// replace those of the document, recursively for objects, and null
+// members remove them. If there's no document, it returns
+// ErrNotFound.
+func (c *Collection) MergePatch(ctx context.Context, id string, patch map[string]any) (uint64, error) {
+	return c.MergePatchIf(ctx, id, patch, anyRevision)
+}
+
+// MergePatchIf applies the JSON Merge Patch patch to the document
+// with id if rev is its revision, or returns ErrConflict. See
+// MergePatch.
+func (c *Collection) MergePatchIf(ctx context.Context, id string, patch map[string]any, rev uint64) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.s.patchDocument(id, func(document map[string]any) (map[string]any, error) {
+		return mergePatch(document, patch).(map[string]any), nil
+	}, rev)
+}
+
+// Patch applies a JSON Patch to a document of the default collection.
+// See Collection.Patch.
+func (db *DB) Patch(ctx context.Context, id string, ops []PatchOperation) (uint64, error) {
+	return db.def.Patch(ctx, id, ops)
+}
+
+// MergePatch applies a JSON Merge Patch to a document of the default
+// collection. See Collection.MergePatch.
+func (db *DB) MergePatch(ctx context.Context, id string, patch map[string]any) (uint64, error) {
+	return db.def.MergePatch(ctx, id, patch)
+}
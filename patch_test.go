@@ -0,0 +1,258 @@
+package docdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_applyPatch(t *testing.T) {
+	tests := []struct {
+		document map[string]any
+		ops      []PatchOperation
+		expected map[string]any
+		err      string
+	}{
+		{
+			map[string]any{"foo": "bar"},
+			[]PatchOperation{{Op: "add", Path: "/baz", Value: "qux"}},
+			map[string]any{"foo": "bar", "baz": "qux"}, "",
+		},
+		{
+			map[string]any{"foo": []any{"bar", "baz"}},
+			[]PatchOperation{{Op: "add", Path: "/foo/1", Value: "qux"}, {Op: "add", Path: "/foo/-", Value: "end"}},
+			map[string]any{"foo": []any{"bar", "qux", "baz", "end"}}, "",
+		},
+		{
+			map[string]any{"foo": []any{"bar", "qux", "baz"}, "a": "b"},
+			[]PatchOperation{{Op: "remove", Path: "/foo/1"}, {Op: "remove", Path: "/a"}},
+			map[string]any{"foo": []any{"bar", "baz"}}, "",
+		},
+		{
+			map[string]any{"a/b": map[string]any{"m~n": float64(1)}},
+			[]PatchOperation{{Op: "replace", Path: "/a~1b/m~0n", Value: float64(2)}},
+			map[string]any{"a/b": map[string]any{"m~n": float64(2)}}, "",
+		},
+		{
+			map[string]any{"foo": map[string]any{"bar": "baz", "waldo": "fred"}, "qux": map[string]any{"corge": "grault"}},
+			[]PatchOperation{{Op: "move", From: "/foo/waldo", Path: "/qux/thud"}},
+			map[string]any{"foo": map[string]any{"bar": "baz"}, "qux": map[string]any{"corge": "grault", "thud": "fred"}}, "",
+		},
+		{
+			map[string]any{"tags": []any{"a", "b"}},
+			[]PatchOperation{{Op: "copy", From: "/tags", Path: "/old"}, {Op: "add", Path: "/tags/0", Value: "z"}},
+			map[string]any{"tags": []any{"z", "a", "b"}, "old": []any{"a", "b"}}, "",
+		},
+		{
+			map[string]any{"n": float64(1), "list": []any{float64(1), "x"}},
+			[]PatchOperation{{Op: "test", Path: "/n", Value: 1}, {Op: "test", Path: "/list", Value: []any{1, "x"}}},
+			map[string]any{"n": float64(1), "list": []any{float64(1), "x"}}, "",
+		},
+		{
+			map[string]any{"n": float64(1)},
+			[]PatchOperation{{Op: "replace", Path: "/n", Value: float64(2)}, {Op: "test", Path: "/n", Value: float64(1)}},
+			nil, "Patch operation 1: Test failed",
+		},
+		{map[string]any{}, []PatchOperation{{Op: "replace", Path: "/missing", Value: true}}, nil, `No member "missing"`},
+		{map[string]any{}, []PatchOperation{{Op: "add", Path: "/a/b", Value: true}}, nil, `No member "a"`},
+		{map[string]any{"l": []any{}}, []PatchOperation{{Op: "add", Path: "/l/1", Value: true}}, nil, "out of range"},
+		{map[string]any{"l": []any{"x"}}, []PatchOperation{{Op: "remove", Path: "/l/01"}}, nil, "out of range"},
+		{map[string]any{"a": map[string]any{}}, []PatchOperation{{Op: "move", From: "/a", Path: "/a/b"}}, nil, "into itself"},
+		{map[string]any{}, []PatchOperation{{Op: "add", Path: "a", Value: true}}, nil, "Bad JSON pointer"},
+		{map[string]any{}, []PatchOperation{{Op: "merge", Path: "/a"}}, nil, `Unknown op "merge"`},
+		{map[string]any{}, []PatchOperation{{Op: "replace", Path: "", Value: "x"}}, nil, "must be JSON objects"},
+		{map[string]any{}, []PatchOperation{{Op: "replace", Path: "", Value: map[string]any{"a": true}}}, map[string]any{"a": true}, ""},
+	}
+	for _, test := range tests {
+		patched, err := applyPatch(test.document, test.ops)
+		if test.err == "" {
+			assert.Nil(t, err, "%v", test.ops)
+			assert.Equal(t, test.expected, patched, "%v", test.ops)
+		} else if assert.Error(t, err, "%v", test.ops) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func Test_mergePatch(t *testing.T) {
+	// The examples of RFC 7386
+	tests := []struct {
+		target, patch, expected any
+	}{
+		{map[string]any{"a": "b"}, map[string]any{"a": "c"}, map[string]any{"a": "c"}},
+		{map[string]any{"a": "b"}, map[string]any{"b": "c"}, map[string]any{"a": "b", "b": "c"}},
+		{map[string]any{"a": "b"}, map[string]any{"a": nil}, map[string]any{}},
+		{map[string]any{"a": "b", "b": "c"}, map[string]any{"a": nil}, map[string]any{"b": "c"}},
+		{map[string]any{"a": []any{"b"}}, map[string]any{"a": "c"}, map[string]any{"a": "c"}},
+		{map[string]any{"a": "c"}, map[string]any{"a": []any{"b"}}, map[string]any{"a": []any{"b"}}},
+		{
+			map[string]any{"a": map[string]any{"b": "c"}},
+			map[string]any{"a": map[string]any{"b": "d", "c": nil}},
+			map[string]any{"a": map[string]any{"b": "d"}},
+		},
+		{map[string]any{"a": []any{map[string]any{"b": "c"}}}, map[string]any{"a": []any{float64(1)}}, map[string]any{"a": []any{float64(1)}}},
+		{map[string]any{"e": nil}, map[string]any{"a": float64(1)}, map[string]any{"e": nil, "a": float64(1)}},
+		{"string", map[string]any{"a": "b"}, map[string]any{"a": "b"}},
+		{map[string]any{}, map[string]any{"a": map[string]any{"bb": map[string]any{"ccc": nil}}}, map[string]any{"a": map[string]any{"bb": map[string]any{}}}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, mergePatch(test.target, test.patch), "%v", test.patch)
+	}
+}
+
+func Test_changedPaths(t *testing.T) {
+	a := map[string]any{"name": "Kate", "age": float64(30), "address": map[string]any{"city": "Oslo", "zip": "0150"}, "tags": []any{"a"}, "same": true}
+	b := map[string]any{"name": "Kate", "age": 31, "address": map[string]any{"city": "Bergen", "zip": "0150"}, "tags": []any{"a", "b"}, "new": nil, "same": true}
+	paths := changedPaths(a, b, "")
+	sort.Strings(paths)
+	assert.Equal(t, []string{"address.city", "age", "new", "tags"}, paths)
+}
+
+func Test_patchDocument(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(&Options{FullText: []string{"bio"}, Geo: []string{"home"}})
+	if err != nil {
+		assert.FailNow(t, "Could not open database")
+	}
+	defer db.Close()
+	_, err = db.Put(ctx, "kate", map[string]any{
+		"name": "Kate", "age": float64(30), "bio": "writes databases",
+		"home":    map[string]any{"lat": 59.9, "lon": 10.7},
+		"address": map[string]any{"city": "Oslo", "zip": "0150"},
+	})
+	assert.Nil(t, err)
+
+	rev, err := db.Patch(ctx, "kate", []PatchOperation{
+		{Op: "test", Path: "/age", Value: 30},
+		{Op: "replace", Path: "/age", Value: 31},
+		{Op: "replace", Path: "/address/city", Value: "Bergen"},
+		{Op: "replace", Path: "/bio", Value: "reads papers"},
+		{Op: "replace", Path: "/home/lat", Value: 60.4},
+		{Op: "add", Path: "/_expires", Value: "2100-01-01T00:00:00Z"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), rev)
+
+	queries := map[string]int{
+		"age:31": 1, "age:30": 0, "address.city:Bergen": 1, "address.city:Oslo": 0,
+		"address.zip:0150": 1, "name:Kate": 1, `bio:~"papers"`: 1, `bio:~"databases"`: 0,
+		"home:@box(60,10,61,11)": 1, "home:@box(59,10,59.95,11)": 0,
+	}
+	for query, n := range queries {
+		docs, err := db.Find(ctx, query)
+		assert.Nil(t, err, query)
+		assert.Equal(t, n, len(docs), query)
+	}
+	ids, err := db.s.expiredIDs(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"kate"}, ids)
+	report, err := db.s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, report.ok())
+
+	rev, err = db.MergePatch(ctx, "kate", map[string]any{"address": nil, "_expires": nil, "pets": map[string]any{"cat": "Tom"}})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), rev)
+	doc, err := db.Get(ctx, "kate")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{
+		"name": "Kate", "age": float64(31), "bio": "reads papers",
+		"home": map[string]any{"lat": 60.4, "lon": 10.7}, "pets": map[string]any{"cat": "Tom"},
+	}, doc.Body)
+	docs, err := db.Find(ctx, "address.zip:0150")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(docs))
+	docs, err = db.Find(ctx, "pets.cat:Tom")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+	report, err = db.s.checkIndex(false)
+	assert.Nil(t, err)
+	assert.True(t, report.ok())
+
+	// Failed patches write nothing
+	_, err = db.Patch(ctx, "kate", []PatchOperation{
+		{Op: "replace", Path: "/age", Value: 32},
+		{Op: "test", Path: "/name", Value: "Phil"},
+	})
+	assert.True(t, errors.Is(err, errPatchTestFailed))
+	_, err = db.def.PatchIf(ctx, "kate", []PatchOperation{{Op: "remove", Path: "/age"}}, 2)
+	assert.Equal(t, ErrConflict, err)
+	_, err = db.MergePatch(ctx, "missing", map[string]any{"a": true})
+	assert.Equal(t, ErrNotFound, err)
+	doc, _ = db.Get(ctx, "kate")
+	assert.Equal(t, uint64(3), doc.Rev)
+	assert.Equal(t, float64(31), doc.Body["age"])
+
+	changes, err := db.s.changesSince(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(changes))
+}
+
+func Test_patchSchema(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open database")
+	}
+	defer db.Close()
+	db.Put(ctx, "kate", map[string]any{"age": float64(30)})
+	assert.Nil(t, db.SetSchema(map[string]any{"properties": map[string]any{"age": map[string]any{"type": "integer"}}}))
+
+	_, err = db.MergePatch(ctx, "kate", map[string]any{"age": "old"})
+	var validationErr *ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	doc, _ := db.Get(ctx, "kate")
+	assert.Equal(t, float64(30), doc.Body["age"])
+}
+
+func Test_httpPatch(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("kate", map[string]any{"name": "Kate", "age": float64(30)})
+	jsonPatch := map[string]string{"Content-Type": "application/json-patch+json"}
+	mergePatch := map[string]string{"Content-Type": "application/merge-patch+json"}
+
+	resp, body := doRequest(t, s, "PATCH", "/docs/kate", `[{"op": "replace", "path": "/age", "value": 31}]`, jsonPatch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+	assert.Equal(t, float64(2), body["body"].(map[string]any)["rev"])
+
+	resp, _ = doRequest(t, s, "PATCH", "/docs/kate", `{"age": null, "city": "Oslo"}`,
+		map[string]string{"Content-Type": "application/merge-patch+json; charset=utf-8", "If-Match": `"2"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	document, err := s.getDocumentById([]byte("kate"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{"name": "Kate", "city": "Oslo"}, document)
+
+	resp, _ = doRequest(t, s, "PATCH", "/docs/kate", `{"age": 1}`,
+		map[string]string{"Content-Type": "application/merge-patch+json", "If-Match": `"2"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PATCH", "/docs/kate", `[{"op": "test", "path": "/name", "value": "Phil"}]`, jsonPatch)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, body = doRequest(t, s, "PATCH", "/docs/kate", `[{"op": "remove", "path": "/age"}]`, jsonPatch)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, `Patch operation 0: No member "age"`, body["error"])
+	resp, _ = doRequest(t, s, "PATCH", "/docs/kate", `{"op": "add"}`, jsonPatch)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PATCH", "/docs/kate", `{"age": 1}`, nil)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Accept-Patch"), "application/merge-patch+json")
+	resp, _ = doRequest(t, s, "PATCH", "/docs/phil", `{"age": 1}`, mergePatch)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, s, "PUT", "/collections/c", `{}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/collections/c/docs/a", `{"n": 1}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PATCH", "/collections/c/docs/a", `{"n": 2}`, mergePatch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body = doRequest(t, s, "GET", "/collections/c/docs/a", "", nil)
+	assert.Equal(t, float64(2), body["body"].(map[string]any)["n"])
+}
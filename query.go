@@ -1,12 +1,16 @@
-package main
+package docdb
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/cockroachdb/pebble"
+	"time"
 )
 
 type queryComparison struct {
@@ -19,8 +23,319 @@ type query struct {
 	ands []queryComparison
 }
 
+// parseQuery parses q into a query. A query is a whitespace separated
+// list of comparisons, all of which must match a document:
+//
+//	name:"Kevin" age:>40 a.b:<3 description:~"fast database"
+//
+// The operator follows the colon: none for equality, > and < for
+// ranges and ~ for full-text. Bare values are parsed as JSON literals
+// where possible, so 40 is a number and true is a boolean, whereas
+// "40" is a string.
+//
+// String values can also be matched by pattern. A bare value
+// containing * or ? is a wildcard (Kev*, K?vin), and a value within
+// slashes is a regular expression that must match the whole string
+// (/K.v+n/).
+//
+// Bare RFC 3339 timestamps, such as 2024-01-01T00:00:00Z, and times
+// relative to now, such as now-7d, are parsed as instants. At
+// timestamp paths (see indexConfig.timestamps) they're looked up as
+// instants, and elsewhere as the strings they were written as.
+//
+// Paths in the geo index are queried with a bounding box or radius:
+//
+//	location:@box(minLat,minLon,maxLat,maxLon)
+//	location:@radius(lat,lon,10km)
+func parseQuery(q string) (*query, error) {
+	parsed := &query{}
+	i := 0
+	for {
+		for i < len(q) && strings.IndexByte(" \t\r\n", q[i]) >= 0 {
+			i++
+		}
+		if i >= len(q) {
+			break
+		}
+
+		colon := strings.IndexByte(q[i:], ':')
+		if colon <= 0 || strings.ContainsAny(q[i:i+colon], " \t\r\n\"") {
+			return nil, errors.New(
+				fmt.Sprintf("Expected path followed by : at %d in %q", i, q),
+			)
+		}
+		path := q[i : i+colon]
+		i += colon + 1
+
+		op := "="
+		if i < len(q) && strings.IndexByte("<>~", q[i]) >= 0 {
+			op = q[i : i+1]
+			i++
+		}
+
+		var value any
+		var n int
+		var err error
+		if op == "=" && i < len(q) && q[i] == '/' {
+			op = "regex"
+			value, n, err = parseQueryRegex(q[i:])
+		} else if op == "=" && i < len(q) && q[i] == '@' {
+			op, value, n, err = parseQueryGeo(q[i:])
+		} else {
+			value, n, err = parseQueryValue(q[i:])
+			if s, ok := value.(string); ok && op == "=" && q[i] != '"' {
+				op = wildcardOp(s)
+			}
+		}
+		if err != nil {
+			return nil, errors.New(
+				fmt.Sprintf("Bad value for %s at %d in %q: %v", path, i, q, err),
+			)
+		}
+		i += n
+
+		parsed.ands = append(parsed.ands, queryComparison{
+			key:   strings.Split(path, "."),
+			value: value,
+			op:    op,
+		})
+	}
+
+	if len(parsed.ands) == 0 {
+		return nil, errors.New("Empty query")
+	}
+	return parsed, nil
+}
+
+// parseQueryValue parses the value at the start of s, returning it and
+// the number of bytes of s it used.
+func parseQueryValue(s string) (any, int, error) {
+	if s == "" || strings.IndexByte(" \t\r\n", s[0]) >= 0 {
+		return nil, 0, errors.New("Expected value")
+	}
+
+	if s[0] == '"' {
+		var sb strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				sb.WriteByte(s[i])
+				continue
+			}
+			if s[i] == '"' {
+				return sb.String(), i + 1, nil
+			}
+			sb.WriteByte(s[i])
+		}
+		return nil, 0, errors.New("Unterminated string")
+	}
+
+	end := strings.IndexAny(s, " \t\r\n")
+	if end < 0 {
+		end = len(s)
+	}
+	token := s[:end]
+
+	var v any
+	if err := json.Unmarshal([]byte(token), &v); err == nil {
+		switch v.(type) {
+		case nil, bool, float64:
+			return v, end, nil
+		}
+	}
+	if t, ok := parseTimestamp(token); ok {
+		return queryTime{token, t}, end, nil
+	}
+	if t, ok := parseRelativeTime(token, time.Now()); ok {
+		return queryTime{token, t}, end, nil
+	}
+	return token, end, nil
+}
+
+// queryTime is a bare query value that's a time, which is only looked
+// up as one at timestamp paths.
+type queryTime struct {
+	token string
+	t     time.Time
+}
+
+// lookupValue returns value as it's looked up at path: the instant of
+// a queryTime at a timestamp path, or its token elsewhere, and other
+// values as they are.
+func lookupValue(cfg *indexConfig, path string, value any) any {
+	qt, ok := value.(queryTime)
+	if !ok {
+		return value
+	}
+	if cfg.isTimestamp([]byte(path)) {
+		return qt.t
+	}
+	return qt.token
+}
+
+// relativeTimeUnits are the units for parseRelativeTime.
+var relativeTimeUnits = map[byte]time.Duration{
+	's': time.Second,
+	'm': time.Minute,
+	'h': time.Hour,
+	'd': 24 * time.Hour,
+	'w': 7 * 24 * time.Hour,
+}
+
+// parseRelativeTime returns the time s refers to relative to now. s is
+// "now", optionally followed by a signed whole number of units, for
+// example now-7d or now+1h. Units are s, m, h, d and w.
+func parseRelativeTime(s string, now time.Time) (time.Time, bool) {
+	if !strings.HasPrefix(s, "now") {
+		return time.Time{}, false
+	}
+	offset := s[len("now"):]
+	if offset == "" {
+		return now, true
+	}
+	if len(offset) < 3 || (offset[0] != '+' && offset[0] != '-') {
+		return time.Time{}, false
+	}
+
+	unit, ok := relativeTimeUnits[offset[len(offset)-1]]
+	if !ok {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseUint(offset[1:len(offset)-1], 10, 32)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	d := time.Duration(n) * unit
+	if offset[0] == '-' {
+		d = -d
+	}
+	return now.Add(d), true
+}
+
+// parseQueryRegex parses the slash delimited regular expression at
+// the start of s, returning its source and the number of bytes of s
+// it used. Slashes within the expression are escaped as \/.
+func parseQueryRegex(s string) (any, int, error) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == '/' {
+			i++
+			sb.WriteByte('/')
+			continue
+		}
+		if s[i] == '/' {
+			if _, err := regexp.Compile(sb.String()); err != nil {
+				return nil, 0, err
+			}
+			return sb.String(), i + 1, nil
+		}
+		sb.WriteByte(s[i])
+	}
+	return nil, 0, errors.New("Unterminated regular expression")
+}
+
+// parseQueryGeo parses the geo function at the start of s, returning
+// its op, its value and the number of bytes of s it used.
+func parseQueryGeo(s string) (string, any, int, error) {
+	lparen := strings.IndexByte(s, '(')
+	rparen := strings.IndexByte(s, ')')
+	if lparen < 0 || rparen < lparen {
+		return "", nil, 0, errors.New("Expected @function(arguments)")
+	}
+	name := s[1:lparen]
+	args := strings.Split(s[lparen+1:rparen], ",")
+
+	nums := make([]float64, len(args))
+	for i, arg := range args {
+		arg = strings.TrimSpace(arg)
+		multiplier := 1.0
+		if name == "radius" && i == 2 {
+			if strings.HasSuffix(arg, "km") {
+				arg, multiplier = arg[:len(arg)-2], 1000
+			} else if strings.HasSuffix(arg, "m") {
+				arg = arg[:len(arg)-1]
+			}
+		}
+		var err error
+		nums[i], err = strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "", nil, 0, errors.New(
+				fmt.Sprintf("Bad argument %q to @%s", args[i], name))
+		}
+		nums[i] *= multiplier
+	}
+
+	switch {
+	case name == "box" && len(nums) == 4:
+		for _, p := range []geoPoint{{nums[0], nums[1]}, {nums[2], nums[3]}} {
+			if err := checkGeoPoint(name, p); err != nil {
+				return "", nil, 0, err
+			}
+		}
+		return "geo_box", geoBox{nums[0], nums[1], nums[2], nums[3]}, rparen + 1, nil
+	case name == "radius" && len(nums) == 3:
+		center := geoPoint{nums[0], nums[1]}
+		if err := checkGeoPoint(name, center); err != nil {
+			return "", nil, 0, err
+		}
+		if !(nums[2] > 0) || math.IsInf(nums[2], 1) {
+			return "", nil, 0, errors.New(
+				fmt.Sprintf("Radius %q of @radius must be greater than 0", strings.TrimSpace(args[2])))
+		}
+		return "geo_radius", geoCircle{center, nums[2]}, rparen + 1, nil
+	}
+	return "", nil, 0, errors.New(
+		fmt.Sprintf("Unrecognised @%s with %d arguments", name, len(nums)))
+}
+
+// checkGeoPoint returns an error if p, an argument of the geo
+// function name, isn't a latitude from -90 to 90 and a longitude
+// from -180 to 180.
+func checkGeoPoint(name string, p geoPoint) error {
+	if !(p.lat >= -90 && p.lat <= 90) {
+		return errors.New(fmt.Sprintf("Latitude %v of @%s must be from -90 to 90", p.lat, name))
+	}
+	if !(p.lon >= -180 && p.lon <= 180) {
+		return errors.New(fmt.Sprintf("Longitude %v of @%s must be from -180 to 180", p.lon, name))
+	}
+	return nil
+}
+
+// wildcardOp returns the op to use for the bare string value s: "=" if
+// s has no wildcards, "prefix" if its only wildcard is a trailing *,
+// otherwise "wildcard".
+func wildcardOp(s string) string {
+	i := strings.IndexAny(s, "*?")
+	if i < 0 {
+		return "="
+	}
+	if i == len(s)-1 && s[i] == '*' {
+		return "prefix"
+	}
+	return "wildcard"
+}
+
+// wildcardToRegex returns the regular expression source equivalent to
+// the wildcard pattern, where * matches any run of characters and ?
+// any single character.
+func wildcardToRegex(pattern string) string {
+	var sb strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
 // searchIndex returns IDs matching q.
-func searchIndex(indexDb *pebble.DB, q *query) ([]string, error) {
+func searchIndex(indexDb KVReader, cfg *indexConfig, q *query) ([]string, error) {
 	idsArgumentCount := map[string]int{}
 	indexLookupCount := 0
 
@@ -30,11 +345,31 @@ func searchIndex(indexDb *pebble.DB, q *query) ([]string, error) {
 		var ids []string
 		var err error
 		if argument.op == "=" {
-			ids, err = lookupEq(indexDb, dottedPath, argument.value)
+			ids, err = lookupEq(indexDb, cfg, dottedPath, argument.value)
 		} else if argument.op == ">" {
-			ids, err = lookupGT(indexDb, dottedPath, argument.value)
+			ids, err = lookupGT(indexDb, cfg, dottedPath, argument.value)
 		} else if argument.op == "<" {
-			ids, err = lookupLT(indexDb, dottedPath, argument.value)
+			ids, err = lookupLT(indexDb, cfg, dottedPath, argument.value)
+		} else if argument.op == "~" {
+			text, ok := argument.value.(string)
+			if !ok {
+				return nil, errors.New(
+					fmt.Sprintf("Full-text query on %s requires a string", dottedPath),
+				)
+			}
+			ids, err = lookupText(indexDb, dottedPath, text)
+		} else if argument.op == "prefix" {
+			pattern := argument.value.(string)
+			ids, err = lookupPrefix(indexDb, cfg, dottedPath, pattern[:len(pattern)-1])
+		} else if argument.op == "wildcard" {
+			ids, err = lookupRegex(
+				indexDb, cfg, dottedPath, wildcardToRegex(argument.value.(string)))
+		} else if argument.op == "regex" {
+			ids, err = lookupRegex(indexDb, cfg, dottedPath, argument.value.(string))
+		} else if argument.op == "geo_box" {
+			ids, err = lookupGeoBox(indexDb, dottedPath, argument.value.(geoBox))
+		} else if argument.op == "geo_radius" {
+			ids, err = lookupGeoRadius(indexDb, dottedPath, argument.value.(geoCircle))
 		} else {
 			return nil, errors.New(
 				fmt.Sprintf("Unrecognised op %s in query %v", argument.op, q),
@@ -43,7 +378,7 @@ func searchIndex(indexDb *pebble.DB, q *query) ([]string, error) {
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("op %s ids: %v", argument.op, ids)
+		// fmt.Printf("op %s ids: %v", argument.op, ids)
 
 		indexLookupCount += 1
 
@@ -67,13 +402,13 @@ func searchIndex(indexDb *pebble.DB, q *query) ([]string, error) {
 	return idsInAll, nil
 }
 
-func lookupEq(indexDb *pebble.DB, path string, value interface{}) ([]string, error) {
+func lookupEq(indexDb KVReader, cfg *indexConfig, path string, value interface{}) ([]string, error) {
 	ids := []string{}
-	startKey := pathValueStartKey(path, value)
-	endKey := pathValueEndKey(path, value)
+	startKey := pathValueStartKey(cfg, path, value)
+	endKey := pathValueEndKey(cfg, path, value)
 
-	readOptions := &pebble.IterOptions{LowerBound: startKey, UpperBound: endKey}
-	fmt.Printf("greaterThan: %+v\n", readOptions)
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	// fmt.Printf("greaterThan: %+v\n", readOptions)
 
 	iter := indexDb.NewIter(readOptions)
 	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
@@ -89,13 +424,13 @@ func lookupEq(indexDb *pebble.DB, path string, value interface{}) ([]string, err
 	return ids, iter.Close()
 }
 
-func lookupGTE(indexDb *pebble.DB, path string, value interface{}) ([]string, error) {
+func lookupGTE(indexDb KVReader, cfg *indexConfig, path string, value interface{}) ([]string, error) {
 	ids := []string{}
-	startKey := pathValueStartKey(path, value)
+	startKey := pathValueStartKey(cfg, path, value)
 	endKey := pathEndKey(path)
 
-	readOptions := &pebble.IterOptions{LowerBound: startKey, UpperBound: endKey}
-	fmt.Printf("greaterThan: %+v\n", readOptions)
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	// fmt.Printf("greaterThan: %+v\n", readOptions)
 
 	iter := indexDb.NewIter(readOptions)
 	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
@@ -110,13 +445,13 @@ func lookupGTE(indexDb *pebble.DB, path string, value interface{}) ([]string, er
 	return ids, iter.Close()
 }
 
-func lookupGT(indexDb *pebble.DB, path string, value interface{}) ([]string, error) {
+func lookupGT(indexDb KVReader, cfg *indexConfig, path string, value interface{}) ([]string, error) {
 	ids := []string{}
-	startKey := pathValueEndKey(path, value)
+	startKey := pathValueEndKey(cfg, path, value)
 	endKey := pathEndKey(path)
 
-	readOptions := &pebble.IterOptions{LowerBound: startKey, UpperBound: endKey}
-	fmt.Printf("greaterThan: %+v\n", readOptions)
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	// fmt.Printf("greaterThan: %+v\n", readOptions)
 
 	iter := indexDb.NewIter(readOptions)
 	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
@@ -131,14 +466,14 @@ func lookupGT(indexDb *pebble.DB, path string, value interface{}) ([]string, err
 	return ids, iter.Close()
 }
 
-func lookupLT(indexDb *pebble.DB, path string, value interface{}) ([]string, error) {
+func lookupLT(indexDb KVReader, cfg *indexConfig, path string, value interface{}) ([]string, error) {
 	// We could use iter.Prev() to get the descending ordering
 	ids := []string{}
 	startKey := pathStartKey(path)
-	endKey := pathValueStartKey(path, value) // As less-than, stop at the first key for the path, value
+	endKey := pathValueStartKey(cfg, path, value) // As less-than, stop at the first key for the path, value
 
-	readOptions := &pebble.IterOptions{LowerBound: startKey, UpperBound: endKey}
-	fmt.Printf("lessThan: %+v\n", readOptions)
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	// fmt.Printf("lessThan: %+v\n", readOptions)
 
 	iter := indexDb.NewIter(readOptions)
 	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
@@ -153,14 +488,14 @@ func lookupLT(indexDb *pebble.DB, path string, value interface{}) ([]string, err
 	return ids, iter.Close()
 }
 
-func lookupLTE(indexDb *pebble.DB, path string, value interface{}) ([]string, error) {
+func lookupLTE(indexDb KVReader, cfg *indexConfig, path string, value interface{}) ([]string, error) {
 	// We could use iter.Prev() to get the descending ordering
 	ids := []string{}
 	startKey := pathStartKey(path)
-	endKey := pathValueEndKey(path, value)
+	endKey := pathValueEndKey(cfg, path, value)
 
-	readOptions := &pebble.IterOptions{LowerBound: startKey, UpperBound: endKey}
-	fmt.Printf("lessThan: %+v\n", readOptions)
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	// fmt.Printf("lessThan: %+v\n", readOptions)
 
 	iter := indexDb.NewIter(readOptions)
 	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
@@ -175,6 +510,90 @@ func lookupLTE(indexDb *pebble.DB, path string, value interface{}) ([]string, er
 	return ids, iter.Close()
 }
 
+// lookupPrefix returns IDs of documents with a string value at path
+// that starts with prefix. As strings sort lexically, this is a range
+// scan of the strings between prefix and the next possible prefix.
+func lookupPrefix(indexDb KVReader, cfg *indexConfig, path string, prefix string) ([]string, error) {
+	match := func([]byte) bool { return true }
+	if cfg.stringCollation() == collationUnicode {
+		match = func(value []byte) bool {
+			return bytes.HasPrefix(value, []byte(prefix))
+		}
+	}
+	return scanStrings(indexDb, cfg, path, prefix, match)
+}
+
+// lookupRegex returns IDs of documents with a string value at path
+// that the regular expression expr matches in full. The literal
+// prefix of expr, if any, bounds the range of strings scanned;
+// each string in that range is then checked against expr. For
+// collationFold, expr matches case-insensitively, as prefixes do.
+func lookupRegex(indexDb KVReader, cfg *indexConfig, path string, expr string) ([]string, error) {
+	unanchored, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	flags := ""
+	if cfg.stringCollation() == collationFold {
+		flags = "(?i)"
+	}
+	re := regexp.MustCompile(flags + "^(?:" + expr + ")$")
+	prefix, _ := unanchored.LiteralPrefix()
+
+	return scanStrings(indexDb, cfg, path, prefix, re.Match)
+}
+
+// scanStrings returns IDs of documents with a string value at path
+// that starts with prefix and for which match returns true. match is
+// passed the original value of the string, before collation.
+//
+// The scan is bounded by the collation key of prefix, so for
+// collationFold strings starting with any case of prefix are passed
+// to match. For collationUnicode, collation keys for prefixes are not
+// prefixes of the keys for longer strings, so every string at path is
+// passed to match.
+func scanStrings(indexDb KVReader, cfg *indexConfig, path string, prefix string, match func([]byte) bool) ([]string, error) {
+	ids := []string{}
+	var startKey []byte
+	if cfg.stringCollation() == collationUnicode {
+		startKey = pathValueStartKey(nil, path, "")
+	} else {
+		startKey = pathValueStartKey(cfg, path, prefix)
+	}
+	endKey := prefixEndKey(startKey)
+
+	readOptions := &IterOptions{LowerBound: startKey, UpperBound: endKey}
+	iter := indexDb.NewIter(readOptions)
+	for iter.SeekGE(startKey); iter.Valid(); iter.Next() {
+		id, err := decodeInvIndexKey(iter.Key())
+		if err != nil {
+			log.Printf("Bad inverted index key found %v: %v", iter.Key(), err)
+			continue
+		}
+		value := id.TaggedValue[1:]
+		if len(iter.Value()) > 0 {
+			value = iter.Value()
+		}
+		if match(value) {
+			ids = append(ids, string(id.DocID))
+		}
+	}
+	return ids, iter.Close()
+}
+
+// prefixEndKey returns the smallest key greater than every key that
+// starts with prefix.
+func prefixEndKey(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil // Every byte was 0xff, no upper bound
+}
+
 // pathStartKey returns a key that at the lower bound that
 // path could have.
 func pathStartKey(path string) []byte {
@@ -198,16 +617,18 @@ func pathEndKey(path string) []byte {
 
 // pathValueStartKey returns the key at the lower bound of keys
 // for path and value.
-func pathValueStartKey(path string, value interface{}) []byte {
-	return encodeInvIdxKey([]byte(path), encodeTaggedValue(value), nil)
+func pathValueStartKey(cfg *indexConfig, path string, value interface{}) []byte {
+	value = lookupValue(cfg, path, value)
+	taggedValue := collateTaggedValue(encodeTaggedValue(value), cfg.stringCollation())
+	return encodeInvIdxKey([]byte(path), taggedValue, nil)
 }
 
 // pathValueEndKey returns a key just beyond the end of the path-value
 // range.
-func pathValueEndKey(path string, value interface{}) []byte {
+func pathValueEndKey(cfg *indexConfig, path string, value interface{}) []byte {
 	// Similar to pathEndKey, we use the fact that there's
 	// a zero separator between the path value key and the
 	// doc ID to generate an upper bound.
-	k := encodeInvIdxKey([]byte(path), encodeTaggedValue(value), nil)
+	k := pathValueStartKey(cfg, path, value)
 	return append(k, 1)
 }
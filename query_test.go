@@ -1,30 +1,29 @@
-package main
+package docdb
 
 import (
 	"testing"
+	"time"
 
-	"github.com/cockroachdb/pebble"
 	"github.com/stretchr/testify/assert"
 )
 
 func Test_searchIndex(t *testing.T) {
-	d := t.TempDir()
-	db, _ := pebble.Open(d, &pebble.Options{})
-	index(db, "doc1", map[string]any{
+	db := NewMemoryKV()
+	index(db, nil, "doc1", map[string]any{
 		"a": map[string]any{
 			"b": 1,
 		},
 		"name": "mike",
 		"age":  40,
 	})
-	index(db, "doc2", map[string]any{
+	index(db, nil, "doc2", map[string]any{
 		"a": map[string]any{
 			"c": 2,
 		},
 		"name": "john",
 		"age":  24,
 	})
-	index(db, "doc3", map[string]any{
+	index(db, nil, "doc3", map[string]any{
 		"a": map[string]any{
 			"c": 2,
 		},
@@ -37,7 +36,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"name"}, "john", "="},
 		},
 	}
-	ids, err := searchIndex(db, q)
+	ids, err := searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -48,7 +47,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"age"}, 20, ">"},
 		},
 	}
-	ids, err = searchIndex(db, q)
+	ids, err = searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -59,7 +58,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"age"}, 24, ">"},
 		},
 	}
-	ids, err = searchIndex(db, q)
+	ids, err = searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -70,7 +69,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"age"}, 25, ">"},
 		},
 	}
-	ids, err = searchIndex(db, q)
+	ids, err = searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -81,7 +80,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"age"}, 120, ">"},
 		},
 	}
-	ids, err = searchIndex(db, q)
+	ids, err = searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -93,7 +92,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"name"}, "john", "="},
 		},
 	}
-	ids, err = searchIndex(db, q)
+	ids, err = searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -104,7 +103,7 @@ func Test_searchIndex(t *testing.T) {
 			{[]string{"nonexistentfield"}, 0, ">"},
 		},
 	}
-	ids, err = searchIndex(db, q)
+	ids, err = searchIndex(db, nil, q)
 	if err != nil {
 		t.Fatalf("Failed due to error: %v", err)
 	}
@@ -112,23 +111,22 @@ func Test_searchIndex(t *testing.T) {
 }
 
 func Test_searchIndexErrors(t *testing.T) {
-	d := t.TempDir()
-	db, _ := pebble.Open(d, &pebble.Options{})
-	index(db, "doc1", map[string]any{
+	db := NewMemoryKV()
+	index(db, nil, "doc1", map[string]any{
 		"a": map[string]any{
 			"b": 1,
 		},
 		"name": "mike",
 		"age":  40,
 	})
-	index(db, "doc2", map[string]any{
+	index(db, nil, "doc2", map[string]any{
 		"a": map[string]any{
 			"c": 2,
 		},
 		"name": "john",
 		"age":  24,
 	})
-	index(db, "doc3", map[string]any{
+	index(db, nil, "doc3", map[string]any{
 		"a": map[string]any{
 			"c": 2,
 		},
@@ -141,8 +139,286 @@ func Test_searchIndexErrors(t *testing.T) {
 			{[]string{"name"}, "john", "blah="},
 		},
 	}
-	_, err := searchIndex(db, q)
+	_, err := searchIndex(db, nil, q)
 	if err == nil {
 		t.Fatalf("Expected error but didn't get one: %v", q)
 	}
 }
+
+func Test_parseQuery(t *testing.T) {
+	tests := []struct {
+		q        string
+		expected []queryComparison
+	}{
+		{`name:"Kevin"`, []queryComparison{
+			{[]string{"name"}, "Kevin", "="},
+		}},
+		{`age:>40 a.b:<3`, []queryComparison{
+			{[]string{"age"}, 40.0, ">"},
+			{[]string{"a", "b"}, 3.0, "<"},
+		}},
+		{`age:"40" active:true deleted:null name:Kevin`, []queryComparison{
+			{[]string{"age"}, "40", "="},
+			{[]string{"active"}, true, "="},
+			{[]string{"deleted"}, nil, "="},
+			{[]string{"name"}, "Kevin", "="},
+		}},
+		{`description:~"fast \"database\""  name:~Kevin`, []queryComparison{
+			{[]string{"description"}, `fast "database"`, "~"},
+			{[]string{"name"}, "Kevin", "~"},
+		}},
+		{`name:Kev* name:K?v*n name:"Kev*" name:/K.v+n/ path:/a\/b/`, []queryComparison{
+			{[]string{"name"}, "Kev*", "prefix"},
+			{[]string{"name"}, "K?v*n", "wildcard"},
+			{[]string{"name"}, "Kev*", "="},
+			{[]string{"name"}, "K.v+n", "regex"},
+			{[]string{"path"}, "a/b", "regex"},
+		}},
+		{`loc:@box(1,-2.5,3,4) loc:@radius(51.5, -0.12, 10km) loc:@radius(1,2,30)`, []queryComparison{
+			{[]string{"loc"}, geoBox{1, -2.5, 3, 4}, "geo_box"},
+			{[]string{"loc"}, geoCircle{geoPoint{51.5, -0.12}, 10000}, "geo_radius"},
+			{[]string{"loc"}, geoCircle{geoPoint{1, 2}, 30}, "geo_radius"},
+		}},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.q)
+		if err != nil {
+			t.Fatalf("Failed due to error: %v", err)
+		}
+		assert.Equal(t, test.expected, q.ands, test.q)
+	}
+
+	for _, bad := range []string{``, `name`, `name:`, `name:"Kevin`, `a b:1`, `name:/K(/`, `name:/Kev`, `loc:@box(1,2,3)`, `loc:@near(1,2,3)`, `loc:@radius(1,2,3mi)`} {
+		_, err := parseQuery(bad)
+		assert.Error(t, err, bad)
+	}
+
+	for _, bad := range []string{`loc:@box(-91,0,0,0)`, `loc:@box(0,0,0,180.5)`, `loc:@box(NaN,0,0,0)`, `loc:@radius(0,-181,1km)`, `loc:@radius(0,0,0)`, `loc:@radius(0,0,-5km)`, `loc:@radius(0,0,NaN)`, `loc:@radius(0,0,Inf)`} {
+		_, err := parseQuery(bad)
+		assert.Error(t, err, bad)
+	}
+	_, err := parseQuery(`loc:@radius(95,0,1km)`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Latitude 95 of @radius must be from -90 to 90")
+	}
+}
+
+func Test_lookupPattern(t *testing.T) {
+	db := NewMemoryKV()
+	index(db, nil, "kevin", map[string]any{"name": "Kevin"})
+	index(db, nil, "kevan", map[string]any{"name": "Kevan"})
+	index(db, nil, "kavvvn", map[string]any{"name": "Kavvvn"})
+	index(db, nil, "keith", map[string]any{"name": "Keith"})
+	index(db, nil, "number", map[string]any{"name": 12})
+	index(db, nil, "other", map[string]any{"other": "Kevin"})
+
+	ids, _ := lookupPrefix(db, nil, "name", "Kev")
+	assert.ElementsMatch(t, []string{"kevin", "kevan"}, ids)
+	ids, _ = lookupPrefix(db, nil, "name", "K")
+	assert.ElementsMatch(t, []string{"kevin", "kevan", "kavvvn", "keith"}, ids)
+	ids, _ = lookupPrefix(db, nil, "name", "")
+	assert.ElementsMatch(t, []string{"kevin", "kevan", "kavvvn", "keith"}, ids)
+	ids, _ = lookupPrefix(db, nil, "name", "Kevins")
+	assert.ElementsMatch(t, []string{}, ids)
+
+	ids, _ = lookupRegex(db, nil, "name", "K.v+n")
+	assert.ElementsMatch(t, []string{"kavvvn"}, ids)
+	ids, _ = lookupRegex(db, nil, "name", "Ke(v|i).*")
+	assert.ElementsMatch(t, []string{"kevin", "kevan", "keith"}, ids)
+	ids, _ = lookupRegex(db, nil, "name", "(?i)kevin")
+	assert.ElementsMatch(t, []string{"kevin"}, ids)
+	ids, _ = lookupRegex(db, nil, "name", "Kev")
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupRegex(db, nil, "name", wildcardToRegex("K?v*n"))
+	assert.ElementsMatch(t, []string{"kevin", "kevan", "kavvvn"}, ids)
+
+	q, _ := parseQuery(`name:Ke*`)
+	ids, err := searchIndex(db, nil, q)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.ElementsMatch(t, []string{"kevin", "kevan", "keith"}, ids)
+	q, _ = parseQuery(`name:K?v?n`)
+	ids, _ = searchIndex(db, nil, q)
+	assert.ElementsMatch(t, []string{"kevin", "kevan"}, ids)
+	q, _ = parseQuery(`name:/Kev[a-z]n/`)
+	ids, _ = searchIndex(db, nil, q)
+	assert.ElementsMatch(t, []string{"kevin", "kevan"}, ids)
+}
+
+func Test_lookupCollated(t *testing.T) {
+	names := map[string]string{
+		"apple":   "apple",
+		"Apple":   "Apple",
+		"APPLES":  "APPLES",
+		"banana":  "banana",
+		"Zed":     "Zed",
+		"elodie":  "Élodie",
+		"unicode": "Ünicode",
+	}
+
+	tests := []struct {
+		c          collation
+		eqApple    []string
+		ltBanana   []string
+		prefixAppl []string
+		regex      []string
+	}{
+		{
+			collationBinary,
+			[]string{"apple"},
+			[]string{"apple", "Apple", "APPLES", "Zed"},
+			[]string{"apple"},
+			[]string{"Apple", "APPLES"},
+		},
+		{
+			collationFold,
+			[]string{"apple", "Apple"},
+			[]string{"apple", "Apple", "APPLES"},
+			[]string{"apple", "Apple", "APPLES"},
+			[]string{"apple", "Apple", "APPLES"},
+		},
+		{
+			collationUnicode,
+			[]string{"apple"},
+			[]string{"apple", "Apple", "APPLES"},
+			[]string{"apple"},
+			[]string{"Apple", "APPLES"},
+		},
+	}
+
+	for _, test := range tests {
+		db := NewMemoryKV()
+		cfg := &indexConfig{collation: test.c}
+		for id, name := range names {
+			index(db, cfg, id, map[string]any{"name": name})
+		}
+
+		ids, _ := lookupEq(db, cfg, "name", "apple")
+		assert.ElementsMatch(t, test.eqApple, ids, "eq %d", test.c)
+		ids, _ = lookupLT(db, cfg, "name", "banana")
+		assert.ElementsMatch(t, test.ltBanana, ids, "lt %d", test.c)
+		ids, _ = lookupPrefix(db, cfg, "name", "appl")
+		assert.ElementsMatch(t, test.prefixAppl, ids, "prefix %d", test.c)
+		ids, _ = lookupRegex(db, cfg, "name", "A.*")
+		assert.ElementsMatch(t, test.regex, ids, "regex %d", test.c)
+		ids, _ = lookupRegex(db, cfg, "name", "Él.*")
+		assert.ElementsMatch(t, []string{"elodie"}, ids, "regex %d", test.c)
+
+		// Unindexing must find the collated keys
+		unindex(db, []byte("Apple"))
+		ids, _ = lookupRegex(db, cfg, "name", "A.*")
+		var unindexed []string
+		for _, id := range test.regex {
+			if id != "Apple" {
+				unindexed = append(unindexed, id)
+			}
+		}
+		assert.ElementsMatch(t, unindexed, ids, "unindex %d", test.c)
+	}
+}
+
+func Test_searchFolded(t *testing.T) {
+	db := NewMemoryKV()
+	cfg := &indexConfig{collation: collationFold}
+	index(db, cfg, "kevin", map[string]any{"name": "Kevin"})
+	index(db, cfg, "kevan", map[string]any{"name": "KEVAN"})
+	index(db, cfg, "keith", map[string]any{"name": "keith"})
+
+	// Prefix, wildcard and regex queries all ignore case
+	for _, query := range []string{"name:kev*", "name:kev?n", "name:/kev.n/", "name:/K[E]v.*/"} {
+		q, err := parseQuery(query)
+		if !assert.NoError(t, err, query) {
+			continue
+		}
+		ids, err := searchIndex(db, cfg, q)
+		assert.NoError(t, err, query)
+		assert.ElementsMatch(t, []string{"kevin", "kevan"}, ids, query)
+	}
+}
+
+func Test_parseRelativeTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s        string
+		expected time.Time
+		ok       bool
+	}{
+		{"now", now, true},
+		{"now-7d", now.Add(-7 * 24 * time.Hour), true},
+		{"now+1h", now.Add(time.Hour), true},
+		{"now-30m", now.Add(-30 * time.Minute), true},
+		{"now-2w", now.Add(-14 * 24 * time.Hour), true},
+		{"now-d", time.Time{}, false},
+		{"now-7y", time.Time{}, false},
+		{"now7d", time.Time{}, false},
+		{"nowhere", time.Time{}, false},
+		{"later", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, ok := parseRelativeTime(test.s, now)
+		assert.Equal(t, test.ok, ok, test.s)
+		assert.Equal(t, test.expected, got, test.s)
+	}
+
+	q, err := parseQuery(`created:>2024-01-01T00:00:00Z updated:>now-7d name:"now"`)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.Equal(t, queryTime{"2024-01-01T00:00:00Z", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}, q.ands[0].value)
+	assert.Equal(t, "now-7d", q.ands[1].value.(queryTime).token)
+	assert.WithinDuration(t, time.Now().Add(-7*24*time.Hour), q.ands[1].value.(queryTime).t, time.Minute)
+	assert.Equal(t, "now", q.ands[2].value)
+}
+
+func Test_lookupTimestamps(t *testing.T) {
+	db := NewMemoryKV()
+	cfg := &indexConfig{timestamps: []string{"created"}}
+	// Lexically these sort a, b, c, d, but in time d, c, a, b
+	index(db, cfg, "a", map[string]any{"created": "2024-01-01T10:00:00Z"})
+	index(db, cfg, "b", map[string]any{"created": "2024-01-01T10:00:00.5Z"})
+	index(db, cfg, "c", map[string]any{"created": "2024-01-01T10:00:00+01:00"})
+	index(db, cfg, "d", map[string]any{"created": "2024-01-01T11:00:00+05:00"})
+	index(db, cfg, "e", map[string]any{"created": "not a time"})
+	index(db, cfg, "f", map[string]any{"updated": "2024-01-01T10:00:00Z"})
+
+	at := func(s string) time.Time {
+		t, _ := parseTimestamp(s)
+		return t
+	}
+	ids, _ := lookupGT(db, cfg, "created", at("2024-01-01T10:00:00Z"))
+	assert.ElementsMatch(t, []string{"b"}, ids)
+	ids, _ = lookupLT(db, cfg, "created", at("2024-01-01T10:00:00Z"))
+	assert.ElementsMatch(t, []string{"c", "d", "e"}, ids)
+	ids, _ = lookupEq(db, cfg, "created", at("2024-01-01T09:00:00Z"))
+	assert.ElementsMatch(t, []string{"c"}, ids)
+	ids, _ = lookupEq(db, cfg, "created", "not a time")
+	assert.ElementsMatch(t, []string{"e"}, ids)
+
+	// Undeclared paths are strings
+	ids, _ = lookupEq(db, cfg, "updated", at("2024-01-01T10:00:00Z"))
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupEq(db, cfg, "updated", "2024-01-01T10:00:00Z")
+	assert.ElementsMatch(t, []string{"f"}, ids)
+
+	q, _ := parseQuery(`created:>2024-01-01T09:30:00+00:00`)
+	ids, _ = searchIndex(db, cfg, q)
+	assert.ElementsMatch(t, []string{"a", "b"}, ids)
+	q, _ = parseQuery(`created:<now`)
+	ids, _ = searchIndex(db, cfg, q)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e"}, ids)
+	// Elsewhere, bare timestamps are the strings they were before
+	q, _ = parseQuery(`updated:2024-01-01T10:00:00Z`)
+	ids, _ = searchIndex(db, cfg, q)
+	assert.ElementsMatch(t, []string{"f"}, ids)
+
+	// With detection, all timestamps are instants
+	cfg = &indexConfig{detectTimestamps: true}
+	index(db, cfg, "f", map[string]any{"updated": "2024-01-01T10:00:00Z"})
+	ids, _ = lookupEq(db, cfg, "updated", at("2024-01-01T10:00:00Z"))
+	assert.ElementsMatch(t, []string{"f"}, ids)
+	unindex(db, []byte("f"))
+	ids, _ = lookupEq(db, cfg, "updated", at("2024-01-01T10:00:00Z"))
+	assert.ElementsMatch(t, []string{}, ids)
+}
@@ -0,0 +1,461 @@
+package docdb
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// This file contains online reindexing.
+//
+// A reindex builds a complete new index, the shadow index, in its
+// own database next to the live one, while queries keep using the
+// live index. It walks primary data in key order, every collection
+// in one pass, a batch of documents at a time, holding writeMu for
+// each batch so that no document changes while it's indexed. Between
+// batches it pauses, to leave room for other work, and records the
+// key of the last document indexed as a checkpoint in the live
+// index's metaNamespace.
+//
+// While the shadow index exists, every write to primary data is
+// also applied to it (see updateShadow), so documents behind the
+// checkpoint stay up to date. This is also what makes a reindex
+// resumable: when the server opens an index with a checkpoint, it
+// opens the shadow index straight away, before any writes, and the
+// next reindex carries on after the checkpoint.
+//
+// When the walk completes, the shadow index replaces the live one,
+// with Storage.ReplaceIndex, which renames directories for Pebble
+// storage. Readers hold indexStore.mu for reading while they use the
+// index, so the swap waits for them, and new readers wait for the
+// swap. The checkpoint is in the old index, so it goes with it.
+
+var metaNamespace byte = 'm'
+
+// reindexCheckpointKey holds the ID of the last document indexed
+// into the shadow index.
+var reindexCheckpointKey = packTuple([]byte{metaNamespace}, []byte("reindex"))
+
+// errReindexRunning is returned when starting a reindex while one
+// is already running.
+var errReindexRunning = errors.New("Reindex already running")
+
+// indexStore holds the index database, which a reindex replaces
+// when it completes.
+type indexStore struct {
+	// mu is held for reading while the index is used outside of
+	// writeMu, and for writing while it's replaced. Take it before
+	// writeMu.
+	mu      sync.RWMutex
+	db      KV
+	storage Storage
+
+	// shadow is the index being built by a reindex, or nil. Guarded
+	// by writeMu.
+	shadow KV
+
+	progressMu sync.Mutex
+	progress   reindexProgress
+	stop       chan struct{}  // Closed to stop a running reindex
+	running    sync.WaitGroup // Done when a running reindex returns
+}
+
+// reindexOptions controls how fast a reindex runs.
+type reindexOptions struct {
+	batchSize int           // Documents indexed while holding writeMu
+	pause     time.Duration // Time to wait between batches
+}
+
+// defaultReindexOptions are used when reindexing at startup.
+var defaultReindexOptions = reindexOptions{batchSize: 100, pause: 10 * time.Millisecond}
+
+// reindexProgress describes a running or finished reindex.
+type reindexProgress struct {
+	running  bool
+	indexed  int // Documents indexed, including before a resume
+	total    int // Documents in primary data when the reindex started
+	resumed  int // Documents already indexed when the reindex started
+	started  time.Time
+	finished time.Time
+	err      error
+}
+
+// eta returns an estimate of the time until p finishes, from the
+// rate of indexing so far, or 0 if there's no estimate.
+func (p reindexProgress) eta() time.Duration {
+	done := p.indexed - p.resumed
+	if !p.running || done <= 0 || p.total <= p.indexed {
+		return 0
+	}
+	perDoc := time.Since(p.started) / time.Duration(done)
+	return perDoc * time.Duration(p.total-p.indexed)
+}
+
+// toMap returns p in the shape of the reindex API's response.
+func (p reindexProgress) toMap() map[string]any {
+	m := map[string]any{
+		"running": p.running,
+		"indexed": p.indexed,
+		"total":   p.total,
+	}
+	if !p.started.IsZero() {
+		m["started"] = p.started.Format(time.RFC3339)
+	}
+	if p.running {
+		m["eta_seconds"] = p.eta().Seconds()
+	} else if !p.finished.IsZero() {
+		m["finished"] = p.finished.Format(time.RFC3339)
+	}
+	if p.err != nil {
+		m["error"] = p.err.Error()
+	}
+	return m
+}
+
+// openIndexStore opens the index in storage, reopening the shadow
+// index of an unfinished reindex.
+func openIndexStore(storage Storage) (*indexStore, error) {
+	idx := &indexStore{storage: storage}
+	var err error
+	idx.db, err = storage.OpenIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIndexVersion(idx.db); err != nil {
+		idx.db.Close()
+		return nil, err
+	}
+
+	_, closer, err := idx.db.Get(reindexCheckpointKey)
+	if err == ErrNotFound {
+		return idx, nil
+	} else if err != nil {
+		return idx, err
+	}
+	closer.Close()
+	idx.shadow, err = storage.OpenShadow(false)
+	return idx, err
+}
+
+// recoverIndexSwap finishes or undoes a swap of the index at path
+// interrupted between its renames.
+func recoverIndexSwap(path string) error {
+	if _, err := os.Stat(path + ".old"); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		// The old index was moved aside, but the shadow index
+		// wasn't moved into place.
+		if _, err := os.Stat(path + ".reindex"); err == nil {
+			if err := os.Rename(path+".reindex", path); err != nil {
+				return err
+			}
+		} else if err := os.Rename(path+".old", path); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(path + ".old")
+}
+
+// reindexProgress returns the progress of the running or last
+// reindex.
+func (s server) reindexProgress() reindexProgress {
+	s.idx.progressMu.Lock()
+	defer s.idx.progressMu.Unlock()
+	return s.idx.progress
+}
+
+// startReindex starts a reindex in the background, resuming an
+// unfinished one. Errors are logged and recorded in its progress.
+func (s server) startReindex(opts reindexOptions) error {
+	stop, err := s.beginReindex()
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := s.runReindex(opts, stop)
+		if err != nil {
+			log.Printf("Could not reindex: %v", err)
+		}
+	}()
+	return nil
+}
+
+// resumeReindex starts a reindex in the background if the index was
+// opened with an unfinished one, and otherwise does nothing.
+func (s server) resumeReindex(opts reindexOptions) error {
+	s.writeMu.Lock()
+	unfinished := s.idx.shadow != nil
+	s.writeMu.Unlock()
+	if !unfinished {
+		return nil
+	}
+	return s.startReindex(opts)
+}
+
+// stopReindex stops a running reindex after its current batch. It
+// can be resumed later by starting a reindex.
+func (s server) stopReindex() {
+	s.idx.progressMu.Lock()
+	defer s.idx.progressMu.Unlock()
+	if s.idx.progress.running && s.idx.stop != nil {
+		close(s.idx.stop)
+		s.idx.stop = nil
+	}
+}
+
+// reindex rebuilds the index from primary data, resuming an
+// unfinished reindex, and returns when it's complete.
+func (s server) reindex(opts reindexOptions) error {
+	stop, err := s.beginReindex()
+	if err != nil {
+		return err
+	}
+	return s.runReindex(opts, stop)
+}
+
+// beginReindex marks a reindex as running and returns the channel
+// that stopReindex closes, or returns errReindexRunning.
+func (s server) beginReindex() (chan struct{}, error) {
+	s.idx.progressMu.Lock()
+	defer s.idx.progressMu.Unlock()
+	if s.idx.progress.running {
+		return nil, errReindexRunning
+	}
+	s.idx.progress = reindexProgress{running: true, started: time.Now()}
+	s.idx.stop = make(chan struct{})
+	s.idx.running.Add(1)
+	return s.idx.stop, nil
+}
+
+// runReindex does the work of a reindex marked as running by
+// beginReindex, until it completes or stop is closed.
+func (s server) runReindex(opts reindexOptions, stop chan struct{}) (err error) {
+	defer s.idx.running.Done()
+	defer func() {
+		s.idx.progressMu.Lock()
+		defer s.idx.progressMu.Unlock()
+		s.idx.progress.running = false
+		s.idx.progress.finished = time.Now()
+		s.idx.progress.err = err
+		s.idx.stop = nil
+	}()
+
+	checkpoint, err := s.startShadow()
+	if err != nil {
+		return err
+	}
+	if err := s.countReindex(checkpoint); err != nil {
+		return err
+	}
+
+	for {
+		var more bool
+		checkpoint, more, err = s.reindexBatch(checkpoint, opts.batchSize)
+		if err != nil || !more {
+			break
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(opts.pause):
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.swapIndex()
+}
+
+// startShadow opens the shadow index, if it isn't already open, and
+// returns the checkpoint to continue from, nil to start from the
+// beginning.
+func (s server) startShadow() ([]byte, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.idx.shadow != nil {
+		v, closer, err := s.idx.db.Get(reindexCheckpointKey)
+		if err == ErrNotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		defer closer.Close()
+		return append([]byte(nil), v...), nil
+	}
+
+	// Anything left from before is from a reindex that never wrote
+	// a checkpoint, so would be stale.
+	shadow, err := s.idx.storage.OpenShadow(true)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeIndexVersion(shadow, indexFormatVersion); err != nil {
+		shadow.Close()
+		return nil, err
+	}
+	s.idx.shadow = shadow
+	return nil, nil
+}
+
+// countReindex records the number of documents in primary data, and
+// how many of them are up to checkpoint, in the reindex progress.
+func (s server) countReindex(checkpoint []byte) error {
+	total, resumed := 0, 0
+	iter := s.cols.root.NewIter(nil)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if c, _ := s.cols.forKey(iter.Key()); c == nil {
+			continue
+		}
+		total++
+		if checkpoint != nil && string(iter.Key()) <= string(checkpoint) {
+			resumed++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	s.idx.progressMu.Lock()
+	defer s.idx.progressMu.Unlock()
+	s.idx.progress.total = total
+	s.idx.progress.indexed = resumed
+	s.idx.progress.resumed = resumed
+	return nil
+}
+
+// reindexBatch indexes up to n documents of any collection after
+// checkpoint, a primary data key, into the shadow index, and returns
+// the new checkpoint and whether there may be more documents.
+func (s server) reindexBatch(checkpoint []byte, n int) ([]byte, bool, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	readOptions := &IterOptions{}
+	if checkpoint != nil {
+		// The smallest key after the checkpoint
+		readOptions.LowerBound = append(append([]byte(nil), checkpoint...), 0)
+	}
+	iter := s.cols.root.NewIter(readOptions)
+	b := s.idx.shadow.NewBatch()
+	defer b.Close()
+
+	count, visited := 0, 0
+	for iter.First(); iter.Valid() && count < n; iter.Next() {
+		visited++
+		checkpoint = append([]byte(nil), iter.Key()...)
+		c, id := s.cols.forKey(iter.Key())
+		if c == nil {
+			continue
+		}
+		count++
+		document, _, err := decodeDocument(iter.Value())
+		if err != nil {
+			log.Printf("Unable to parse bad document, %s: %s", c.describeID(id), err)
+			continue
+		}
+		err = indexBatch(c.indexView(b), c.cfg, string(id), document)
+		if err != nil {
+			iter.Close()
+			return nil, false, err
+		}
+	}
+	more := iter.Valid()
+	if err := iter.Close(); err != nil {
+		return nil, false, err
+	}
+
+	if visited > 0 {
+		if err := s.idx.shadow.Apply(b); err != nil {
+			return nil, false, err
+		}
+		err := s.idx.db.Set(reindexCheckpointKey, checkpoint)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	s.idx.progressMu.Lock()
+	s.idx.progress.indexed += count
+	s.idx.progressMu.Unlock()
+	return checkpoint, more, nil
+}
+
+// updateShadow applies the current primary data for ids to the
+// shadow index, if a reindex is building one. The caller must hold
+// writeMu.
+func (s server) updateShadow(ids ...string) error {
+	if s.idx.shadow == nil {
+		return nil
+	}
+	b := s.idx.shadow.NewBatch()
+	defer b.Close()
+	for _, id := range ids {
+		document, _, err := s.getDocument([]byte(id))
+		if err == ErrNotFound {
+			err = unindexBatch(s.indexView(b), []byte(id))
+		} else if err == nil {
+			err = indexBatch(s.indexView(b), s.cfg, id, document)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.idx.shadow.Apply(b)
+}
+
+// swapIndex replaces the live index with the completed shadow index.
+// If that fails, it keeps the index and shadow index that
+// Storage.ReplaceIndex leaves, so queries carry on and the next
+// reindex resumes from the checkpoint.
+func (s server) swapIndex() error {
+	s.idx.mu.Lock()
+	defer s.idx.mu.Unlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	db, shadow, err := s.idx.storage.ReplaceIndex(s.idx.db, s.idx.shadow)
+	if db != nil {
+		s.idx.db = db
+		s.idx.shadow = shadow
+	}
+	return err
+}
+
+// close stops any running reindex, replication, reaper and
+// webhooks, waits for readers of the index to finish and closes the
+// databases.
+func (s server) close() error {
+	s.cols.mu.RLock()
+	f := s.cols.follower
+	s.cols.mu.RUnlock()
+	if f != nil {
+		f.stop()
+	}
+	s.stopReaper()
+	s.cols.hooks.stopAll()
+	s.stopReindex()
+	s.idx.running.Wait()
+
+	s.idx.mu.Lock()
+	defer s.idx.mu.Unlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var errs []error
+	if s.idx.shadow != nil {
+		errs = append(errs, s.idx.shadow.Close())
+		s.idx.shadow = nil
+	}
+	errs = append(errs, s.idx.db.Close(), s.cols.root.Close())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
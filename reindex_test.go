@@ -0,0 +1,207 @@
+package docdb
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_reindexOnline(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		s.addDocument(id, map[string]any{"kind": "letter"})
+	}
+	// Bad documents are skipped, rather than indexed as empty
+	s.db.Set([]byte("bad"), []byte("{"))
+	s.idx.db.Delete(
+		encodeInvIdxKey([]byte("kind"), encodeTaggedValue("letter"), []byte("c")),
+	)
+
+	// Queries and writes carry on while the reindex runs
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := s.reindex(reindexOptions{batchSize: 1})
+		assert.NoError(t, err)
+	}()
+	q, _ := parseQuery("kind:letter")
+	for !s.reindexProgress().finished.After(s.reindexProgress().started) {
+		_, err := s.searchDocuments(q)
+		assert.NoError(t, err)
+		s.addDocument("f", map[string]any{"kind": "letter"})
+		s.deleteDocument("f", anyRevision)
+	}
+	wg.Wait()
+	s.addDocument("g", map[string]any{"kind": "letter"})
+
+	result, _ := s.searchDocuments(q)
+	assert.Equal(t, 6, result["count"])
+	report, _ := s.checkIndex(false)
+	assert.Empty(t, report.missing)
+	assert.Empty(t, report.orphans)
+
+	progress := s.reindexProgress()
+	assert.False(t, progress.running)
+	assert.Nil(t, progress.err)
+	assert.GreaterOrEqual(t, progress.indexed, 6) // f may be indexed too
+	_, err = os.Stat(d + ".index.reindex")
+	assert.True(t, os.IsNotExist(err))
+	_, _, err = s.idx.db.Get(reindexCheckpointKey)
+	assert.Equal(t, ErrNotFound, err)
+
+	s.idx.db.Close()
+	s.cols.root.Close()
+}
+
+func Test_reindexResume(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		s.addDocument(id, map[string]any{"n": 1})
+	}
+
+	assert.NoError(t, s.startReindex(reindexOptions{batchSize: 2, pause: time.Hour}))
+	assert.Equal(t, errReindexRunning, s.startReindex(reindexOptions{}))
+	for s.reindexProgress().indexed < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	s.stopReindex()
+	for s.reindexProgress().running {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 2, s.reindexProgress().indexed)
+
+	// Writes behind the checkpoint are applied to the shadow index,
+	// including after a restart
+	s.addDocument("a", map[string]any{"n": 2})
+	s.idx.shadow.Close()
+	s.idx.db.Close()
+	s.cols.root.Close()
+	s, err = newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not reopen s")
+	}
+	assert.NotNil(t, s.idx.shadow)
+	s.deleteDocument("b", anyRevision)
+
+	assert.NoError(t, s.resumeReindex(reindexOptions{batchSize: 2}))
+	s.idx.running.Wait()
+	progress := s.reindexProgress()
+	assert.NoError(t, progress.err)
+	assert.Equal(t, 1, progress.resumed) // b was deleted
+	assert.Equal(t, 4, progress.indexed)
+
+	ids, _ := lookupEq(s.idx.db, nil, "n", 1)
+	assert.ElementsMatch(t, []string{"c", "d", "e"}, ids)
+	ids, _ = lookupEq(s.idx.db, nil, "n", 2)
+	assert.ElementsMatch(t, []string{"a"}, ids)
+
+	// With nothing to resume, no reindex starts
+	assert.NoError(t, s.resumeReindex(reindexOptions{batchSize: 2}))
+	assert.False(t, s.reindexProgress().running)
+	assert.Nil(t, s.idx.shadow)
+
+	s.idx.db.Close()
+	s.cols.root.Close()
+}
+
+func Test_recoverIndexSwap(t *testing.T) {
+	d := t.TempDir() + "/index"
+
+	// Interrupted before the shadow index was moved into place
+	os.MkdirAll(d+".old", 0755)
+	os.MkdirAll(d+".reindex/new", 0755)
+	assert.NoError(t, recoverIndexSwap(d))
+	_, err := os.Stat(d + "/new")
+	assert.NoError(t, err)
+	_, err = os.Stat(d + ".old")
+	assert.True(t, os.IsNotExist(err))
+
+	// Interrupted after, with only the old index left to remove
+	os.MkdirAll(d+".old", 0755)
+	assert.NoError(t, recoverIndexSwap(d))
+	_, err = os.Stat(d + "/new")
+	assert.NoError(t, err)
+	_, err = os.Stat(d + ".old")
+	assert.True(t, os.IsNotExist(err))
+}
+
+// failingStorage is a Storage whose ReplaceIndex fails with err,
+// if it's set.
+type failingStorage struct {
+	Storage
+	err error
+}
+
+func (f *failingStorage) ReplaceIndex(index, shadow KV) (KV, KV, error) {
+	if f.err != nil {
+		return index, shadow, f.err
+	}
+	return f.Storage.ReplaceIndex(index, shadow)
+}
+
+func Test_reindexSwapFails(t *testing.T) {
+	storage := &failingStorage{MemoryStorage(), errors.New("No space left")}
+	s, err := newStorageServer(storage, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		s.addDocument(id, map[string]any{"n": 1})
+	}
+
+	// The index and shadow index are kept, and queries carry on
+	assert.Equal(t, storage.err, s.reindex(reindexOptions{batchSize: 2}))
+	assert.NotNil(t, s.idx.shadow)
+	ids, err := lookupEq(s.idx.db, nil, "n", 1)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, ids)
+
+	// The next reindex swaps the shadow index in
+	storage.err = nil
+	s.addDocument("d", map[string]any{"n": 1})
+	assert.NoError(t, s.reindex(reindexOptions{batchSize: 2}))
+	assert.Nil(t, s.idx.shadow)
+	ids, _ = lookupEq(s.idx.db, nil, "n", 1)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d"}, ids)
+}
+
+func Test_pebbleReplaceIndexFails(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("a", map[string]any{"n": 1})
+
+	// The old index can't be moved aside
+	os.MkdirAll(d+".index.old/stale", 0755)
+	_, err = s.startShadow()
+	assert.NoError(t, err)
+	err = s.swapIndex()
+	assert.Error(t, err)
+	assert.NotNil(t, s.idx.shadow)
+	ids, err := lookupEq(s.idx.db, nil, "n", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids)
+
+	assert.NoError(t, s.reindex(reindexOptions{batchSize: 2}))
+	assert.Nil(t, s.idx.shadow)
+	ids, _ = lookupEq(s.idx.db, nil, "n", 1)
+	assert.Equal(t, []string{"a"}, ids)
+
+	s.idx.db.Close()
+	s.cols.root.Close()
+}
@@ -0,0 +1,506 @@
+package docdb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains replication, which makes a database a read-only
+// follower of another docdb, its leader, over HTTP.
+//
+// A follower tails the change feed of each of the leader's
+// collections with long polls of /_changes?include_docs=true, which
+// returns every change with the leader's current revision and body
+// of its document. The follower stores the document with the leader's
+// revision, indexing it locally with index(), and records the
+// leader's sequence number, its cursor, under replicationKey in the
+// same batch, so that it resumes from the right place after a
+// restart. A change may carry a newer state of its document than the
+// change itself, when the document has been written again since;
+// applying it early does no harm, and the later change is skipped as
+// the follower already has it.
+//
+// The follower also polls the leader's list of collections, creating
+// the ones it doesn't have, with the leader's options, and dropping
+// the ones the leader has dropped. The default collection's options
+// aren't stored, so a follower's are those it was opened with. A
+// collection that's dropped and created again between polls keeps
+// the follower's cursor, which is ahead of the new feed, so it must be
+// dropped on the follower by hand.
+//
+// While a database is a follower, every other write of documents or
+// collections returns ErrReadOnly.
+
+var (
+	// ErrReadOnly is returned for writes to a follower.
+	ErrReadOnly = errors.New("Database is a read-only follower")
+	// errFollowing is returned when following while already a
+	// follower.
+	errFollowing = errors.New("Database is already a follower")
+	// errNotFollower is returned for the replication status of a
+	// database that isn't a follower.
+	errNotFollower = errors.New("Database isn't a follower")
+)
+
+// ReplicationStatus describes the replication of a follower.
+type ReplicationStatus struct {
+	Leader string
+	// Error is the last error reading the leader's collections.
+	Error       string
+	Collections map[string]CollectionReplication
+}
+
+// CollectionReplication describes the replication of a collection.
+type CollectionReplication struct {
+	// Seq is the leader's sequence number replicated up to.
+	Seq uint64
+	// Pending is the number of leader changes not yet replicated, as
+	// of the last poll.
+	Pending uint64
+	// CaughtUp is when there were last no pending changes, or zero
+	// if there haven't been.
+	CaughtUp time.Time
+	// Lag is how long the follower has been behind, 0 when it's
+	// caught up.
+	Lag time.Duration
+	// Error is the last error replicating, cleared on success.
+	Error string
+}
+
+// toMap returns r in the shape of the replication API's response.
+func (r *ReplicationStatus) toMap() map[string]any {
+	collections := map[string]any{}
+	for name, c := range r.Collections {
+		m := map[string]any{
+			"seq":         c.Seq,
+			"pending":     c.Pending,
+			"lag_seconds": c.Lag.Seconds(),
+		}
+		if !c.CaughtUp.IsZero() {
+			m["caught_up"] = c.CaughtUp.Format(time.RFC3339)
+		}
+		if c.Error != "" {
+			m["error"] = c.Error
+		}
+		collections[name] = m
+	}
+	m := map[string]any{"leader": r.Leader, "collections": collections}
+	if r.Error != "" {
+		m["error"] = r.Error
+	}
+	return m
+}
+
+// replicatedChange is a change of a /_changes response with
+// include_docs, with its document's current state on the leader.
+type replicatedChange struct {
+	Change
+	Doc *replicatedDoc `json:"doc"` // nil once the document is deleted
+}
+
+// replicatedDoc is the state of a document in a replicatedChange.
+type replicatedDoc struct {
+	Rev  uint64         `json:"rev"`
+	Body map[string]any `json:"body"`
+}
+
+// changesResponse is the body of a /_changes response.
+type changesResponse struct {
+	Results []replicatedChange `json:"results"`
+	LastSeq uint64             `json:"last_seq"`
+	Pending uint64             `json:"pending"`
+}
+
+// replicationKey returns the primary data key of a follower's cursor
+// for collection name.
+func replicationKey(name string) []byte {
+	return metaKey(replicationMeta, name)
+}
+
+// follower replicates a leader's collections into a database.
+type follower struct {
+	leader string
+	client *http.Client
+	// poll is how long each long poll of the leader waits for changes.
+	poll time.Duration
+	// collectionsPoll is how often the leader's collections are
+	// listed.
+	collectionsPoll time.Duration
+	// retry is the delay after the first error, doubling up to
+	// maxRetry.
+	retry    time.Duration
+	maxRetry time.Duration
+
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
+	mu      sync.Mutex
+	err     error                         // Last error listing collections
+	tailers map[string]context.CancelFunc // By collection
+	status  map[string]*CollectionReplication
+	started time.Time
+}
+
+func newFollower(leader string) *follower {
+	return &follower{
+		leader:          strings.TrimSuffix(leader, "/"),
+		client:          &http.Client{Timeout: 2 * time.Minute},
+		poll:            30 * time.Second,
+		collectionsPoll: 30 * time.Second,
+		retry:           time.Second,
+		maxRetry:        30 * time.Second,
+		tailers:         map[string]context.CancelFunc{},
+		status:          map[string]*CollectionReplication{},
+		started:         time.Now(),
+	}
+}
+
+// follow makes the database of s a follower of leader, replicating in
+// the background until it's closed.
+func (s server) follow(leader string, f *follower) error {
+	u, err := url.Parse(leader)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New(fmt.Sprintf("Bad leader URL %q", leader))
+	}
+
+	s.cols.mu.Lock()
+	defer s.cols.mu.Unlock()
+	if s.cols.follower != nil {
+		return errFollowing
+	}
+	s.cols.follower = f
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.cancel = cancel
+	f.running.Add(1)
+	go func() {
+		defer f.running.Done()
+		for {
+			err := f.syncCollections(ctx, s)
+			f.mu.Lock()
+			f.err = err
+			f.mu.Unlock()
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Could not read the leader's collections: %v", err)
+			}
+
+			select {
+			case <-time.After(f.collectionsPoll):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stop stops replication and waits for it to return.
+func (f *follower) stop() {
+	f.cancel()
+	f.running.Wait()
+}
+
+// get GETs path from the leader and decodes the body of its response
+// into v.
+func (f *follower) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", f.leader+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Body  json.RawMessage `json:"body"`
+		Error string          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Leader returned %s: %s", resp.Status, body.Error))
+	}
+	return json.Unmarshal(body.Body, v)
+}
+
+// collectionPath returns the path of collection name in the API.
+func collectionPath(name string) string {
+	if name == DefaultCollection {
+		return ""
+	}
+	return "/collections/" + url.PathEscape(name)
+}
+
+// syncCollections creates and drops the collections of s to match the
+// leader's, and tails each of them.
+func (f *follower) syncCollections(ctx context.Context, s server) error {
+	var list struct {
+		Collections []string `json:"collections"`
+	}
+	if err := f.get(ctx, "/collections", &list); err != nil {
+		return err
+	}
+
+	leader := map[string]bool{}
+	for _, name := range list.Collections {
+		leader[name] = true
+		if _, err := s.collection(name); err == nil {
+			continue
+		}
+		var def struct {
+			Options *Options `json:"options"`
+		}
+		if err := f.get(ctx, collectionPath(name), &def); err != nil {
+			return err
+		}
+		if _, err := s.addCollection(name, def.Options); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range s.listCollections() {
+		if !leader[name] && name != DefaultCollection {
+			f.stopTailing(name)
+			if err := s.removeCollection(name); err != nil && err != ErrNoCollection {
+				return err
+			}
+		}
+	}
+	for name := range leader {
+		if c, err := s.collection(name); err == nil {
+			f.startTailing(ctx, *c)
+		}
+	}
+	return nil
+}
+
+// startTailing starts replicating collection s, if it isn't already.
+func (f *follower) startTailing(ctx context.Context, s server) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tailers[s.name] != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f.tailers[s.name] = cancel
+	f.running.Add(1)
+	go func() {
+		defer f.running.Done()
+		f.tail(ctx, s)
+	}()
+}
+
+// stopTailing stops replicating collection name.
+func (f *follower) stopTailing(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cancel := f.tailers[name]; cancel != nil {
+		cancel()
+		delete(f.tailers, name)
+		delete(f.status, name)
+	}
+}
+
+// tail replicates the changes of collection s until ctx is done or
+// the collection is dropped.
+func (f *follower) tail(ctx context.Context, s server) {
+	since, err := s.replicationCursor()
+	delay := f.retry
+	for ctx.Err() == nil {
+		var resp changesResponse
+		if err == nil {
+			path := fmt.Sprintf("%s/_changes?feed=longpoll&include_docs=true&since=%d&limit=%d&timeout=%d",
+				collectionPath(s.name), since, subscriptionBatchSize, f.poll/time.Millisecond)
+			err = f.get(ctx, path, &resp)
+		}
+		for i := 0; err == nil && i < len(resp.Results); i++ {
+			err = s.applyReplicated(resp.Results[i])
+			if err == nil {
+				since = resp.Results[i].Seq
+			}
+		}
+		if err == ErrNoCollection || ctx.Err() != nil {
+			return
+		}
+		f.report(s.name, since, resp.Pending, err)
+
+		if err == nil {
+			delay = f.retry
+			continue
+		}
+		log.Printf("Could not replicate collection %s: %v", s.name, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+		if delay > f.maxRetry {
+			delay = f.maxRetry
+		}
+		// Read the cursor again, in case the error came before it
+		// was loaded
+		since, err = s.replicationCursor()
+	}
+}
+
+// report records the state of the replication of collection name.
+func (f *follower) report(name string, seq, pending uint64, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := f.status[name]
+	if status == nil {
+		status = &CollectionReplication{}
+		f.status[name] = status
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+	status.Seq, status.Pending, status.Error = seq, pending, ""
+	if pending == 0 {
+		status.CaughtUp = time.Now()
+	}
+}
+
+// replicationStatus returns the state of replication.
+func (f *follower) replicationStatus() *ReplicationStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := &ReplicationStatus{Leader: f.leader, Collections: map[string]CollectionReplication{}}
+	if f.err != nil {
+		status.Error = f.err.Error()
+	}
+	for name, c := range f.status {
+		r := *c
+		if r.Pending > 0 || r.Error != "" {
+			since := r.CaughtUp
+			if since.IsZero() {
+				since = f.started
+			}
+			r.Lag = time.Since(since)
+		}
+		status.Collections[name] = r
+	}
+	return status
+}
+
+// replicationCursor returns the leader's sequence number that s is
+// replicated up to.
+func (s server) replicationCursor() (uint64, error) {
+	value, closer, err := s.cols.root.Get(replicationKey(s.name))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	seq, _ := binary.Uvarint(value)
+	return seq, nil
+}
+
+// applyReplicated stores the state of the document of c on the
+// leader, unless s already has it, along with the cursor of c.
+func (s server) applyReplicated(c replicatedChange) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.exists() {
+		return ErrNoCollection
+	}
+
+	current, rev, err := readDocument(s.db, []byte(c.ID))
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	b := s.db.NewBatch()
+	defer b.Close()
+	var changes []Change
+	if c.Doc == nil && current != nil {
+		if err := unindex(s.indexDb(), []byte(c.ID)); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(c.ID)); err != nil {
+			return err
+		}
+		changes = append(changes, Change{ID: c.ID, Rev: rev, Deleted: true})
+	} else if c.Doc != nil && (c.Doc.Rev != rev || !reflect.DeepEqual(c.Doc.Body, current)) {
+		index(s.indexDb(), s.cfg, c.ID, c.Doc.Body)
+		bs, err := encodeDocument(c.Doc.Body, c.Doc.Rev)
+		if err != nil {
+			return err
+		}
+		if err := b.Set([]byte(c.ID), bs); err != nil {
+			return err
+		}
+		changes = append(changes, Change{ID: c.ID, Rev: c.Doc.Rev})
+	}
+
+	err = rootBatch(b).Set(replicationKey(s.name), binary.AppendUvarint(nil, c.Seq))
+	if err != nil {
+		return err
+	}
+	seq, err := s.logChanges(b, changes...)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Apply(b); err != nil {
+		return err
+	}
+	s.feed.publish(seq)
+	if len(changes) == 0 {
+		return nil
+	}
+	return s.updateShadow(c.ID)
+}
+
+// Follow makes the database a read-only follower of the docdb whose
+// HTTP API is at leader, such as "http://localhost:8080". It
+// replicates the leader's collections and their documents in the
+// background until the database is closed, resuming where it left
+// off, and other writes return ErrReadOnly.
+func (db *DB) Follow(leader string) error {
+	return db.s.follow(leader, newFollower(leader))
+}
+
+// Replication returns the state of replication from the leader, or
+// nil if the database isn't a follower.
+func (db *DB) Replication() *ReplicationStatus {
+	db.s.cols.mu.RLock()
+	f := db.s.cols.follower
+	db.s.cols.mu.RUnlock()
+	if f == nil {
+		return nil
+	}
+	return f.replicationStatus()
+}
+
+// collectionOptions returns the Options s was created with, or nil
+// for the default collection.
+func (s server) collectionOptions() (*Options, error) {
+	if s.prefix == nil {
+		return nil, nil
+	}
+	value, closer, err := s.cols.root.Get(catalogKey(s.name))
+	if err == ErrNotFound {
+		return nil, ErrNoCollection
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var opts *Options
+	return opts, json.Unmarshal(value, &opts)
+}
@@ -0,0 +1,199 @@
+package docdb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLeader returns a database in memory served over HTTP.
+func newTestLeader(t *testing.T) (*DB, *httptest.Server) {
+	db, err := OpenMemory(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open leader")
+	}
+	server := httptest.NewServer(db.Handler())
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return db, server
+}
+
+// follow makes db a follower of leader that polls often.
+func follow(t *testing.T, db *DB, leader string) {
+	f := newFollower(leader)
+	f.poll = 50 * time.Millisecond
+	f.collectionsPoll = 10 * time.Millisecond
+	f.retry = time.Millisecond
+	assert.Nil(t, db.s.follow(leader, f))
+}
+
+// caughtUp returns whether every collection of follower has caught up
+// with leader.
+func caughtUp(leader, follower *DB) bool {
+	status := follower.Replication()
+	names := leader.Collections()
+	if len(status.Collections) != len(names) {
+		return false
+	}
+	for _, name := range names {
+		c, err := leader.Collection(name)
+		if err != nil {
+			return false
+		}
+		r, ok := status.Collections[name]
+		if !ok || r.Error != "" || r.Pending > 0 || r.Seq != c.s.feed.last() {
+			return false
+		}
+	}
+	return true
+}
+
+func waitForCaughtUp(t *testing.T, leader, follower *DB) {
+	assert.Eventually(t, func() bool { return caughtUp(leader, follower) },
+		5*time.Second, 5*time.Millisecond)
+}
+
+func Test_replication(t *testing.T) {
+	ctx := context.Background()
+	leader, server := newTestLeader(t)
+	leader.Put(ctx, "a", map[string]any{"name": "Kate"})
+	leader.Put(ctx, "a", map[string]any{"name": "Kate", "age": 30.0})
+	leader.Put(ctx, "b", map[string]any{"name": "Phil"})
+	notes, err := leader.CreateCollection("notes", &Options{FullText: []string{"text"}})
+	assert.Nil(t, err)
+	notes.Put(ctx, "n1", map[string]any{"text": "replicated databases"})
+
+	follower, err := OpenMemory(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open follower")
+	}
+	defer follower.Close()
+	follow(t, follower, server.URL)
+	waitForCaughtUp(t, leader, follower)
+
+	// Documents have the leader's revisions, and are indexed
+	doc, err := follower.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), doc.Rev)
+	assert.Equal(t, map[string]any{"name": "Kate", "age": 30.0}, doc.Body)
+	docs, err := follower.Find(ctx, "name:Phil")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+	followerNotes, err := follower.Collection("notes")
+	assert.Nil(t, err)
+	docs, err = followerNotes.Find(ctx, `text:~"database"`)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs))
+
+	// Later writes and deletes follow
+	leader.Delete(ctx, "b")
+	leader.Put(ctx, "c", map[string]any{"name": "Tim"})
+	waitForCaughtUp(t, leader, follower)
+	_, err = follower.Get(ctx, "b")
+	assert.Equal(t, ErrNotFound, err)
+	docs, err = follower.Find(ctx, "name:Phil")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(docs))
+	doc, err = follower.Get(ctx, "c")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), doc.Rev)
+
+	// Dropped collections are dropped
+	assert.Nil(t, leader.DropCollection("notes"))
+	assert.Eventually(t, func() bool {
+		_, err := follower.Collection("notes")
+		return err == ErrNoCollection
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// The follower refuses writes
+	_, err = follower.Put(ctx, "d", map[string]any{})
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, follower.Delete(ctx, "a"))
+	_, err = follower.CreateCollection("mine", nil)
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, errFollowing, follower.Follow(server.URL))
+
+	status := follower.Replication()
+	assert.Equal(t, server.URL, status.Leader)
+	assert.Equal(t, uint64(0), status.Collections["default"].Pending)
+	assert.Equal(t, time.Duration(0), status.Collections["default"].Lag)
+	assert.Nil(t, leader.Replication())
+}
+
+func Test_replicationResume(t *testing.T) {
+	ctx := context.Background()
+	leader, server := newTestLeader(t)
+	leader.Put(ctx, "a", map[string]any{"n": 1.0})
+
+	d := t.TempDir()
+	follower, err := Open(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open follower")
+	}
+	follow(t, follower, server.URL)
+	waitForCaughtUp(t, leader, follower)
+	assert.Nil(t, follower.Close())
+
+	leader.Put(ctx, "a", map[string]any{"n": 2.0})
+	leader.Put(ctx, "b", map[string]any{"n": 3.0})
+
+	follower, err = Open(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open follower again")
+	}
+	defer follower.Close()
+	cursor, err := follower.s.replicationCursor()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), cursor)
+
+	follow(t, follower, server.URL)
+	waitForCaughtUp(t, leader, follower)
+	doc, err := follower.Get(ctx, "a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), doc.Rev)
+	assert.Equal(t, 2.0, doc.Body["n"])
+	_, err = follower.Get(ctx, "b")
+	assert.Nil(t, err)
+
+	// The follower's own feed has the changes it applied
+	changes, err := follower.Changes(ctx, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(changes))
+}
+
+func Test_httpReplication(t *testing.T) {
+	leader, server := newTestLeader(t)
+	leader.Put(context.Background(), "a", map[string]any{})
+
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	defer s.close()
+	resp, _ := doRequest(t, s, "GET", "/_replication", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	follower := &DB{s: s, def: &Collection{s: s}}
+	follow(t, follower, server.URL)
+	waitForCaughtUp(t, leader, follower)
+
+	resp, body := doRequest(t, s, "GET", "/_replication", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	status := body["body"].(map[string]any)
+	assert.Equal(t, server.URL, status["leader"])
+	def := status["collections"].(map[string]any)["default"].(map[string]any)
+	assert.Equal(t, 1.0, def["seq"])
+	assert.Equal(t, 0.0, def["pending"])
+	assert.NotNil(t, def["caught_up"])
+
+	resp, _ = doRequest(t, s, "PUT", "/docs/b", "{}", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/collections/mine", "", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
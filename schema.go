@@ -0,0 +1,893 @@
+package docdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// This file contains schema validation, which checks the documents
+// written to a collection against a JSON Schema, so that a field
+// doesn't hold a number in one document and a string in the next.
+//
+// Schemas are a subset of JSON Schema draft 2020-12:
+//
+// - type, enum and const;
+// - properties, patternProperties, additionalProperties, required,
+//   minProperties and maxProperties;
+// - items, prefixItems, minItems, maxItems and uniqueItems;
+// - minLength, maxLength and pattern, a Go regular expression;
+// - minimum, maximum, exclusiveMinimum, exclusiveMaximum and
+//   multipleOf;
+// - allOf, anyOf, oneOf and not;
+// - $defs, and $ref to "#" or a JSON pointer within the schema.
+//
+// Annotations, such as title, description and format, are ignored,
+// and any other keyword is rejected rather than silently not checked.
+//
+// A collection's schema is stored as JSON under schemaKey in primary
+// data, apart from its Options, so that it can be changed, and the
+// default collection can have one too. Setting a schema doesn't check
+// the documents already stored, which ValidateExisting does. Writes
+// are checked under writeMu, as they're stored, and before they're
+// indexed. _expires, which a TTL adds to documents, isn't checked, so
+// that schemas with additionalProperties false allow it.
+
+// errNoSchema is returned for the schema of a collection without one.
+var errNoSchema = errors.New("Collection has no schema")
+
+// maxSchemaDepth limits how deeply schemas apply to a value, which
+// stops schemas that refer to themselves without end.
+const maxSchemaDepth = 64
+
+// schemaKey returns the primary data key of the schema of collection
+// name.
+func schemaKey(name string) []byte {
+	return metaKey(schemaMeta, name)
+}
+
+// SchemaError is a way a document doesn't match a schema.
+type SchemaError struct {
+	// Path is the JSON pointer of the value in the document, "" for
+	// the document itself.
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
+
+func (e SchemaError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "document"
+	}
+	return fmt.Sprintf("%s %s", path, e.Message)
+}
+
+// ValidationError is returned for documents that don't match their
+// collection's schema.
+type ValidationError struct {
+	Errors []SchemaError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return "Document doesn't match schema: " + strings.Join(messages, "; ")
+}
+
+// jsonSchema is a compiled schema.
+type jsonSchema struct {
+	always *bool // For the true and false schemas
+
+	types    []string
+	enum     []any
+	constant *any
+
+	properties        map[string]*jsonSchema
+	patternProperties []patternSchema
+	additional        *jsonSchema
+	required          []string
+	minProperties     *int
+	maxProperties     *int
+
+	items       *jsonSchema
+	prefixItems []*jsonSchema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+	ref   *jsonSchema
+}
+
+// patternSchema is the schema of the properties matching a pattern.
+type patternSchema struct {
+	re     *regexp.Regexp
+	schema *jsonSchema
+}
+
+// schemaAnnotations are the keywords that don't affect validation.
+var schemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "$anchor": true,
+	"$defs": true, "title": true, "description": true, "default": true,
+	"examples": true, "deprecated": true, "readOnly": true,
+	"writeOnly": true, "format": true, "contentEncoding": true,
+	"contentMediaType": true,
+}
+
+// schemaTypes are the values of the type keyword.
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// schemaCompiler compiles a schema, resolving its references.
+type schemaCompiler struct {
+	root     any
+	compiled map[string]*jsonSchema // By JSON pointer
+}
+
+// compileSchema returns the compiled schema, or an error saying where
+// it's bad. schema is anything that marshals to a JSON schema.
+func compileSchema(schema any) (*jsonSchema, error) {
+	// A round trip makes numbers float64, as they are in documents
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	var root any
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if m, ok := root.(map[string]any); ok {
+		if v, ok := m["$schema"]; ok && v != "https://json-schema.org/draft/2020-12/schema" {
+			return nil, errors.New(fmt.Sprintf("Unsupported $schema %v, only draft 2020-12 is", v))
+		}
+	}
+
+	c := &schemaCompiler{root: root, compiled: map[string]*jsonSchema{}}
+	return c.compileRef("#")
+}
+
+// schemaError returns the error for a bad schema at pointer.
+func schemaError(pointer, format string, args ...any) error {
+	return errors.New(fmt.Sprintf("Bad schema at %s: %s", pointer, fmt.Sprintf(format, args...)))
+}
+
+// compileRef returns the compiled schema at ref, a JSON pointer
+// fragment such as "#/$defs/address", compiling it once.
+func (c *schemaCompiler) compileRef(ref string) (*jsonSchema, error) {
+	if s, ok := c.compiled[ref]; ok {
+		return s, nil
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, errors.New(fmt.Sprintf("Bad schema: $ref %q must start with #", ref))
+	}
+
+	raw := c.root
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer != "" {
+		for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			switch v := raw.(type) {
+			case map[string]any:
+				raw = v[token]
+			case []any:
+				i, err := strconv.Atoi(token)
+				if err != nil || i < 0 || i >= len(v) {
+					return nil, errors.New(fmt.Sprintf("Bad schema: $ref %q not found", ref))
+				}
+				raw = v[i]
+			default:
+				raw = nil
+			}
+			if raw == nil {
+				return nil, errors.New(fmt.Sprintf("Bad schema: $ref %q not found", ref))
+			}
+		}
+	}
+
+	// Cached before it's compiled, so that it can refer to itself
+	s := &jsonSchema{}
+	c.compiled[ref] = s
+	return s, c.compile(s, raw, ref)
+}
+
+// compile compiles raw, the schema at pointer, into s.
+func (c *schemaCompiler) compile(s *jsonSchema, raw any, pointer string) error {
+	if b, ok := raw.(bool); ok {
+		s.always = &b
+		return nil
+	}
+	m, ok := raw.(map[string]any)
+	if !ok {
+		return schemaError(pointer, "must be an object or boolean")
+	}
+
+	// Keywords are compiled in order, so errors are the same each time
+	keywords := make([]string, 0, len(m))
+	for k := range m {
+		keywords = append(keywords, k)
+	}
+	sort.Strings(keywords)
+	for _, k := range keywords {
+		if err := c.compileKeyword(s, k, m[k], pointer+"/"+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileKeyword compiles keyword k, with value v at pointer, into s.
+func (c *schemaCompiler) compileKeyword(s *jsonSchema, k string, v any, pointer string) error {
+	var err error
+	switch k {
+	case "type":
+		switch t := v.(type) {
+		case string:
+			s.types = []string{t}
+		case []any:
+			for _, e := range t {
+				name, _ := e.(string)
+				s.types = append(s.types, name)
+			}
+		}
+		if len(s.types) == 0 {
+			return schemaError(pointer, "must be a type name or array of them")
+		}
+		for _, t := range s.types {
+			if !schemaTypes[t] {
+				return schemaError(pointer, "unknown type %q", t)
+			}
+		}
+	case "enum":
+		values, ok := v.([]any)
+		if !ok {
+			return schemaError(pointer, "must be an array")
+		}
+		s.enum = values
+	case "const":
+		s.constant = &v
+	case "properties":
+		props, ok := v.(map[string]any)
+		if !ok {
+			return schemaError(pointer, "must be an object")
+		}
+		s.properties = map[string]*jsonSchema{}
+		for name, raw := range props {
+			s.properties[name], err = c.subschema(raw, pointer+"/"+escapePointer(name))
+			if err != nil {
+				return err
+			}
+		}
+	case "patternProperties":
+		props, ok := v.(map[string]any)
+		if !ok {
+			return schemaError(pointer, "must be an object")
+		}
+		patterns := make([]string, 0, len(props))
+		for pattern := range props {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return schemaError(pointer, "bad pattern %q: %v", pattern, err)
+			}
+			schema, err := c.subschema(props[pattern], pointer+"/"+escapePointer(pattern))
+			if err != nil {
+				return err
+			}
+			s.patternProperties = append(s.patternProperties, patternSchema{re, schema})
+		}
+	case "additionalProperties":
+		s.additional, err = c.subschema(v, pointer)
+	case "required":
+		names, ok := v.([]any)
+		if !ok {
+			return schemaError(pointer, "must be an array of strings")
+		}
+		for _, name := range names {
+			str, ok := name.(string)
+			if !ok {
+				return schemaError(pointer, "must be an array of strings")
+			}
+			s.required = append(s.required, str)
+		}
+	case "minProperties":
+		s.minProperties, err = schemaCount(v, pointer)
+	case "maxProperties":
+		s.maxProperties, err = schemaCount(v, pointer)
+	case "items":
+		s.items, err = c.subschema(v, pointer)
+	case "prefixItems":
+		s.prefixItems, err = c.subschemas(v, pointer)
+	case "minItems":
+		s.minItems, err = schemaCount(v, pointer)
+	case "maxItems":
+		s.maxItems, err = schemaCount(v, pointer)
+	case "uniqueItems":
+		b, ok := v.(bool)
+		if !ok {
+			return schemaError(pointer, "must be a boolean")
+		}
+		s.uniqueItems = b
+	case "minLength":
+		s.minLength, err = schemaCount(v, pointer)
+	case "maxLength":
+		s.maxLength, err = schemaCount(v, pointer)
+	case "pattern":
+		pattern, ok := v.(string)
+		if !ok {
+			return schemaError(pointer, "must be a string")
+		}
+		s.pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return schemaError(pointer, "bad pattern: %v", err)
+		}
+	case "minimum":
+		s.minimum, err = schemaNumber(v, pointer)
+	case "maximum":
+		s.maximum, err = schemaNumber(v, pointer)
+	case "exclusiveMinimum":
+		s.exclusiveMinimum, err = schemaNumber(v, pointer)
+	case "exclusiveMaximum":
+		s.exclusiveMaximum, err = schemaNumber(v, pointer)
+	case "multipleOf":
+		s.multipleOf, err = schemaNumber(v, pointer)
+		if err == nil && *s.multipleOf <= 0 {
+			return schemaError(pointer, "must be greater than 0")
+		}
+	case "allOf":
+		s.allOf, err = c.subschemas(v, pointer)
+	case "anyOf":
+		s.anyOf, err = c.subschemas(v, pointer)
+	case "oneOf":
+		s.oneOf, err = c.subschemas(v, pointer)
+	case "not":
+		s.not, err = c.subschema(v, pointer)
+	case "$ref":
+		ref, ok := v.(string)
+		if !ok {
+			return schemaError(pointer, "must be a string")
+		}
+		s.ref, err = c.compileRef(ref)
+	default:
+		if !schemaAnnotations[k] {
+			return schemaError(pointer, "unsupported keyword %q", k)
+		}
+	}
+	return err
+}
+
+// subschema compiles raw, the schema at pointer within another.
+func (c *schemaCompiler) subschema(raw any, pointer string) (*jsonSchema, error) {
+	s := &jsonSchema{}
+	return s, c.compile(s, raw, pointer)
+}
+
+// subschemas compiles raw, the array of schemas at pointer.
+func (c *schemaCompiler) subschemas(raw any, pointer string) ([]*jsonSchema, error) {
+	list, ok := raw.([]any)
+	if !ok || len(list) == 0 {
+		return nil, schemaError(pointer, "must be a non-empty array of schemas")
+	}
+	schemas := make([]*jsonSchema, len(list))
+	for i, e := range list {
+		var err error
+		schemas[i], err = c.subschema(e, pointer+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return schemas, nil
+}
+
+// schemaCount returns v, the value of a keyword at pointer that must
+// be a non-negative integer.
+func schemaCount(v any, pointer string) (*int, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+		return nil, schemaError(pointer, "must be a non-negative integer")
+	}
+	n := int(f)
+	return &n, nil
+}
+
+// schemaNumber returns v, the value of a keyword at pointer that must
+// be a number.
+func schemaNumber(v any, pointer string) (*float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, schemaError(pointer, "must be a number")
+	}
+	return &f, nil
+}
+
+// escapePointer escapes token for a JSON pointer.
+func escapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// jsonType returns the JSON type of v, a value of a document, with
+// "integer" for whole numbers.
+func jsonType(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	if f, ok := jsonNumber(v); ok {
+		if f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return reflect.TypeOf(v).String()
+}
+
+// jsonNumber returns v as a float64, if it's a number of any Go type.
+func jsonNumber(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	}
+	return 0, false
+}
+
+// jsonEqual returns true if a and b are the same JSON value.
+func jsonEqual(a, b any) bool {
+	fa, aNumber := jsonNumber(a)
+	fb, bNumber := jsonNumber(b)
+	if aNumber || bNumber {
+		return aNumber && bNumber && fa == fb
+	}
+	switch at := a.(type) {
+	case map[string]any:
+		bt, ok := b.(map[string]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, v := range at {
+			w, ok := bt[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		bt, ok := b.([]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for i := range at {
+			if !jsonEqual(at[i], bt[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// validate returns the ways v, at path in a document, doesn't match s,
+// at depth levels of schemas below the document's.
+func (s *jsonSchema) validate(v any, path string, depth int) []SchemaError {
+	if depth > maxSchemaDepth {
+		return []SchemaError{{path, "$ref", "is nested too deeply for the schema"}}
+	}
+	if s.always != nil {
+		if *s.always {
+			return nil
+		}
+		return []SchemaError{{path, "false", "is not allowed"}}
+	}
+
+	var errs []SchemaError
+	fail := func(keyword, format string, args ...any) {
+		errs = append(errs, SchemaError{path, keyword, fmt.Sprintf(format, args...)})
+	}
+	valid := func(schema *jsonSchema) bool {
+		return len(schema.validate(v, path, depth+1)) == 0
+	}
+
+	if s.types != nil {
+		t := jsonType(v)
+		ok := false
+		for _, want := range s.types {
+			ok = ok || want == t || (want == "number" && t == "integer")
+		}
+		if !ok {
+			fail("type", "must be %s, not %s", strings.Join(s.types, " or "), t)
+			// Other keywords would only repeat the type mismatch
+			return errs
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, e := range s.enum {
+			ok = ok || jsonEqual(v, e)
+		}
+		if !ok {
+			enum, _ := json.Marshal(s.enum)
+			fail("enum", "must be one of %s", enum)
+		}
+	}
+	if s.constant != nil && !jsonEqual(v, *s.constant) {
+		constant, _ := json.Marshal(*s.constant)
+		fail("const", "must be %s", constant)
+	}
+
+	switch t := v.(type) {
+	case map[string]any:
+		errs = append(errs, s.validateObject(t, path, depth)...)
+	case []any:
+		errs = append(errs, s.validateArray(t, path, depth)...)
+	case string:
+		n := utf8.RuneCountInString(t)
+		if s.minLength != nil && n < *s.minLength {
+			fail("minLength", "must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("maxLength", "must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			fail("pattern", "must match pattern %q", s.pattern)
+		}
+	default:
+		if f, ok := jsonNumber(v); ok {
+			errs = append(errs, s.validateNumber(f, path)...)
+		}
+	}
+
+	for _, schema := range s.allOf {
+		errs = append(errs, schema.validate(v, path, depth+1)...)
+	}
+	if s.anyOf != nil {
+		ok := false
+		for _, schema := range s.anyOf {
+			ok = ok || valid(schema)
+		}
+		if !ok {
+			fail("anyOf", "must match at least one schema in anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		matched := 0
+		for _, schema := range s.oneOf {
+			if valid(schema) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("oneOf", "must match exactly one schema in oneOf, not %d", matched)
+		}
+	}
+	if s.not != nil && valid(s.not) {
+		fail("not", "must not match the schema in not")
+	}
+	if s.ref != nil {
+		errs = append(errs, s.ref.validate(v, path, depth+1)...)
+	}
+	return errs
+}
+
+// validateObject returns the ways object, at path, doesn't match the
+// object keywords of s.
+func (s *jsonSchema) validateObject(object map[string]any, path string, depth int) []SchemaError {
+	var errs []SchemaError
+	for _, name := range s.required {
+		if _, ok := object[name]; !ok {
+			errs = append(errs, SchemaError{path, "required", fmt.Sprintf("must have property %q", name)})
+		}
+	}
+	if s.minProperties != nil && len(object) < *s.minProperties {
+		errs = append(errs, SchemaError{path, "minProperties",
+			fmt.Sprintf("must have at least %d properties", *s.minProperties)})
+	}
+	if s.maxProperties != nil && len(object) > *s.maxProperties {
+		errs = append(errs, SchemaError{path, "maxProperties",
+			fmt.Sprintf("must have at most %d properties", *s.maxProperties)})
+	}
+
+	// Properties are checked in order, so errors are too
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, valuePath := object[name], path+"/"+escapePointer(name)
+		matched := false
+		if schema, ok := s.properties[name]; ok {
+			matched = true
+			errs = append(errs, schema.validate(value, valuePath, depth+1)...)
+		}
+		for _, p := range s.patternProperties {
+			if p.re.MatchString(name) {
+				matched = true
+				errs = append(errs, p.schema.validate(value, valuePath, depth+1)...)
+			}
+		}
+		if !matched && s.additional != nil {
+			errs = append(errs, s.additional.validate(value, valuePath, depth+1)...)
+		}
+	}
+	return errs
+}
+
+// validateArray returns the ways array, at path, doesn't match the
+// array keywords of s.
+func (s *jsonSchema) validateArray(array []any, path string, depth int) []SchemaError {
+	var errs []SchemaError
+	if s.minItems != nil && len(array) < *s.minItems {
+		errs = append(errs, SchemaError{path, "minItems", fmt.Sprintf("must have at least %d items", *s.minItems)})
+	}
+	if s.maxItems != nil && len(array) > *s.maxItems {
+		errs = append(errs, SchemaError{path, "maxItems", fmt.Sprintf("must have at most %d items", *s.maxItems)})
+	}
+	if s.uniqueItems {
+	unique:
+		for i := range array {
+			for j := 0; j < i; j++ {
+				if jsonEqual(array[i], array[j]) {
+					errs = append(errs, SchemaError{path, "uniqueItems",
+						fmt.Sprintf("must not have duplicate items, %d and %d", j, i)})
+					break unique
+				}
+			}
+		}
+	}
+	for i, item := range array {
+		itemPath := path + "/" + strconv.Itoa(i)
+		if i < len(s.prefixItems) {
+			errs = append(errs, s.prefixItems[i].validate(item, itemPath, depth+1)...)
+		} else if s.items != nil {
+			errs = append(errs, s.items.validate(item, itemPath, depth+1)...)
+		}
+	}
+	return errs
+}
+
+// validateNumber returns the ways f, at path, doesn't match the number
+// keywords of s.
+func (s *jsonSchema) validateNumber(f float64, path string) []SchemaError {
+	var errs []SchemaError
+	fail := func(keyword, format string, limit float64) {
+		errs = append(errs, SchemaError{path, keyword, fmt.Sprintf(format, limit)})
+	}
+	if s.minimum != nil && f < *s.minimum {
+		fail("minimum", "must be at least %v", *s.minimum)
+	}
+	if s.maximum != nil && f > *s.maximum {
+		fail("maximum", "must be at most %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+		fail("exclusiveMinimum", "must be greater than %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+		fail("exclusiveMaximum", "must be less than %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		q := f / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("multipleOf", "must be a multiple of %v", *s.multipleOf)
+		}
+	}
+	return errs
+}
+
+// collectionSchema holds the schema of a collection, which is shared
+// by every copy of its server.
+type collectionSchema struct {
+	mu     sync.RWMutex
+	raw    json.RawMessage // nil for none
+	schema *jsonSchema
+}
+
+// loadSchema returns the schema of collection name stored in root.
+func loadSchema(root KVReader, name string) (*collectionSchema, error) {
+	cs := &collectionSchema{}
+	value, closer, err := root.Get(schemaKey(name))
+	if err == ErrNotFound {
+		return cs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	cs.raw = append(json.RawMessage(nil), value...)
+	var raw any
+	if err := json.Unmarshal(cs.raw, &raw); err != nil {
+		return nil, err
+	}
+	cs.schema, err = compileSchema(raw)
+	return cs, err
+}
+
+// get returns the compiled schema, or nil.
+func (cs *collectionSchema) get() *jsonSchema {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.schema
+}
+
+// validateDocument returns a *ValidationError if document, apart
+// from its _expires, doesn't match schema, which may be nil for none.
+func validateDocument(schema *jsonSchema, document map[string]any) error {
+	if schema == nil {
+		return nil
+	}
+	if _, ok := document[expiresField]; ok {
+		without := make(map[string]any, len(document)-1)
+		for k, v := range document {
+			if k != expiresField {
+				without[k] = v
+			}
+		}
+		document = without
+	}
+	if errs := schema.validate(document, "", 0); len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// storedDocument returns document as s stores it, with its expiry,
+// after checking it against the schema of s.
+func (s server) storedDocument(document map[string]any) (map[string]any, error) {
+	document, err := s.withExpiry(document)
+	if err != nil {
+		return nil, err
+	}
+	return document, validateDocument(s.schema.get(), document)
+}
+
+// setSchema makes schema, which may be nil to remove it, the schema
+// of s.
+func (s server) setSchema(schema any) error {
+	var compiled *jsonSchema
+	var raw []byte
+	if schema != nil {
+		var err error
+		compiled, err = compileSchema(schema)
+		if err != nil {
+			return err
+		}
+		raw, err = json.Marshal(schema)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return err
+	}
+	var err error
+	if schema == nil {
+		err = s.cols.root.Delete(schemaKey(s.name))
+	} else {
+		err = s.cols.root.Set(schemaKey(s.name), raw)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.schema.mu.Lock()
+	defer s.schema.mu.Unlock()
+	s.schema.raw, s.schema.schema = raw, compiled
+	return nil
+}
+
+// getSchema returns the schema of s as JSON, or errNoSchema.
+func (s server) getSchema() (json.RawMessage, error) {
+	s.schema.mu.RLock()
+	defer s.schema.mu.RUnlock()
+	if s.schema.raw == nil {
+		return nil, errNoSchema
+	}
+	return s.schema.raw, nil
+}
+
+// InvalidDocument is a stored document that doesn't match a schema.
+type InvalidDocument struct {
+	ID  string
+	Err *ValidationError
+}
+
+// SetSchema makes schema, a JSON Schema or anything that marshals to
+// one, the schema that documents written to the collection must
+// match. Writes of documents that don't match return a
+// *ValidationError. A nil schema removes it. The documents already
+// stored aren't checked, see ValidateExisting.
+func (c *Collection) SetSchema(schema any) error {
+	return c.s.setSchema(schema)
+}
+
+// Schema returns the schema of the collection, or nil if it has none.
+func (c *Collection) Schema() json.RawMessage {
+	raw, _ := c.s.getSchema()
+	return raw
+}
+
+// ValidateExisting checks the stored documents of the collection
+// against schema, or the collection's schema if it's nil, and returns
+// the ones that don't match, in ID order, and the number checked.
+func (c *Collection) ValidateExisting(ctx context.Context, schema any) ([]InvalidDocument, int, error) {
+	compiled := c.s.schema.get()
+	if schema != nil {
+		var err error
+		compiled, err = compileSchema(schema)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if compiled == nil {
+		return nil, 0, errNoSchema
+	}
+
+	var invalid []InvalidDocument
+	checked := 0
+	err := c.s.scanDocuments(func(id string, document map[string]any) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		checked++
+		if err := validateDocument(compiled, document); err != nil {
+			invalid = append(invalid, InvalidDocument{ID: id, Err: err.(*ValidationError)})
+		}
+		return nil
+	})
+	return invalid, checked, err
+}
+
+// SetSchema sets the schema of the default collection. See
+// Collection.SetSchema.
+func (db *DB) SetSchema(schema any) error {
+	return db.def.SetSchema(schema)
+}
+
+// ValidateExisting checks the documents of the default collection.
+// See Collection.ValidateExisting.
+func (db *DB) ValidateExisting(ctx context.Context, schema any) ([]InvalidDocument, int, error) {
+	return db.def.ValidateExisting(ctx, schema)
+}
@@ -0,0 +1,238 @@
+package docdb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var personSchema = map[string]any{
+	"type":     "object",
+	"required": []any{"name"},
+	"properties": map[string]any{
+		"name":    map[string]any{"type": "string", "minLength": 1},
+		"age":     map[string]any{"type": "integer", "minimum": 0},
+		"email":   map[string]any{"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"tags":    map[string]any{"type": "array", "items": map[string]any{"type": "string"}, "uniqueItems": true},
+		"address": map[string]any{"$ref": "#/$defs/address"},
+	},
+	"additionalProperties": false,
+	"$defs": map[string]any{
+		"address": map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"city": map[string]any{"type": "string"}},
+		},
+	},
+}
+
+func Test_compileSchema(t *testing.T) {
+	tests := []struct {
+		schema any
+		err    string
+	}{
+		{personSchema, ""},
+		{true, ""},
+		{map[string]any{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "x"}, ""},
+		{map[string]any{"$schema": "http://json-schema.org/draft-07/schema#"}, "Unsupported $schema"},
+		{map[string]any{"type": "int"}, `Bad schema at #/type: unknown type "int"`},
+		{map[string]any{"properties": map[string]any{"a": map[string]any{"if": true}}}, `Bad schema at #/properties/a/if`},
+		{map[string]any{"minLength": -1}, "must be a non-negative integer"},
+		{map[string]any{"pattern": "("}, "bad pattern"},
+		{map[string]any{"$ref": "#/$defs/missing"}, "not found"},
+		{map[string]any{"anyOf": []any{}}, "non-empty array"},
+		{"string", "must be an object or boolean"},
+	}
+	for _, test := range tests {
+		_, err := compileSchema(test.schema)
+		if test.err == "" {
+			assert.Nil(t, err, "%v", test.schema)
+		} else if assert.Error(t, err, "%v", test.schema) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
+
+func Test_validate(t *testing.T) {
+	recursive := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"value":    map[string]any{"type": "number", "multipleOf": 0.5},
+			"children": map[string]any{"type": "array", "items": map[string]any{"$ref": "#"}},
+		},
+	}
+	tests := []struct {
+		schema   any
+		document map[string]any
+		errors   []SchemaError
+	}{
+		{personSchema, map[string]any{"name": "Kate", "age": float64(30), "tags": []any{"a", "b"}}, nil},
+		{personSchema, map[string]any{"age": float64(-1.5)}, []SchemaError{
+			{"", "required", `must have property "name"`},
+			{"/age", "type", "must be integer, not number"},
+		}},
+		{personSchema, map[string]any{"name": "", "email": "kate", "other": true}, []SchemaError{
+			{"/email", "pattern", `must match pattern "^[^@]+@[^@]+$"`},
+			{"/name", "minLength", "must be at least 1 characters long"},
+			{"/other", "false", "is not allowed"},
+		}},
+		{personSchema, map[string]any{"name": "Kate", "tags": []any{"a", "a", float64(1)}}, []SchemaError{
+			{"/tags", "uniqueItems", "must not have duplicate items, 0 and 1"},
+			{"/tags/2", "type", "must be string, not integer"},
+		}},
+		{personSchema, map[string]any{"name": "Kate", "address": map[string]any{"city": float64(1)}}, []SchemaError{
+			{"/address/city", "type", "must be string, not integer"},
+		}},
+		// Documents written from Go can hold any number type
+		{personSchema, map[string]any{"name": "Kate", "age": 30}, nil},
+		{recursive, map[string]any{"children": []any{map[string]any{"value": 1.5}}}, nil},
+		{recursive, map[string]any{"children": []any{map[string]any{"value": 1.2}}}, []SchemaError{
+			{"/children/0/value", "multipleOf", "must be a multiple of 0.5"},
+		}},
+		{map[string]any{"properties": map[string]any{
+			"kind":  map[string]any{"enum": []any{"a", "b"}},
+			"n":     map[string]any{"oneOf": []any{map[string]any{"type": "integer"}, map[string]any{"minimum": 0}}},
+			"fixed": map[string]any{"const": map[string]any{"x": float64(1)}},
+		}}, map[string]any{"kind": "c", "n": float64(1), "fixed": map[string]any{"x": 1}}, []SchemaError{
+			{"/kind", "enum", `must be one of ["a","b"]`},
+			{"/n", "oneOf", "must match exactly one schema in oneOf, not 2"},
+		}},
+	}
+	for _, test := range tests {
+		schema, err := compileSchema(test.schema)
+		assert.Nil(t, err)
+		err = validateDocument(schema, test.document)
+		if test.errors == nil {
+			assert.Nil(t, err, "%v", test.document)
+			continue
+		}
+		var validationErr *ValidationError
+		if assert.True(t, errors.As(err, &validationErr), "%v", test.document) {
+			assert.Equal(t, test.errors, validationErr.Errors, "%v", test.document)
+		}
+	}
+
+	// Schemas that only refer to themselves give up rather than recurse
+	loop, err := compileSchema(map[string]any{"$defs": map[string]any{"a": map[string]any{"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"})
+	assert.Nil(t, err)
+	assert.Error(t, validateDocument(loop, map[string]any{}))
+}
+
+func Test_schemaWrites(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "docdb.data")
+	db, err := Open(path, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not open database")
+	}
+	db.Put(ctx, "old", map[string]any{"age": "ten"})
+	people, err := db.CreateCollection("people", &Options{TTL: "1h"})
+	assert.Nil(t, err)
+	assert.Nil(t, db.SetSchema(personSchema))
+	assert.Error(t, db.SetSchema(map[string]any{"type": "int"}))
+	// _expires, which the TTL adds, isn't checked
+	assert.Nil(t, people.SetSchema(map[string]any{"properties": map[string]any{}, "additionalProperties": false}))
+
+	_, err = db.Put(ctx, "kate", map[string]any{"name": "Kate"})
+	assert.Nil(t, err)
+	_, err = db.Put(ctx, "bad", map[string]any{"name": 1})
+	var validationErr *ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	_, err = db.Get(ctx, "bad")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = people.Put(ctx, "phil", map[string]any{})
+	assert.Nil(t, err)
+	_, err = people.MergePatch(ctx, "phil", map[string]any{})
+	assert.Nil(t, err)
+	_, err = people.Put(ctx, "bad", map[string]any{"name": "Kate"})
+	assert.True(t, errors.As(err, &validationErr))
+
+	writer := db.NewBulkWriter(0)
+	writer.Put(ctx, "b1", map[string]any{"name": "Ana"})
+	writer.Put(ctx, "b2", map[string]any{})
+	results, err := writer.Flush(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, results[0].Err)
+	assert.True(t, errors.As(results[1].Err, &validationErr))
+
+	tx, err := db.Begin(ctx)
+	assert.Nil(t, err)
+	assert.True(t, errors.As(tx.Put(ctx, "t1", map[string]any{"name": false}), &validationErr))
+	tx.Rollback()
+
+	// Schemas are kept, and dropped with their collection
+	assert.Nil(t, db.Close())
+	db, err = Open(path, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not reopen database")
+	}
+	defer db.Close()
+	_, err = db.Put(ctx, "bad", map[string]any{"name": 1})
+	assert.Error(t, err)
+	people, _ = db.Collection("people")
+	assert.NotNil(t, people.Schema())
+	assert.Nil(t, db.DropCollection("people"))
+	people, err = db.CreateCollection("people", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, people.Schema())
+
+	invalid, checked, err := db.ValidateExisting(ctx, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, checked)
+	if assert.Equal(t, 1, len(invalid)) {
+		assert.Equal(t, "old", invalid[0].ID)
+		assert.Equal(t, []SchemaError{
+			{"", "required", `must have property "name"`},
+			{"/age", "type", "must be integer, not string"},
+		}, invalid[0].Err.Errors)
+	}
+	invalid, _, err = db.ValidateExisting(ctx, map[string]any{"type": "object"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(invalid))
+	_, _, err = people.ValidateExisting(ctx, nil)
+	assert.Equal(t, errNoSchema, err)
+}
+
+func Test_httpSchema(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	resp, _ := doRequest(t, s, "GET", "/_schema", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, body := doRequest(t, s, "PUT", "/_schema", `{"type": "object", "minimum": "one"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Bad schema at #/minimum: must be a number", body["error"])
+	resp, _ = doRequest(t, s, "PUT", "/_schema", `{"properties": {"age": {"type": "integer"}}}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body = doRequest(t, s, "GET", "/_schema", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]any{"properties": map[string]any{"age": map[string]any{"type": "integer"}}}, body["body"])
+
+	resp, body = doRequest(t, s, "PUT", "/docs/kate", `{"age": "old"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "Document doesn't match schema: /age must be integer, not string", body["error"])
+	assert.Equal(t, []any{map[string]any{"path": "/age", "keyword": "type", "message": "must be integer, not string"}}, body["errors"])
+	resp, body = doRequest(t, s, "POST", "/docs/_bulk", `{"id": "a", "body": {"age": 1}}
+{"id": "b", "body": {"age": 1.5}}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	results := body["body"].(map[string]any)["results"].([]any)
+	assert.Equal(t, float64(1), results[0].(map[string]any)["rev"])
+	assert.Equal(t, "/age", results[1].(map[string]any)["errors"].([]any)[0].(map[string]any)["path"])
+
+	resp, _ = doRequest(t, s, "PUT", "/collections/c", `{}`, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/collections/c/docs/kate", `{"age": "old"}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "DELETE", "/collections/c/_schema", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, s, "DELETE", "/_schema", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/docs/kate", `{"age": "old"}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -2,9 +2,8 @@
 
 set -e
 
-count=50
+# Loads the array of documents in $1, 50 times, with the bulk API
 for run in {1..50}; do
-    jq -c '.[]' "$1" | while read data; do
-	curl -X POST -H 'Content-Type: application/json' -d "$data" http://localhost:8080/docs
-    done
+    jq -c '.[] | {body: .}' "$1" |
+	curl -s -X POST -H 'Content-Type: application/x-ndjson' --data-binary @- http://localhost:8080/docs/_bulk > /dev/null
 done
@@ -0,0 +1,476 @@
+package docdb
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server is one collection of a database, the default collection
+// unless it's from collection. See collection.go.
+type server struct {
+	db   KV            // Primary data of the collection
+	idx  *indexStore   // Index data of every collection, see indexDb
+	cfg  *indexConfig  // Index options, may be nil
+	ids  *idGenerator  // Generates IDs for inserted documents
+	ttl  time.Duration // Lifetime of documents without _expires, or 0
+	feed *changeFeed   // Sequence numbers of the collection's changes
+
+	schema *collectionSchema // Schema of the collection's documents
+
+	name   string       // Collection name
+	prefix []byte       // Key prefix of the collection, nil for the default one
+	cols   *collections // Every collection of the database
+
+	// writeMu serialises writes, so that checking a document's
+	// revision and writing its new revision is atomic, and so that
+	// index and unindex never run at once for a document.
+	writeMu *sync.Mutex
+}
+
+// anyRevision can be passed to putDocument or deleteDocument as the
+// expected revision to write whatever the stored revision is.
+const anyRevision uint64 = math.MaxUint64
+
+// newServer returns a new database server with data on disk
+// at database. cfg may be nil to use the default index options.
+func newServer(database string, cfg *indexConfig) (*server, error) {
+	return newStorageServer(PebbleStorage(database), cfg)
+}
+
+// newMemoryServer returns a new database server with data in memory.
+func newMemoryServer(cfg *indexConfig) (*server, error) {
+	return newStorageServer(MemoryStorage(), cfg)
+}
+
+// newStorageServer returns a new database server with data in
+// storage. It's the default collection, with index options cfg.
+func newStorageServer(storage Storage, cfg *indexConfig) (*server, error) {
+	ids, _ := newIDGenerator("")
+	s := server{db: nil, cfg: cfg, ids: ids, name: DefaultCollection, writeMu: &sync.Mutex{}}
+	root, err := storage.OpenPrimary()
+	if err != nil {
+		return nil, err
+	}
+	// The default collection's documents are the keys that don't
+	// start with collectionNamespace
+	s.db = newPrefixKV(root, nil, []byte{collectionNamespace + 1})
+	s.cols = &collections{
+		root:   root,
+		byName: map[string]*server{DefaultCollection: &s},
+		hooks:  newWebhooks(),
+	}
+
+	err = upgradeMetaKeys(root)
+	if err == nil {
+		s.feed, err = loadChangeFeed(root, DefaultCollection)
+	}
+	if err == nil {
+		s.schema, err = loadSchema(root, DefaultCollection)
+	}
+	if err != nil {
+		root.Close()
+		return nil, err
+	}
+	s.idx, err = openIndexStore(storage)
+	if err == nil {
+		err = s.loadCollections()
+	}
+	if err != nil {
+		if s.idx != nil {
+			s.idx.db.Close()
+		}
+		root.Close()
+		return nil, err
+	}
+	return &s, nil
+}
+
+// addDocument adds and indexes document with id, replacing any
+// existing document.
+func (s server) addDocument(id string, document map[string]any) error {
+	_, err := s.putDocument(id, document, anyRevision)
+	return err
+}
+
+// putDocument adds and indexes document with id, if rev is the
+// revision of the stored document, and returns the document's
+// new revision. rev is 0 when there should be no stored document.
+// If rev doesn't match, returns ErrConflict.
+func (s server) putDocument(id string, document map[string]any, rev uint64) (uint64, error) {
+	if !validID(id) {
+		return 0, errBadID
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return 0, err
+	}
+
+	current, err := s.getRevision([]byte(id))
+	if err != nil {
+		return 0, err
+	}
+	if rev != anyRevision && rev != current {
+		return 0, ErrConflict
+	}
+	next, err := s.nextRevision([]byte(id), current)
+	if err != nil {
+		return 0, err
+	}
+	document, err = s.storedDocument(document)
+	if err != nil {
+		return 0, err
+	}
+
+	index(s.indexDb(), s.cfg, id, document)
+
+	bs, err := encodeDocument(document, next)
+	if err != nil {
+		return 0, err
+	}
+	b := s.db.NewBatch()
+	defer b.Close()
+	err = b.Set([]byte(id), bs)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := s.logChanges(b, Change{ID: id, Rev: next})
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.Apply(b)
+	if err != nil {
+		return 0, err
+	}
+	s.feed.publish(seq)
+
+	return next, s.updateShadow(id)
+}
+
+// deleteDocument removes the document with id from the database and
+// index, if rev is its revision. If rev doesn't match, returns
+// ErrConflict. If there's no document, returns ErrNotFound.
+func (s server) deleteDocument(id string, rev uint64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.writable(); err != nil {
+		return err
+	}
+
+	current, err := s.getRevision([]byte(id))
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return ErrNotFound
+	}
+	if rev != anyRevision && rev != current {
+		return ErrConflict
+	}
+
+	err = unindex(s.indexDb(), []byte(id))
+	if err != nil {
+		return err
+	}
+	b := s.db.NewBatch()
+	defer b.Close()
+	err = b.Delete([]byte(id))
+	if err != nil {
+		return err
+	}
+	seq, err := s.logChanges(b, Change{ID: id, Rev: current, Deleted: true})
+	if err != nil {
+		return err
+	}
+	err = s.db.Apply(b)
+	if err != nil {
+		return err
+	}
+	s.feed.publish(seq)
+	return s.updateShadow(id)
+}
+
+// getDocumentById returns a document for id, if it exists in the
+// database.
+func (s server) getDocumentById(id []byte) (map[string]any, error) {
+	document, _, err := s.getDocument(id)
+	return document, err
+}
+
+// getDocument returns a document for id and its revision, if it
+// exists in the database.
+func (s server) getDocument(id []byte) (map[string]any, uint64, error) {
+	return readDocument(s.db, id)
+}
+
+// getRevision returns the revision of the document for id, or 0 if
+// it doesn't exist.
+func (s server) getRevision(id []byte) (uint64, error) {
+	return readRevision(s.db, id)
+}
+
+// tombstoneKey returns the primary data key of the revision that the
+// document with id in collection name had when it was last deleted.
+// Tombstones are kept until the collection is dropped, so that a
+// document created again carries on from that revision.
+func tombstoneKey(name, id string) []byte {
+	return metaKey(tombstoneMeta, name, []byte(id))
+}
+
+// nextRevision returns the revision of the next write of the document
+// for id, whose stored revision is current. Revisions carry on from
+// the last deleted revision, so an ID never has the same revision
+// twice.
+func (s server) nextRevision(id []byte, current uint64) (uint64, error) {
+	if current > 0 {
+		return current + 1, nil
+	}
+	deleted, err := s.deletedRevision(id)
+	return deleted + 1, err
+}
+
+// lastRevision returns the revision of the document for id, or if it
+// doesn't exist, its deletedRevision.
+func (s server) lastRevision(id []byte) (uint64, error) {
+	current, err := s.getRevision(id)
+	if err != nil || current > 0 {
+		return current, err
+	}
+	return s.deletedRevision(id)
+}
+
+// deletedRevision returns the revision the document for id had when
+// it was last deleted, or 0 if it never was.
+func (s server) deletedRevision(id []byte) (uint64, error) {
+	value, closer, err := s.cols.root.Get(tombstoneKey(s.name, string(id)))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+	rev, _ := binary.Uvarint(value)
+	return rev, nil
+}
+
+// readDocument returns the document for id in db and its revision.
+func readDocument(db KVReader, id []byte) (map[string]any, uint64, error) {
+	valBytes, closer, err := db.Get(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closer.Close()
+
+	return decodeDocument(valBytes)
+}
+
+// readRevision returns the revision of the document for id in db, or
+// 0 if it doesn't exist.
+func readRevision(db KVReader, id []byte) (uint64, error) {
+	valBytes, closer, err := db.Get(id)
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer closer.Close()
+
+	return decodeRevision(valBytes)
+}
+
+// snapshot returns snapshots of the index and primary data taken at
+// the same point. Writes hold writeMu while updating both databases,
+// so taking the snapshots under it means that neither sees a write
+// the other doesn't. The caller must hold s.idx.mu for reading
+// until it has closed both.
+func (s server) snapshot() (KVSnapshot, KVSnapshot) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.indexDb().NewSnapshot(), s.db.NewSnapshot()
+}
+
+// searchDocuments returns the documents matching q. When q contains
+// full-text comparisons, documents are ordered by their BM25 score,
+// highest first.
+//
+// The query runs against snapshots of the index and primary data, so
+// its clauses and the documents returned all see the same writes.
+func (s server) searchDocuments(q *query) (map[string]any, error) {
+	results, err := s.find(q)
+	if err != nil {
+		return nil, err
+	}
+	return formatResults(results), nil
+}
+
+// find returns the documents matching q, as described by
+// searchDocuments.
+func (s server) find(q *query) ([]searchResult, error) {
+	s.idx.mu.RLock()
+	defer s.idx.mu.RUnlock()
+	indexSnap, snap := s.snapshot()
+	defer indexSnap.Close()
+	defer snap.Close()
+
+	return findDocuments(indexSnap, snap, s.cfg, q)
+}
+
+// searchResult is a document matching a query.
+type searchResult struct {
+	id       string
+	document map[string]any
+	rev      uint64
+	score    float64
+}
+
+// findDocuments returns the documents matching q, using the index in
+// indexDb and the primary data in db, in the order described by
+// searchDocuments.
+func findDocuments(indexDb, db KVReader, cfg *indexConfig, q *query) ([]searchResult, error) {
+	ids, err := searchIndex(indexDb, cfg, q)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := map[string]float64{}
+	for _, argument := range q.ands {
+		if argument.op != "~" {
+			continue
+		}
+		textScores, err := scoreText(
+			indexDb, strings.Join(argument.key, "."), argument.value.(string), ids)
+		if err != nil {
+			return nil, err
+		}
+		for id, score := range textScores {
+			scores[id] += score
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	results := []searchResult{}
+	for _, id := range ids {
+		document, rev, err := readDocument(db, []byte(id))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, searchResult{id, document, rev, scores[id]})
+	}
+	return results, nil
+}
+
+// formatResults returns results in the shape of the search API's
+// response.
+func formatResults(results []searchResult) map[string]any {
+	documents := []any{}
+	for _, r := range results {
+		documents = append(documents, map[string]any{
+			"id":    r.id,
+			"body":  r.document,
+			"score": r.score,
+		})
+	}
+	return map[string]any{"documents": documents, "count": len(documents)}
+}
+
+// getValueAtPath returns the value at path parts for doc. If not found,
+// returns nil, false.
+func getValueAtPath(doc map[string]any, parts []string) (any, bool) {
+	var docSegment any = doc
+	for _, part := range parts {
+		m, ok := docSegment.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		if docSegment, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return docSegment, true
+}
+
+// match returns true if this query q matches doc
+// func (q query) match(doc map[string]any) bool {
+// 	for _, argument := range q.ands {
+// 		value, ok := getValueAtPath(doc, argument.key)
+// 		if !ok {
+// 			return false
+// 		}
+
+// 		// Handle equality
+// 		if argument.op == "=" {
+// 			match := fmt.Sprintf("%v", value) == argument.value
+// 			if !match {
+// 				return false
+// 			}
+
+// 			continue
+// 		}
+
+// 		// Handle <, >
+// 		right, err := strconv.ParseFloat(argument.value, 64)
+// 		if err != nil {
+// 			return false
+// 		}
+
+// 		var left float64
+// 		switch t := value.(type) {
+// 		case float64:
+// 			left = t
+// 		case float32:
+// 			left = float64(t)
+// 		case uint:
+// 			left = float64(t)
+// 		case uint8:
+// 			left = float64(t)
+// 		case uint16:
+// 			left = float64(t)
+// 		case uint32:
+// 			left = float64(t)
+// 		case uint64:
+// 			left = float64(t)
+// 		case int:
+// 			left = float64(t)
+// 		case int8:
+// 			left = float64(t)
+// 		case int16:
+// 			left = float64(t)
+// 		case int32:
+// 			left = float64(t)
+// 		case int64:
+// 			left = float64(t)
+// 		case string:
+// 			left, err = strconv.ParseFloat(t, 64)
+// 			if err != nil {
+// 				return false
+// 			}
+// 		default:
+// 			return false
+// 		}
+
+// 		if argument.op == ">" {
+// 			if left <= right {
+// 				return false
+// 			}
+
+// 			continue
+// 		}
+
+// 		if left >= right {
+// 			return false
+// 		}
+// 	}
+
+// 	return true
+// }
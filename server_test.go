@@ -0,0 +1,501 @@
+package docdb
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getValueAtPath(t *testing.T) {
+	tests := []struct {
+		object        map[string]any
+		path          []string
+		expectedValue any
+		expectedOk    bool
+	}{
+		{
+			map[string]any{
+				"a": map[string]any{
+					"b": 1,
+				},
+			},
+			[]string{"a", "b"},
+			1,
+			true,
+		},
+		{
+			map[string]any{
+				"a": map[string]any{
+					"b": 1,
+				},
+			},
+			[]string{"a", "c"},
+			nil,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		v, ok := getValueAtPath(test.object, test.path)
+		assert.Equal(t, test.expectedValue, v)
+		assert.Equal(t, test.expectedOk, ok)
+	}
+}
+func Test_lookupEq(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike",
+		map[string]any{
+			"name": "mike",
+			"age":  40,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("phil",
+		map[string]any{
+			"name": "phil",
+			"age":  30,
+			"pet":  "cat",
+		},
+	)
+
+	ids, _ := lookupEq(s.idx.db, nil, "name", "mike")
+	assert.ElementsMatch(t, []string{"mike"}, ids, "lookupEq mike")
+	ids, _ = lookupEq(s.idx.db, nil, "name", "fred")
+	assert.ElementsMatch(t, []string{}, ids, "lookupEq fred")
+
+	ids, _ = lookupEq(s.idx.db, nil, "age", 40)
+	assert.ElementsMatch(t, []string{"mike"}, ids, "lookupEq age 40")
+	ids, _ = lookupEq(s.idx.db, nil, "age", "mike")
+	assert.ElementsMatch(t, []string{}, ids, "lookupEq age mike")
+	ids, _ = lookupEq(s.idx.db, nil, "age", "40")
+	assert.ElementsMatch(t, []string{}, ids, "lookupEq age string 40")
+
+	ids, _ = lookupEq(s.idx.db, nil, "pet", "cat")
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids, "lookupEq pet cat")
+}
+
+func Test_lookupGE(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike",
+		map[string]any{
+			"name": "mike",
+			"age":  40,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("phil",
+		map[string]any{
+			"name": "phil",
+			"age":  30,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("funny",
+		map[string]any{
+			"name": 1,
+			"age":  nil,
+			"pet":  false,
+		},
+	)
+
+	var ids []string
+
+	ids, _ = lookupGTE(s.idx.db, nil, "name", "mike")
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "name", "ned")
+	assert.ElementsMatch(t, []string{"phil"}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "name", "tom")
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "name", 1234)
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "name", true)
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+
+	ids, _ = lookupGTE(s.idx.db, nil, "age", 20)
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "age", 40)
+	assert.ElementsMatch(t, []string{"mike"}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "age", 400)
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "age", "mike")
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGTE(s.idx.db, nil, "age", "40")
+	assert.ElementsMatch(t, []string{}, ids)
+
+	ids, _ = lookupGTE(s.idx.db, nil, "pet", "cat")
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids)
+
+	// Check we don't bleed into other fields greater than this one
+	// Ie, age < name in the byte array prefixes
+	ids, _ = lookupGTE(s.idx.db, nil, "age", 400000)
+	assert.ElementsMatch(t, []string{}, ids)
+}
+
+func Test_lookupGT(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike",
+		map[string]any{
+			"name": "mike",
+			"age":  40,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("phil",
+		map[string]any{
+			"name": "phil",
+			"age":  30,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("funny",
+		map[string]any{
+			"name": 1,
+			"age":  nil,
+			"pet":  false,
+		},
+	)
+
+	var ids []string
+
+	ids, _ = lookupGT(s.idx.db, nil, "name", "ned")
+	assert.ElementsMatch(t, []string{"phil"}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "name", "tom")
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "name", 1234)
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "name", true)
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "name", "mike")
+	assert.ElementsMatch(t, []string{"phil"}, ids)
+
+	ids, _ = lookupGT(s.idx.db, nil, "age", 20)
+	assert.ElementsMatch(t, []string{"mike", "phil"}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "age", 40)
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "age", 400)
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "age", "mike")
+	assert.ElementsMatch(t, []string{}, ids)
+	ids, _ = lookupGT(s.idx.db, nil, "age", "40")
+	assert.ElementsMatch(t, []string{}, ids)
+
+	ids, _ = lookupGT(s.idx.db, nil, "pet", "cat")
+	assert.ElementsMatch(t, []string{}, ids)
+
+	// Check we don't bleed into other fields greater than this one
+	// Ie, age < name in the byte array prefixes
+	ids, _ = lookupGT(s.idx.db, nil, "age", 400000)
+	assert.ElementsMatch(t, []string{}, ids)
+}
+
+func Test_lookupLT(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike",
+		map[string]any{
+			"name": "mike",
+			"age":  40,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("phil",
+		map[string]any{
+			"name": "phil",
+			"age":  30,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("funny",
+		map[string]any{
+			"name": 12,
+			"age":  nil,
+			"pet":  false,
+		},
+	)
+
+	var ids []string
+
+	ids, _ = lookupLT(s.idx.db, nil, "name", "mike")
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "name", "ned")
+	assert.ElementsMatch(t, []string{"mike", "funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "name", "tom")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "name", 1234)
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "name", true)
+	assert.ElementsMatch(t, []string{}, ids)
+
+	ids, _ = lookupLT(s.idx.db, nil, "age", 20)
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "age", 40)
+	assert.ElementsMatch(t, []string{"phil", "funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "age", 400)
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "age", "mike")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "age", "10")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "age", nil)
+	assert.ElementsMatch(t, []string{}, ids)
+
+	ids, _ = lookupLT(s.idx.db, nil, "pet", "cat")
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+	ids, _ = lookupLT(s.idx.db, nil, "pet", nil)
+	assert.ElementsMatch(t, []string{}, ids)
+
+	// // Check we don't bleed into other fields lower than this one
+	// // Ie, name > age in the byte array prefixes
+	ids, _ = lookupLT(s.idx.db, nil, "name", 11) // funny is 12
+	assert.ElementsMatch(t, []string{}, ids)
+}
+
+func Test_lookupLTE(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("mike",
+		map[string]any{
+			"name": "mike",
+			"age":  40,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("phil",
+		map[string]any{
+			"name": "phil",
+			"age":  30,
+			"pet":  "cat",
+		},
+	)
+	s.addDocument("funny",
+		map[string]any{
+			"name": 12,
+			"age":  nil,
+			"pet":  false,
+		},
+	)
+
+	var ids []string
+
+	ids, _ = lookupLTE(s.idx.db, nil, "name", "mike")
+	assert.ElementsMatch(t, []string{"mike", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "name", "ned")
+	assert.ElementsMatch(t, []string{"mike", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "name", "tom")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "name", 1234)
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "name", true)
+	assert.ElementsMatch(t, []string{}, ids)
+
+	ids, _ = lookupLTE(s.idx.db, nil, "age", 20)
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "age", 40)
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "age", 400)
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "age", "mike")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "age", "10")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "age", nil)
+	assert.ElementsMatch(t, []string{"funny"}, ids)
+
+	ids, _ = lookupLTE(s.idx.db, nil, "pet", "cat")
+	assert.ElementsMatch(t, []string{"mike", "phil", "funny"}, ids)
+	ids, _ = lookupLTE(s.idx.db, nil, "pet", nil)
+	assert.ElementsMatch(t, []string{}, ids)
+
+	// Check we don't bleed into other fields lower than this one
+	// Ie, name > age in the byte array prefixes
+	ids, _ = lookupLTE(s.idx.db, nil, "name", 11) // funny is 12
+	assert.ElementsMatch(t, []string{}, ids)
+}
+
+func Test_searchDocuments(t *testing.T) {
+	s, err := newMemoryServer(&indexConfig{fullText: []string{"description"}})
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("docdb",
+		map[string]any{
+			"description": "A fast database for JSON documents",
+			"stars":       10,
+		},
+	)
+	s.addDocument("pebble",
+		map[string]any{
+			"description": "Fast database",
+			"stars":       100,
+		},
+	)
+	s.addDocument("bolt",
+		map[string]any{
+			"description": "An embedded key value database",
+			"stars":       50,
+		},
+	)
+
+	q, _ := parseQuery(`description:~"fast database"`)
+	result, err := s.searchDocuments(q)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.Equal(t, 2, result["count"])
+	documents := result["documents"].([]any)
+	assert.Equal(t, "pebble", documents[0].(map[string]any)["id"])
+	assert.Equal(t, "docdb", documents[1].(map[string]any)["id"])
+
+	q, _ = parseQuery(`description:~database stars:>20`)
+	result, err = s.searchDocuments(q)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.Equal(t, 2, result["count"])
+}
+
+func Test_putDocument(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	rev, err := s.putDocument("mike", map[string]any{"age": 40}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), rev)
+
+	// Creating again fails, as does updating a stale revision
+	_, err = s.putDocument("mike", map[string]any{"age": 41}, 0)
+	assert.Equal(t, ErrConflict, err)
+	rev, err = s.putDocument("mike", map[string]any{"age": 41}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), rev)
+	_, err = s.putDocument("mike", map[string]any{"age": 42}, 1)
+	assert.Equal(t, ErrConflict, err)
+
+	doc, rev, err := s.getDocument([]byte("mike"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), rev)
+	assert.Equal(t, 41.0, doc["age"])
+	ids, _ := lookupEq(s.idx.db, nil, "age", 41)
+	assert.ElementsMatch(t, []string{"mike"}, ids)
+
+	rev, err = s.putDocument("mike", map[string]any{"age": 43}, anyRevision)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), rev)
+
+	assert.Equal(t, ErrConflict, s.deleteDocument("mike", 2))
+	assert.NoError(t, s.deleteDocument("mike", 3))
+	assert.Equal(t, ErrNotFound, s.deleteDocument("mike", anyRevision))
+	_, _, err = s.getDocument([]byte("mike"))
+	assert.Equal(t, ErrNotFound, err)
+	ids, _ = lookupEq(s.idx.db, nil, "age", 43)
+	assert.ElementsMatch(t, []string{}, ids)
+
+	// Created again, it carries on from the deleted revision, so
+	// that a writer holding revision 1 can't overwrite it
+	rev, err = s.putDocument("mike", map[string]any{"age": 44}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), rev)
+	_, err = s.putDocument("mike", map[string]any{"age": 45}, 1)
+	assert.Equal(t, ErrConflict, err)
+	results, _ := s.bulkWrite([]bulkWrite{{id: "mike", document: map[string]any{}, rev: 4}})
+	assert.Equal(t, uint64(5), results[0].Rev)
+}
+
+// Racing writers with the same expected revision must not both
+// succeed, or one of their updates is lost.
+func Test_putDocumentRace(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	rev, _ := s.putDocument("counter", map[string]any{"n": 0}, 0)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := s.putDocument("counter", map[string]any{"n": i}, rev)
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, succeeded)
+	_, rev, _ = s.getDocument([]byte("counter"))
+	assert.Equal(t, uint64(2), rev)
+}
+
+// A query must see a single point in time, so a document moving
+// between values is never returned with a body that doesn't match.
+func Test_searchDocumentsSnapshot(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.addDocument("flag", map[string]any{"color": "red", "shade": "red"})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			color := []string{"red", "blue"}[i%2]
+			s.addDocument("flag", map[string]any{"color": color, "shade": color})
+		}
+	}()
+
+	q, _ := parseQuery("color:red shade:red")
+	for i := 0; i < 200; i++ {
+		result, err := s.searchDocuments(q)
+		if err != nil {
+			t.Fatalf("Failed due to error: %v", err)
+		}
+		for _, document := range result["documents"].([]any) {
+			body := document.(map[string]any)["body"].(map[string]any)
+			assert.Equal(t, "red", body["color"])
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// Writes after a snapshot aren't visible through it
+	indexSnap, snap := s.snapshot()
+	defer indexSnap.Close()
+	defer snap.Close()
+	s.addDocument("flag", map[string]any{"color": "green"})
+	results, _ := findDocuments(indexSnap, snap, nil, q)
+	for _, r := range results {
+		assert.NotEqual(t, "green", r.document["color"])
+	}
+	doc, _, _ := readDocument(snap, []byte("flag"))
+	assert.NotEqual(t, "green", doc["color"])
+}
@@ -0,0 +1,307 @@
+package docdb
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// This file contains transactions, which write several documents
+// so that either all of the writes happen or none do.
+//
+// A transaction stages its writes in two indexed batches, one for
+// the primary data and one for the index. Reads and queries in the
+// transaction go through the batches, so they see its own writes
+// on top of the committed data.
+//
+// Transactions are optimistic. The first time a transaction reads
+// or writes a document, it records the document's last committed
+// revision, which is its revision when it was deleted if it doesn't
+// exist. Commit fails with ErrConflict, writing nothing, if any of
+// those revisions has since changed. Documents returned by a
+// query count as read, but a document that starts to match the
+// query after it ran isn't detected as a conflict.
+//
+// Primary data and index are separate databases, so Commit applies
+// the two batches one after the other while holding the server's
+// write lock. As with putDocument, the index is written first.
+//
+// A transaction only holds the index for reading while it uses it,
+// so a reindex can replace the index during a transaction. The
+// transaction's index batch is on the replaced index, so from then
+// on it fails with ErrConflict.
+
+// errTxnDone is returned when a transaction is used after it was
+// committed or rolled back.
+var errTxnDone = errors.New("Transaction is already committed or rolled back")
+
+// Txn is a transaction on a collection, started by Collection.Begin.
+// It must be committed or rolled back. It isn't safe for concurrent
+// use.
+type Txn struct {
+	s       server
+	db      KVBatch // Staged primary data writes
+	indexDb KVBatch // Staged index writes
+	idx     KV      // The live index when the transaction began
+
+	// revs holds the last committed revision of each document the
+	// transaction has read or written, see lastRevision, and existed
+	// whether it existed.
+	revs    map[string]uint64
+	existed map[string]bool
+	done    bool
+}
+
+// begin starts a new transaction.
+func (s server) begin() *Txn {
+	s.idx.mu.RLock()
+	defer s.idx.mu.RUnlock()
+	return &Txn{
+		s:       s,
+		db:      s.db.NewBatch(),
+		indexDb: s.indexDb().NewBatch(),
+		idx:     s.idx.db,
+		revs:    map[string]uint64{},
+		existed: map[string]bool{},
+	}
+}
+
+// lockIndex holds the index for reading, for the transaction to use
+// its index batch, and returns the function that releases it. If the
+// index was replaced since the transaction began, it returns
+// ErrConflict instead.
+func (t *Txn) lockIndex() (func(), error) {
+	t.s.idx.mu.RLock()
+	if t.s.idx.db != t.idx {
+		t.s.idx.mu.RUnlock()
+		return nil, ErrConflict
+	}
+	return t.s.idx.mu.RUnlock, nil
+}
+
+// observe records the last committed revision of the document for
+// id, if it's not already recorded.
+func (t *Txn) observe(id string) error {
+	if _, ok := t.revs[id]; ok {
+		return nil
+	}
+	rev, err := t.s.getRevision([]byte(id))
+	if err != nil {
+		return err
+	}
+	t.existed[id] = rev > 0
+	if rev == 0 {
+		rev, err = t.s.deletedRevision([]byte(id))
+		if err != nil {
+			return err
+		}
+	}
+	t.revs[id] = rev
+	return nil
+}
+
+// Get returns the document with id as seen by the transaction,
+// including its own writes, or ErrNotFound.
+func (t *Txn) Get(ctx context.Context, id string) (*Document, error) {
+	if t.done {
+		return nil, errTxnDone
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := t.observe(id); err != nil {
+		return nil, err
+	}
+	body, rev, err := readDocument(t.db, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return &Document{ID: id, Rev: rev, Body: body}, nil
+}
+
+// Put stages storing body as the document with id, replacing any
+// existing document.
+func (t *Txn) Put(ctx context.Context, id string, body map[string]any) error {
+	if t.done {
+		return errTxnDone
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !validID(id) {
+		return errBadID
+	}
+	if err := t.observe(id); err != nil {
+		return err
+	}
+	document, err := t.s.storedDocument(body)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := t.lockIndex()
+	if err != nil {
+		return err
+	}
+	err = indexBatch(t.indexDb, t.s.cfg, id, document)
+	unlock()
+	if err != nil {
+		return err
+	}
+	bs, err := encodeDocument(document, t.revs[id]+1)
+	if err != nil {
+		return err
+	}
+	return t.db.Set([]byte(id), bs)
+}
+
+// Delete stages removing the document with id. If there's no
+// document, as seen by the transaction, it returns ErrNotFound.
+func (t *Txn) Delete(ctx context.Context, id string) error {
+	if t.done {
+		return errTxnDone
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := t.observe(id); err != nil {
+		return err
+	}
+
+	_, closer, err := t.db.Get([]byte(id))
+	if err != nil {
+		return err
+	}
+	closer.Close()
+
+	unlock, err := t.lockIndex()
+	if err != nil {
+		return err
+	}
+	err = unindexBatch(t.indexDb, []byte(id))
+	unlock()
+	if err != nil {
+		return err
+	}
+	return t.db.Delete([]byte(id))
+}
+
+// Find returns the documents matching query as seen by the
+// transaction, ordered as by Collection.Find. They count as read by
+// the transaction.
+func (t *Txn) Find(ctx context.Context, query string) ([]Document, error) {
+	if t.done {
+		return nil, errTxnDone
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
+
+	unlock, err := t.lockIndex()
+	if err != nil {
+		return nil, err
+	}
+	results, err := findDocuments(t.indexDb, t.db, t.s.cfg, q)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range results {
+		if err := t.observe(r.id); err != nil {
+			return nil, err
+		}
+	}
+	return newDocuments(results), nil
+}
+
+// Commit applies the transaction's writes. If a document it read or
+// wrote has changed since, or the index was replaced by a reindex,
+// nothing is written and Commit returns ErrConflict. The transaction
+// can't be used afterwards.
+//
+// The index and the documents are written in two separate batches,
+// not one atomic one: other readers never see half of the
+// transaction, but a crash between the batches leaves index entries
+// for documents that weren't written, which `docdb check -repair`
+// removes.
+func (t *Txn) Commit(ctx context.Context) error {
+	if t.done {
+		return errTxnDone
+	}
+	defer t.Rollback()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock, err := t.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	t.s.writeMu.Lock()
+	defer t.s.writeMu.Unlock()
+	if err := t.s.writable(); err != nil {
+		return err
+	}
+
+	for id, rev := range t.revs {
+		last, err := t.s.lastRevision([]byte(id))
+		if err != nil {
+			return err
+		}
+		if last != rev {
+			return ErrConflict
+		}
+	}
+
+	written := make([]string, 0, len(t.revs))
+	for id := range t.revs {
+		written = append(written, id)
+	}
+	sort.Strings(written)
+
+	// Documents that were only read keep their revision
+	var changes []Change
+	for _, id := range written {
+		rev, err := readRevision(t.db, []byte(id))
+		if err != nil {
+			return err
+		}
+		if rev > 0 && rev != t.revs[id] {
+			changes = append(changes, Change{ID: id, Rev: rev})
+		} else if rev == 0 && t.existed[id] {
+			changes = append(changes, Change{ID: id, Rev: t.revs[id], Deleted: true})
+		}
+	}
+	seq, err := t.s.logChanges(t.db, changes...)
+	if err != nil {
+		return err
+	}
+
+	err = t.s.indexDb().Apply(t.indexDb)
+	if err != nil {
+		return err
+	}
+	err = t.s.db.Apply(t.db)
+	if err != nil {
+		return err
+	}
+	t.s.feed.publish(seq)
+
+	return t.s.updateShadow(written...)
+}
+
+// Rollback discards the transaction's writes. It does nothing if the
+// transaction is already committed or rolled back.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+	t.db.Close()
+	t.indexDb.Close()
+}
@@ -0,0 +1,112 @@
+package docdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_txn(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	ctx := context.Background()
+	s.addDocument("alice", map[string]any{"balance": 100.0})
+	s.addDocument("bob", map[string]any{"balance": 50.0})
+
+	// Transfer, reading our own writes
+	tx := s.begin()
+	alice, _ := tx.Get(ctx, "alice")
+	bob, _ := tx.Get(ctx, "bob")
+	tx.Put(ctx, "alice", map[string]any{"balance": alice.Body["balance"].(float64) - 30})
+	tx.Put(ctx, "bob", map[string]any{"balance": bob.Body["balance"].(float64) + 30})
+	alice, _ = tx.Get(ctx, "alice")
+	assert.Equal(t, 70.0, alice.Body["balance"])
+	assert.Equal(t, uint64(2), alice.Rev)
+
+	documents, err := tx.Find(ctx, "balance:>60")
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	assert.Equal(t, 2, len(documents))
+	_, err = tx.Find(ctx, "balance:")
+	var queryErr *QueryError
+	assert.True(t, errors.As(err, &queryErr))
+
+	q, _ := parseQuery("balance:>60")
+
+	// Nothing is visible outside until commit
+	result, _ := s.searchDocuments(q)
+	assert.Equal(t, 1, result["count"])
+	assert.Nil(t, tx.Commit(ctx))
+	result, _ = s.searchDocuments(q)
+	assert.Equal(t, 2, result["count"])
+	_, rev, _ := s.getDocument([]byte("bob"))
+	assert.Equal(t, uint64(2), rev)
+	assert.Equal(t, errTxnDone, tx.Commit(ctx))
+
+	// Rollback discards the writes
+	tx = s.begin()
+	assert.Nil(t, tx.Delete(ctx, "alice"))
+	tx.Put(ctx, "carol", map[string]any{"balance": 10.0})
+	_, err = tx.Get(ctx, "alice")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, tx.Delete(ctx, "alice"))
+	tx.Rollback()
+	_, err = tx.Get(ctx, "alice")
+	assert.Equal(t, errTxnDone, err)
+	_, err = s.getDocumentById([]byte("alice"))
+	assert.Nil(t, err)
+	_, err = s.getDocumentById([]byte("carol"))
+	assert.Equal(t, ErrNotFound, err)
+
+	// A concurrent write to a document read by the transaction
+	// fails it as a whole
+	tx = s.begin()
+	tx.Get(ctx, "alice")
+	tx.Put(ctx, "bob", map[string]any{"balance": 0.0})
+	s.addDocument("alice", map[string]any{"balance": 1.0})
+	assert.Equal(t, ErrConflict, tx.Commit(ctx))
+	body, _ := s.getDocumentById([]byte("bob"))
+	assert.Equal(t, 80.0, body["balance"])
+
+	// As does creating a document the transaction creates
+	tx = s.begin()
+	tx.Put(ctx, "dave", map[string]any{"balance": 1.0})
+	s.addDocument("dave", map[string]any{"balance": 2.0})
+	assert.Equal(t, ErrConflict, tx.Commit(ctx))
+
+	// Deletes are committed to the index too
+	tx = s.begin()
+	assert.Nil(t, tx.Delete(ctx, "bob"))
+	assert.Nil(t, tx.Commit(ctx))
+	result, _ = s.searchDocuments(q)
+	assert.Equal(t, 0, result["count"])
+
+	// A document deleted and created again meanwhile is a conflict,
+	// and revisions carry on after a delete
+	tx = s.begin()
+	tx.Get(ctx, "bob")
+	s.addDocument("bob", map[string]any{"balance": 1.0})
+	s.deleteDocument("bob", anyRevision)
+	assert.Equal(t, ErrConflict, tx.Commit(ctx))
+	tx = s.begin()
+	assert.Nil(t, tx.Put(ctx, "bob", map[string]any{"balance": 2.0}))
+	assert.Nil(t, tx.Commit(ctx))
+	_, rev, _ = s.getDocument([]byte("bob"))
+	assert.Equal(t, uint64(4), rev)
+
+	// An open transaction doesn't hold up a reindex, but fails after
+	// it
+	tx = s.begin()
+	assert.Nil(t, tx.Put(ctx, "erin", map[string]any{"balance": 5.0}))
+	assert.Nil(t, s.reindex(reindexOptions{batchSize: 10}))
+	_, err = tx.Find(ctx, "balance:>60")
+	assert.Equal(t, ErrConflict, err)
+	assert.Equal(t, ErrConflict, tx.Commit(ctx))
+	_, err = s.getDocumentById([]byte("erin"))
+	assert.Equal(t, ErrNotFound, err)
+}
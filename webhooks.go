@@ -0,0 +1,544 @@
+package docdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains webhooks, which POST to a URL when a document of
+// a collection starts or stops matching a query.
+//
+// Each webhook follows its collection's change feed. For each change
+// that's still the latest of its document, it checks whether the
+// document matches the query, by indexing the document on its own in
+// memory and running the query against that, and compares this with
+// whether it matched before, which is kept as a set of the matching
+// IDs. Older changes are skipped, as the document they wrote is gone,
+// so a webhook that falls behind doesn't see every state a document
+// passed through, only its latest. When they differ, the event is
+// delivered, retrying with backoff until the receiver accepts it with
+// a 2xx status. The webhook's cursor, the sequence number of the last
+// change handled, and the set of matching IDs are then written
+// together, so after a restart delivery carries on from the cursor
+// and an event may be delivered again, but none are lost.
+//
+// A webhook starts from the point it's created, with the set of
+// documents that match then, so only later writes are delivered.
+//
+// Webhooks are kept in primary data: each under webhookKey, holding
+// its webhookRecord as JSON, and its set of matching IDs under
+// webhookMatchKey. Delivery runs in the background once
+// StartWebhooks is called, a goroutine for each webhook.
+
+var (
+	// ErrNoWebhook is returned for webhooks that don't exist.
+	ErrNoWebhook = errors.New("Webhook not found")
+	// errBadWebhookName is returned for names that aren't allowed.
+	errBadWebhookName = errors.New("Webhook names must be 1 to 64 lower case letters, digits, - or _")
+	// errBadWebhookURL is returned for webhooks without an HTTP URL.
+	errBadWebhookURL = errors.New("Webhook URLs must be http or https")
+)
+
+// Webhook POSTs the documents of a collection that start or stop
+// matching Query to URL.
+type Webhook struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	URL   string `json:"url"`
+}
+
+// webhookRecord is how a webhook is stored.
+type webhookRecord struct {
+	Query  string `json:"query"`
+	URL    string `json:"url"`
+	Cursor uint64 `json:"cursor"` // Last sequence number handled
+}
+
+// webhookEvent is the body POSTed to a webhook's URL.
+type webhookEvent struct {
+	Webhook    string         `json:"webhook"`
+	Collection string         `json:"collection"`
+	Event      string         `json:"event"` // "match" or "unmatch"
+	Seq        uint64         `json:"seq"`
+	ID         string         `json:"id"`
+	Rev        uint64         `json:"rev"`
+	Deleted    bool           `json:"deleted,omitempty"`
+	Document   map[string]any `json:"document,omitempty"` // Unless deleted
+}
+
+// webhooksPrefix returns the primary data key prefix of the webhooks
+// of collection name.
+func webhooksPrefix(name string) []byte {
+	return metaKey(webhooksMeta, name, nil)
+}
+
+// webhookKey returns the primary data key of webhook hook of
+// collection name.
+func webhookKey(name, hook string) []byte {
+	return append(webhooksPrefix(name), hook...)
+}
+
+// webhookMatchKey returns the primary data key recording that the
+// document with id matches the query of webhook hook.
+func webhookMatchKey(name, hook, id string) []byte {
+	return packTuple(webhookKey(name, hook), []byte(id))
+}
+
+// webhooks runs the delivery of the webhooks of a database.
+type webhooks struct {
+	client *http.Client
+	retry  time.Duration // Delay before the first retry, doubling each time
+	// maxRetry caps the delay between retries.
+	maxRetry time.Duration
+
+	mu      sync.Mutex
+	started bool
+	workers map[string]*webhookWorker // By collection and webhook name
+	running sync.WaitGroup
+}
+
+// webhookWorker is the delivery of one webhook.
+type webhookWorker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newWebhooks() *webhooks {
+	return &webhooks{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		retry:    time.Second,
+		maxRetry: time.Minute,
+		workers:  map[string]*webhookWorker{},
+	}
+}
+
+// workerKey returns the key in webhooks.workers of webhook hook of
+// collection name.
+func workerKey(name, hook string) string {
+	return name + "/" + hook
+}
+
+// start starts delivering webhook hook of s, if webhooks are started.
+func (w *webhooks) start(s server, hook string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key := workerKey(s.name, hook)
+	if !w.started || w.workers[key] != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := &webhookWorker{cancel: cancel, done: make(chan struct{})}
+	w.workers[key] = worker
+	w.running.Add(1)
+	go func() {
+		defer w.running.Done()
+		defer close(worker.done)
+		err := s.runWebhook(ctx, hook)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Webhook %s stopped: %v", key, err)
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.workers[key] == worker {
+			delete(w.workers, key)
+		}
+	}()
+}
+
+// stop stops delivering the webhooks of collection name for which
+// match returns true, and waits for them to return.
+func (w *webhooks) stop(name string, match func(hook string) bool) {
+	w.mu.Lock()
+	var stopped []*webhookWorker
+	prefix := workerKey(name, "")
+	for key, worker := range w.workers {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix && match(key[len(prefix):]) {
+			worker.cancel()
+			stopped = append(stopped, worker)
+			delete(w.workers, key)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, worker := range stopped {
+		<-worker.done
+	}
+}
+
+// stopAll stops delivering every webhook and waits for them to
+// return.
+func (w *webhooks) stopAll() {
+	w.mu.Lock()
+	w.started = false
+	for key, worker := range w.workers {
+		worker.cancel()
+		delete(w.workers, key)
+	}
+	w.mu.Unlock()
+	w.running.Wait()
+}
+
+// startWebhooks starts delivering the webhooks of every collection.
+func (s server) startWebhooks() error {
+	hooks := s.cols.hooks
+	hooks.mu.Lock()
+	hooks.started = true
+	hooks.mu.Unlock()
+
+	for _, name := range s.listCollections() {
+		c, err := s.collection(name)
+		if err != nil {
+			continue
+		}
+		list, err := c.listWebhooks()
+		if err != nil {
+			return err
+		}
+		for _, hook := range list {
+			hooks.start(*c, hook.Name)
+		}
+	}
+	return nil
+}
+
+// getWebhook returns the stored record of webhook hook, or
+// ErrNoWebhook.
+func (s server) getWebhook(hook string) (*webhookRecord, error) {
+	value, closer, err := s.cols.root.Get(webhookKey(s.name, hook))
+	if err == ErrNotFound {
+		return nil, ErrNoWebhook
+	} else if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var rec webhookRecord
+	return &rec, json.Unmarshal(value, &rec)
+}
+
+// listWebhooks returns the webhooks of s in name order.
+func (s server) listWebhooks() ([]Webhook, error) {
+	prefix := webhooksPrefix(s.name)
+	iter := s.cols.root.NewIter(&IterOptions{LowerBound: prefix, UpperBound: prefixEnd(prefix)})
+	defer iter.Close()
+
+	list := []Webhook{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		name := iter.Key()[len(prefix):]
+		if bytes.IndexByte(name, 0) >= 0 {
+			// A webhook's matching ID
+			continue
+		}
+		var rec webhookRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil {
+			return nil, err
+		}
+		list = append(list, Webhook{Name: string(name), Query: rec.Query, URL: rec.URL})
+	}
+	return list, nil
+}
+
+// putWebhook adds hook to s, replacing any webhook with its name. It
+// starts from the documents matching its query now.
+func (s server) putWebhook(hook Webhook) error {
+	if !collectionNameRegexp.MatchString(hook.Name) {
+		return errBadWebhookName
+	}
+	if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+		return errBadWebhookURL
+	}
+	q, err := parseQuery(hook.Query)
+	if err != nil {
+		return &QueryError{Query: hook.Query, Err: err}
+	}
+	s.cols.hooks.stop(s.name, func(name string) bool { return name == hook.Name })
+
+	s.idx.mu.RLock()
+	defer s.idx.mu.RUnlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.exists() {
+		return ErrNoCollection
+	}
+
+	indexSnap, snap := s.indexDb().NewSnapshot(), s.db.NewSnapshot()
+	defer indexSnap.Close()
+	defer snap.Close()
+	ids, err := searchIndex(indexSnap, s.cfg, q)
+	if err != nil {
+		return err
+	}
+
+	def, err := json.Marshal(webhookRecord{Query: hook.Query, URL: hook.URL, Cursor: s.feed.last()})
+	if err != nil {
+		return err
+	}
+	b := s.cols.root.NewBatch()
+	defer b.Close()
+	key := webhookKey(s.name, hook.Name)
+	err = b.DeleteRange(key, prefixEnd(append(key, 0)))
+	if err == nil {
+		err = b.Set(key, def)
+	}
+	for i := 0; err == nil && i < len(ids); i++ {
+		err = b.Set(webhookMatchKey(s.name, hook.Name, ids[i]), nil)
+	}
+	if err == nil {
+		err = s.cols.root.Apply(b)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.cols.hooks.start(s, hook.Name)
+	return nil
+}
+
+// deleteWebhook removes webhook hook from s, or returns ErrNoWebhook.
+func (s server) deleteWebhook(hook string) error {
+	s.cols.hooks.stop(s.name, func(name string) bool { return name == hook })
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.getWebhook(hook); err != nil {
+		return err
+	}
+
+	b := s.cols.root.NewBatch()
+	defer b.Close()
+	key := webhookKey(s.name, hook)
+	err := b.DeleteRange(key, prefixEnd(append(key, 0)))
+	if err == nil {
+		err = s.cols.root.Apply(b)
+	}
+	return err
+}
+
+// runWebhook delivers the events of webhook hook of s, until ctx is
+// done or the webhook or collection is removed.
+func (s server) runWebhook(ctx context.Context, hook string) error {
+	rec, err := s.getWebhook(hook)
+	if err != nil {
+		return err
+	}
+	q, err := parseQuery(rec.Query)
+	if err != nil {
+		return err
+	}
+
+	for {
+		changes, err := s.changesSince(rec.Cursor, subscriptionBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			if err := s.waitForChanges(ctx, rec.Cursor); err != nil {
+				return err
+			}
+			continue
+		}
+
+		handled := false // Whether the cursor has moved since it was saved
+		for _, c := range changes {
+			event, err := s.webhookEventFor(hook, q, c)
+			if err != nil {
+				return err
+			}
+			rec.Cursor = c.Seq
+			handled = true
+			if event == nil {
+				continue
+			}
+
+			if err := s.deliverWebhook(ctx, rec.URL, event); err != nil {
+				return err
+			}
+			if err := s.saveWebhook(hook, rec, event); err != nil {
+				return err
+			}
+			handled = false
+		}
+		if handled {
+			// Save the cursor past changes without events
+			if err := s.saveWebhook(hook, rec, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// saveWebhook writes rec, with its cursor, as webhook hook, and
+// records the match of the document of event, which may be nil.
+func (s server) saveWebhook(hook string, rec *webhookRecord, event *webhookEvent) error {
+	def, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	b := s.cols.root.NewBatch()
+	defer b.Close()
+	err = b.Set(webhookKey(s.name, hook), def)
+	if err == nil && event != nil {
+		if event.Event == "match" {
+			err = b.Set(webhookMatchKey(s.name, hook, event.ID), nil)
+		} else {
+			err = b.Delete(webhookMatchKey(s.name, hook, event.ID))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.cols.root.Apply(b)
+}
+
+// webhookEventFor returns the event of webhook hook, with query q,
+// for change c, or nil if the document's match hasn't changed or c
+// isn't its latest change.
+func (s server) webhookEventFor(hook string, q *query, c Change) (*webhookEvent, error) {
+	document, rev, err := s.getDocument([]byte(c.ID))
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if c.Deleted != (document == nil) || (document != nil && rev != c.Rev) {
+		return nil, nil
+	}
+	matches := false
+	if document != nil {
+		if matches, err = matchesDocument(s.cfg, q, c.ID, document); err != nil {
+			return nil, err
+		}
+	}
+
+	_, closer, err := s.cols.root.Get(webhookMatchKey(s.name, hook, c.ID))
+	matched := err == nil
+	if matched {
+		closer.Close()
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+	if matches == matched {
+		return nil, nil
+	}
+
+	event := &webhookEvent{
+		Webhook:    hook,
+		Collection: s.name,
+		Event:      "match",
+		Seq:        c.Seq,
+		ID:         c.ID,
+		Rev:        c.Rev,
+		Deleted:    c.Deleted,
+		Document:   document,
+	}
+	if !matches {
+		event.Event = "unmatch"
+	}
+	return event, nil
+}
+
+// matchesDocument returns true if document with id matches q, by
+// indexing it alone in memory and searching that index.
+func matchesDocument(cfg *indexConfig, q *query, id string, document map[string]any) (bool, error) {
+	kv := NewMemoryKV()
+	defer kv.Close()
+	b := kv.NewBatch()
+	defer b.Close()
+
+	if err := indexBatch(b, cfg, id, document); err != nil {
+		return false, err
+	}
+	ids, err := searchIndex(b, cfg, q)
+	return len(ids) > 0, err
+}
+
+// deliverWebhook POSTs event to url, retrying until it's accepted or
+// ctx is done.
+func (s server) deliverWebhook(ctx context.Context, url string, event *webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	hooks := s.cols.hooks
+	delay := hooks.retry
+	for {
+		err := postWebhook(ctx, hooks.client, url, body)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Could not deliver webhook %s change %d, retrying in %v: %v",
+			workerKey(s.name, event.Webhook), event.Seq, delay, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+		if delay > hooks.maxRetry {
+			delay = hooks.maxRetry
+		}
+	}
+}
+
+// postWebhook POSTs body to url once.
+func postWebhook(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Receiver returned %s", resp.Status))
+	}
+	return nil
+}
+
+// StartWebhooks starts delivering the events of the webhooks of every
+// collection in the background, until the database is closed.
+// Webhooks added afterwards start straight away.
+func (db *DB) StartWebhooks() error {
+	return db.s.startWebhooks()
+}
+
+// PutWebhook adds hook to the collection, replacing any webhook with
+// its name. Events are delivered for writes after it's added, when a
+// document starts or stops matching hook.Query. Names are 1 to 64
+// lower case letters, digits, - or _.
+func (c *Collection) PutWebhook(ctx context.Context, hook Webhook) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.s.putWebhook(hook)
+}
+
+// DeleteWebhook removes webhook name from the collection, or returns
+// ErrNoWebhook.
+func (c *Collection) DeleteWebhook(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.s.deleteWebhook(name)
+}
+
+// Webhooks returns the webhooks of the collection, in name order.
+func (c *Collection) Webhooks(ctx context.Context) ([]Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.s.listWebhooks()
+}
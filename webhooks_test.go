@@ -0,0 +1,159 @@
+package docdb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookReceiver records the events POSTed to it, failing the first
+// fail requests.
+type webhookReceiver struct {
+	mu     sync.Mutex
+	fail   int
+	events []webhookEvent
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var event webhookEvent
+	json.NewDecoder(req.Body).Decode(&event)
+	r.events = append(r.events, event)
+}
+
+// wait returns the events once there are n of them.
+func (r *webhookReceiver) wait(t *testing.T, n int) []webhookEvent {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		r.mu.Lock()
+		events := append([]webhookEvent(nil), r.events...)
+		r.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+	}
+	t.Fatalf("Timed out waiting for %d webhook events", n)
+	return nil
+}
+
+func Test_webhooks(t *testing.T) {
+	d := t.TempDir()
+	s, err := newServer(d, nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+	s.cols.hooks.retry = time.Millisecond
+	receiver := &webhookReceiver{fail: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	s.addDocument("old", map[string]any{"status": "failed"})
+	hook := Webhook{Name: "failures", Query: `status:"failed"`, URL: server.URL}
+	assert.Nil(t, s.putWebhook(hook))
+	assert.Nil(t, s.startWebhooks())
+
+	s.addDocument("a", map[string]any{"status": "running"})
+	s.addDocument("a", map[string]any{"status": "failed"})
+	receiver.wait(t, 1)
+	s.addDocument("a", map[string]any{"status": "failed", "retried": false})
+	s.addDocument("old", map[string]any{"status": "done"})
+	receiver.wait(t, 2)
+	s.deleteDocument("a", anyRevision)
+	events := receiver.wait(t, 3)
+	assert.Equal(t, []webhookEvent{
+		{Webhook: "failures", Collection: "default", Event: "match", Seq: 3, ID: "a", Rev: 2,
+			Document: map[string]any{"status": "failed"}},
+		{Webhook: "failures", Collection: "default", Event: "unmatch", Seq: 5, ID: "old", Rev: 2,
+			Document: map[string]any{"status": "done"}},
+		{Webhook: "failures", Collection: "default", Event: "unmatch", Seq: 6, ID: "a", Rev: 3, Deleted: true},
+	}, events)
+
+	// Delivery resumes after the cursor after a restart
+	assert.Nil(t, s.close())
+	s, err = newServer(d, nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	defer s.close()
+	s.addDocument("b", map[string]any{"status": "failed"})
+	assert.Nil(t, s.startWebhooks())
+	events = receiver.wait(t, 4)
+	assert.Len(t, events, 4)
+	assert.Equal(t, "b", events[3].ID)
+
+	list, _ := s.listWebhooks()
+	assert.Equal(t, []Webhook{hook}, list)
+	assert.Nil(t, s.deleteWebhook("failures"))
+	assert.Equal(t, ErrNoWebhook, s.deleteWebhook("failures"))
+	list, _ = s.listWebhooks()
+	assert.Empty(t, list)
+	report, _ := s.checkIndex(false)
+	assert.True(t, report.ok())
+
+	assert.Equal(t, errBadWebhookURL, s.putWebhook(Webhook{Name: "x", Query: "a:1", URL: "ftp://x"}))
+	assert.Equal(t, errBadWebhookName, s.putWebhook(Webhook{Name: "X", Query: "a:1", URL: server.URL}))
+	assert.Error(t, s.putWebhook(Webhook{Name: "x", Query: "a:/[/", URL: server.URL}))
+}
+
+func Test_webhooksCollection(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenMemory(nil)
+	if err != nil {
+		t.Fatalf("Failed due to error: %v", err)
+	}
+	defer db.Close()
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	assert.NoError(t, db.StartWebhooks())
+	orders, _ := db.CreateCollection("orders", &Options{FullText: []string{"note"}})
+	assert.NoError(t, orders.PutWebhook(ctx, Webhook{Name: "urgent", Query: "note:~urgent", URL: server.URL}))
+	db.Put(ctx, "1", map[string]any{"note": "Urgent delivery"})
+	orders.Put(ctx, "1", map[string]any{"note": "Not urgent"})
+	orders.Put(ctx, "2", map[string]any{"note": "Whenever"})
+	events := receiver.wait(t, 1)
+	assert.Equal(t, "orders", events[0].Collection)
+	assert.Equal(t, "1", events[0].ID)
+
+	// Dropping the collection stops and removes its webhooks
+	assert.NoError(t, db.DropCollection("orders"))
+	orders, _ = db.CreateCollection("orders", nil)
+	hooks, _ := orders.Webhooks(ctx)
+	assert.Empty(t, hooks)
+}
+
+func Test_httpWebhooks(t *testing.T) {
+	s, err := newMemoryServer(nil)
+	if err != nil {
+		assert.FailNow(t, "Could not create s")
+	}
+
+	resp, _ := doRequest(t, s, "PUT", "/_webhooks/failures", `{"query": "status:failed", "url": "http://localhost:1/hook"}`, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/_webhooks/bad", `{"query": "status:/[/", "url": "http://localhost:1/hook"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, s, "PUT", "/_webhooks/bad", `{"query": "status:failed"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, body := doRequest(t, s, "GET", "/_webhooks", "", nil)
+	assert.Equal(t, map[string]any{"webhooks": []any{
+		map[string]any{"name": "failures", "query": "status:failed", "url": "http://localhost:1/hook"},
+	}}, body["body"])
+	resp, _ = doRequest(t, s, "DELETE", "/_webhooks/failures", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, s, "DELETE", "/_webhooks/failures", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = doRequest(t, s, "GET", "/collections/none/_webhooks", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}